@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"k8s.io/client-go/rest"
+
+	"github.com/clarkezone/previewd/internal"
+	"github.com/clarkezone/previewd/pkg/kubelayer"
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+// addClusterFlags adds the flags selecting the kube context and the cluster render jobs run in
+func addClusterFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&internal.KubeContext, internal.KubeContextVar,
+		viper.GetString(internal.KubeContextVar), "kubeconfig context to use, defaults to the current context")
+	flags.StringVar(&internal.Impersonate, internal.ImpersonateVar, viper.GetString(internal.ImpersonateVar),
+		"user or service account (system:serviceaccount:<namespace>:<name>) to create render jobs as")
+	flags.StringVar(&internal.ImpersonateGroups, internal.ImpersonateGroupsVar,
+		viper.GetString(internal.ImpersonateGroupsVar), "comma separated groups to create render jobs as")
+	flags.StringVar(&internal.BuildKubeConfigPath, internal.BuildKubeConfigPathVar,
+		viper.GetString(internal.BuildKubeConfigPathVar), "absolute path to a kubeconfig of a separate build cluster")
+	flags.StringVar(&internal.BuildKubeContext, internal.BuildKubeContextVar,
+		viper.GetString(internal.BuildKubeContextVar), "kubeconfig context of the cluster render jobs run in")
+}
+
+// getBuildConfig returns the config render jobs are created with and whether it targets a different
+// cluster than local.  Without a build kubeconfig or context this is local, the config previewd itself
+// runs with, impersonating the configured user if any.
+func getBuildConfig(local *rest.Config) (*rest.Config, bool, error) {
+	build := local
+	separate := false
+	if internal.BuildKubeConfigPath != "" || internal.BuildKubeContext != "" {
+		buildPath := internal.BuildKubeConfigPath
+		if buildPath == "" {
+			buildPath = internal.KubeConfigPath
+		}
+		if buildPath == "" {
+			return nil, false, fmt.Errorf("%v requires %v or %v", internal.BuildKubeContextVar,
+				internal.BuildKubeConfigPathVar, internal.KubeConfigPathVar)
+		}
+		var err error
+		build, err = kubelayer.GetConfigOutofClusterWithContext(buildPath, internal.BuildKubeContext)
+		if err != nil {
+			return nil, false, err
+		}
+		separate = build.Host != local.Host
+		clarkezoneLog.Successf("render jobs run in cluster %v from config %v context '%v'",
+			build.Host, buildPath, internal.BuildKubeContext)
+	}
+	if internal.Impersonate != "" {
+		clarkezoneLog.Successf("creating render jobs as %v", internal.Impersonate)
+	}
+	return kubelayer.WithImpersonation(build, internal.Impersonate, splitList(internal.ImpersonateGroups)), separate, nil
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/clarkezone/previewd/internal"
+	"github.com/clarkezone/previewd/pkg/kubelayer"
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+// gitTokenKey is the key of GitTokenSecret read when the key is not given
+const gitTokenKey = "token"
+
+// getGitToken returns the personal access token used to clone the target repo, read from
+// GitTokenFile or GitTokenSecret in namespace, or empty for anonymous access.  The token is never logged.
+func getGitToken(namespace string) (string, error) {
+	if internal.GitTokenFile != "" {
+		clarkezoneLog.Debugf("getGitToken() reading token from file %v", internal.GitTokenFile)
+		content, err := os.ReadFile(internal.GitTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("unable to read %v: %w", internal.GitTokenFileVar, err)
+		}
+		token := strings.TrimSpace(string(content))
+		if token == "" {
+			return "", fmt.Errorf("%v %v is empty", internal.GitTokenFileVar, internal.GitTokenFile)
+		}
+		return token, nil
+	}
+	if internal.GitTokenSecret == "" {
+		return "", nil
+	}
+	selector, err := kubelayer.ParseSecretKeySelector(internal.GitTokenSecret, gitTokenKey)
+	if err != nil {
+		return "", err
+	}
+	clarkezoneLog.Debugf("getGitToken() reading token from secret %v key %v", selector.Name, selector.Key)
+	// the secret is read from the cluster previewd runs in, not a separate build cluster
+	c, err := getConfig(true, true)
+	if err != nil {
+		return "", err
+	}
+	clientset, err := kubernetes.NewForConfig(c)
+	if err != nil {
+		return "", err
+	}
+	return kubelayer.ReadSecretKey(clientset, namespace, selector)
+}
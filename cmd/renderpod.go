@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/clarkezone/previewd/internal"
+	"github.com/clarkezone/previewd/pkg/jobmanager"
+	"github.com/clarkezone/previewd/pkg/kubelayer"
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+// addRenderPodFlags adds the flags configuring and hardening render pods to a command and binds them so
+// that they can also be set from the environment
+func addRenderPodFlags(flags *pflag.FlagSet) error {
+	flags.StringVar(&internal.RenderServiceAccount, internal.RenderServiceAccountVar,
+		viper.GetString(internal.RenderServiceAccountVar), "service account render pods run as")
+	flags.StringVar(&internal.RenderImagePullSecrets, internal.RenderImagePullSecretsVar,
+		viper.GetString(internal.RenderImagePullSecretsVar), "comma separated secrets used to pull render images")
+	flags.StringVar(&internal.RenderImagePullPolicy, internal.RenderImagePullPolicyVar,
+		viper.GetString(internal.RenderImagePullPolicyVar), "pull policy of render images: Always, IfNotPresent or Never")
+	flags.BoolVar(&internal.RenderRunAsNonRoot, internal.RenderRunAsNonRootVar,
+		viper.GetBool(internal.RenderRunAsNonRootVar), "require render pods to run as a non-root user")
+	flags.Int64Var(&internal.RenderRunAsUser, internal.RenderRunAsUserVar,
+		viper.GetInt64(internal.RenderRunAsUserVar), "uid render pods run as, 0 uses the image's user")
+	flags.Int64Var(&internal.RenderFSGroup, internal.RenderFSGroupVar,
+		viper.GetInt64(internal.RenderFSGroupVar), "fsGroup of render pods, should match the owner of files on the claims")
+	flags.BoolVar(&internal.RenderReadOnlyRootFS, internal.RenderReadOnlyRootFSVar,
+		viper.GetBool(internal.RenderReadOnlyRootFSVar), "make the root filesystem of render containers read only")
+	flags.StringVar(&internal.RenderSeccompProfile, internal.RenderSeccompProfileVar,
+		viper.GetString(internal.RenderSeccompProfileVar),
+		"seccomp profile of render pods: RuntimeDefault, Unconfined or Localhost/<profile>")
+	flags.StringVar(&internal.RenderDropCapabilities, internal.RenderDropCapabilitiesVar,
+		viper.GetString(internal.RenderDropCapabilitiesVar),
+		"comma separated capabilities dropped by render containers, eg ALL")
+	flags.BoolVar(&internal.RenderNetworkPolicy, internal.RenderNetworkPolicyVar,
+		viper.GetBool(internal.RenderNetworkPolicyVar),
+		"create a network policy limiting render pod egress to renderegressallow")
+	flags.StringVar(&internal.RenderEgressAllow, internal.RenderEgressAllowVar,
+		viper.GetString(internal.RenderEgressAllowVar),
+		"comma separated CIDRs, optionally suffixed with :port, that render pods may connect to")
+	for _, name := range []string{internal.RenderServiceAccountVar, internal.RenderImagePullSecretsVar,
+		internal.RenderImagePullPolicyVar, internal.RenderRunAsNonRootVar, internal.RenderRunAsUserVar,
+		internal.RenderFSGroupVar, internal.RenderReadOnlyRootFSVar, internal.RenderSeccompProfileVar,
+		internal.RenderDropCapabilitiesVar, internal.RenderNetworkPolicyVar, internal.RenderEgressAllowVar} {
+		err := viper.BindPFlag(name, flags.Lookup(name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getRenderSecurity returns the configured security options for render pods or nil if none are set
+func getRenderSecurity() (*kubelayer.SecurityOptions, error) {
+	security := &kubelayer.SecurityOptions{
+		RunAsNonRoot:           internal.RenderRunAsNonRoot,
+		RunAsUser:              internal.RenderRunAsUser,
+		FSGroup:                internal.RenderFSGroup,
+		ReadOnlyRootFilesystem: internal.RenderReadOnlyRootFS,
+		SeccompProfile:         internal.RenderSeccompProfile,
+		DropCapabilities:       splitList(internal.RenderDropCapabilities),
+	}
+	err := kubelayer.ValidateSeccompProfile(security.SeccompProfile)
+	if err != nil {
+		return nil, err
+	}
+	if !security.RunAsNonRoot && security.RunAsUser == 0 && security.FSGroup == 0 &&
+		!security.ReadOnlyRootFilesystem && security.SeccompProfile == "" && len(security.DropCapabilities) == 0 {
+		return nil, nil
+	}
+	return security, nil
+}
+
+// applyRenderPodOptions applies the configured pod options, security options and network policy to render jobs
+func applyRenderPodOptions(renderjm *jobmanager.Jobmanager, namespace string) error {
+	pullPolicy, err := kubelayer.ParsePullPolicy(internal.RenderImagePullPolicy)
+	if err != nil {
+		return err
+	}
+	renderjm.SetRenderPodOptions(kubelayer.PodOptions{
+		ServiceAccountName: internal.RenderServiceAccount,
+		ImagePullSecrets:   splitList(internal.RenderImagePullSecrets),
+		ImagePullPolicy:    pullPolicy,
+	})
+	security, err := getRenderSecurity()
+	if err != nil {
+		return err
+	}
+	renderjm.SetRenderSecurity(security)
+	if !internal.RenderNetworkPolicy {
+		return nil
+	}
+	rules := []kubelayer.EgressRule{}
+	for _, item := range splitList(internal.RenderEgressAllow) {
+		rule, err := kubelayer.ParseEgressRule(item)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, rule)
+	}
+	clarkezoneLog.Successf("limiting render pod egress in namespace '%v' to %v", namespace, rules)
+	return renderjm.EnsureRenderNetworkPolicy(namespace, rules)
+}
+
+// splitList splits a comma separated list ignoring empty items
+func splitList(value string) []string {
+	result := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}
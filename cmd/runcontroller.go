@@ -0,0 +1,131 @@
+// Package cmd contains commands
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/clarkezone/previewd/pkg/basicserver"
+	"github.com/clarkezone/previewd/pkg/config"
+	"github.com/clarkezone/previewd/pkg/jobmanager"
+	"github.com/clarkezone/previewd/pkg/sitepreview"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/clarkezone/previewd/internal"
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+// defaultControllerPollInterval is how often sites are polled for pushes when no interval is configured
+const defaultControllerPollInterval = time.Minute
+
+func getRunControllerCmd() *cobra.Command {
+	command := &cobra.Command{
+		Use:   "runcontroller --localdir=<path to local dir>",
+		Short: "Reconciles SitePreview resources into clones and render jobs",
+		Long: `Runs previewd as a controller that watches SitePreview custom resources.
+Each SitePreview is cloned into its own directory below localdir, where the source claim is
+mounted, or into the spec's localDir, and each of its branches is rendered by a kubernetes job.
+Build status, last commit and preview url are written back to the status of the resource.
+
+previewd runcontroller --localdir=/src
+previewd runcontroller --localdir=/src --namespace=previewdtest
+`,
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return internal.ValidatePollEnv()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			clarkezoneLog.Infof("previewd version:%s hash:%s\n", config.VersionString, config.VersionHash)
+			clarkezoneLog.Successf("runcontroller with port: %v, localdir:%v, namespace:'%v'",
+				internal.Port, internal.LocalDir, internal.Namespace)
+			return runController(internal.LocalDir, internal.Namespace)
+		},
+	}
+
+	command.PersistentFlags().StringVarP(&internal.LocalDir, internal.LocalDirVar, "d",
+		viper.GetString(internal.LocalDirVar), "absolute path to the mounted source claim to clone sites into")
+	command.PersistentFlags().StringVarP(&internal.KubeConfigPath, internal.KubeConfigPathVar, "k",
+		viper.GetString(internal.KubeConfigPathVar), "absolute path to a valid kubeconfig file")
+	addClusterFlags(command.PersistentFlags())
+	command.PersistentFlags().StringVarP(&internal.Namespace, internal.NamespaceVar, "n",
+		viper.GetString(internal.NamespaceVar), "Kube namespace to watch for SitePreviews, all namespaces if empty")
+	command.PersistentFlags().DurationVar(&internal.SucceededRetention, internal.SucceededRetentionVar,
+		viper.GetDuration(internal.SucceededRetentionVar), "how long to keep succeeded render jobs, 0 deletes immediately")
+	command.PersistentFlags().DurationVar(&internal.FailedRetention, internal.FailedRetentionVar,
+		viper.GetDuration(internal.FailedRetentionVar), "how long to keep failed render jobs, negative keeps them forever")
+	addControllerPollFlags(command.PersistentFlags())
+	err := addRenderPodFlags(command.PersistentFlags())
+	if err != nil {
+		panic(err)
+	}
+	return command
+}
+
+// addControllerPollFlags adds the flags polling sites, which unlike runwebhookserver poll by default as no
+// webhook reaches the controller
+func addControllerPollFlags(flags *pflag.FlagSet) {
+	interval := viper.GetDuration(internal.PollIntervalVar)
+	if interval == 0 {
+		interval = defaultControllerPollInterval
+	}
+	flags.DurationVar(&internal.PollInterval, internal.PollIntervalVar, interval,
+		"how often to poll the branches of each site for new commits, 0 disables polling")
+	flags.Float64Var(&internal.PollJitter, internal.PollJitterVar,
+		viper.GetFloat64(internal.PollJitterVar), "fraction by which each poll interval is randomly varied")
+	flags.DurationVar(&internal.PollMaxBackoff, internal.PollMaxBackoffVar,
+		viper.GetDuration(internal.PollMaxBackoffVar), "longest wait between polls after polls fail")
+}
+
+func runController(localDir string, namespace string) error {
+	c, err := getConfig(true, true)
+	if err != nil {
+		return err
+	}
+	// jobs are created in the namespace of each SitePreview so watch them everywhere we watch sites
+	buildConfig, separate, err := getBuildConfig(c)
+	if err != nil {
+		return err
+	}
+	controllerjm, err := jobmanager.Newjobmanager(buildConfig, namespace, false, false)
+	if err != nil {
+		return err
+	}
+	if !separate {
+		setJobOwner(controllerjm.KubeSession(), namespace)
+	}
+	controllerjm.SetRetention(getRetentionPolicy())
+	if internal.RenderNetworkPolicy && namespace == "" {
+		return fmt.Errorf("%v requires a namespace in controller mode", internal.RenderNetworkPolicyVar)
+	}
+	err = applyRenderPodOptions(controllerjm, namespace)
+	if err != nil {
+		return err
+	}
+
+	controller, err := sitepreview.NewController(c, controllerjm, localDir, namespace)
+	if err != nil {
+		return err
+	}
+	if internal.PollInterval > 0 {
+		controller.SetPolling(internal.PollInterval, internal.PollJitter, internal.PollMaxBackoff)
+	}
+	// Watchers must be started after the controller has registered for build notifications
+	err = controllerjm.StartWatchers(false)
+	if err != nil {
+		return err
+	}
+	err = controller.Start()
+	if err != nil {
+		return err
+	}
+	defer controller.Stop()
+
+	server := basicserver.CreateBasicServer()
+	server.StartListen("", basicserver.NewLoggingMiddleware(basicserver.DefaultMux()))
+	return server.WaitforInterupt()
+}
+
+func init() {
+	rootCmd.AddCommand(getRunControllerCmd())
+}
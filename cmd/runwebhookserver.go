@@ -6,7 +6,7 @@ Copyright © 2022 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
-	"os"
+	"fmt"
 	"path"
 
 	"github.com/clarkezone/previewd/pkg/config"
@@ -22,11 +22,16 @@ import (
 	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
 )
 
+// dryRunFlag is spelt like kubectl's flag rather than after its viper key
+const dryRunFlag = "dry-run"
+
 var (
 	lrm              *llrm.LocalRepoManager
 	jm               *jobmanager.Jobmanager
 	enableBranchMode bool
 	whl              *webhooklistener.WebhookListener
+	// repoToken is the personal access token used to clone the target repo, empty for anonymous access
+	repoToken string
 )
 
 type providers interface {
@@ -63,7 +68,7 @@ previewd runwebhookserver --targetrepo=test --localdir=/tmp --initialclone=false
 			previewserver := false
 			clarkezoneLog.Infof("previewd version:%s hash:%s\n", config.VersionString, config.VersionHash)
 			clarkezoneLog.Successf("runwebhookserver with port: %v, TargetRepo:%v, localdir:%v, initialbranch:%v, namespace:'%v'",
-				internal.Port, internal.TargetRepo, internal.LocalDir, internal.InitialBranch, internal.Namespace)
+				internal.Port, llrm.RedactURL(internal.TargetRepo), internal.LocalDir, internal.InitialBranch, internal.Namespace)
 			clarkezoneLog.Successf(" clone on run:%v, build on run:%v, start webhook server:%v, start preview server:%v",
 				internal.InitialClone, internal.InitialBuild, internal.WebhookListen, previewserver)
 
@@ -95,6 +100,8 @@ func setupFlags(command *cobra.Command) error {
 		return err
 	}
 
+	addClusterFlags(command.PersistentFlags())
+
 	command.PersistentFlags().StringVarP(&internal.Namespace, internal.NamespaceVar, "n",
 		viper.GetString(internal.NamespaceVar), "Kube namespace for creating resources")
 	err = viper.BindPFlag(internal.NamespaceVar, command.PersistentFlags().Lookup(internal.NamespaceVar))
@@ -121,7 +128,206 @@ func setupFlags(command *cobra.Command) error {
 	if err != nil {
 		return err
 	}
-	return nil
+
+	command.PersistentFlags().StringVar(&internal.Executor, internal.ExecutorVar,
+		viper.GetString(internal.ExecutorVar), "where render jobs run: kube or local")
+	err = viper.BindPFlag(internal.ExecutorVar, command.PersistentFlags().Lookup(internal.ExecutorVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.OutputDir, internal.OutputDirVar,
+		viper.GetString(internal.OutputDirVar), "local dir to render into when executor is local, default localdir/output")
+	err = viper.BindPFlag(internal.OutputDirVar, command.PersistentFlags().Lookup(internal.OutputDirVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.DryRun, dryRunFlag, viper.GetString(internal.DryRunVar),
+		"print kubernetes objects instead of creating them: none, client or server")
+	command.PersistentFlags().Lookup(dryRunFlag).NoOptDefVal = string(kubelayer.DryRunClient)
+	err = viper.BindPFlag(internal.DryRunVar, command.PersistentFlags().Lookup(dryRunFlag))
+	if err != nil {
+		return err
+	}
+	command.PersistentFlags().StringVar(&internal.RenderClaim, internal.RenderClaimVar,
+		viper.GetString(internal.RenderClaimVar), "name or label selector of the claim render jobs write to")
+	err = viper.BindPFlag(internal.RenderClaimVar, command.PersistentFlags().Lookup(internal.RenderClaimVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.SourceClaim, internal.SourceClaimVar,
+		viper.GetString(internal.SourceClaimVar), "name or label selector of the claim holding the source")
+	err = viper.BindPFlag(internal.SourceClaimVar, command.PersistentFlags().Lookup(internal.SourceClaimVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.RenderEnv, internal.RenderEnvVar,
+		viper.GetString(internal.RenderEnvVar), "comma separated NAME=value environment variables of render jobs")
+	err = viper.BindPFlag(internal.RenderEnvVar, command.PersistentFlags().Lookup(internal.RenderEnvVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.RenderEnvFrom, internal.RenderEnvFromVar,
+		viper.GetString(internal.RenderEnvFromVar),
+		"comma separated secret/<name> or configmap/<name> whose keys are set in the environment of render jobs")
+	err = viper.BindPFlag(internal.RenderEnvFromVar, command.PersistentFlags().Lookup(internal.RenderEnvFromVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.GitUsername, internal.GitUsernameVar,
+		viper.GetString(internal.GitUsernameVar), "username sent with the repo access token, required by Gitea and GitLab")
+	err = viper.BindPFlag(internal.GitUsernameVar, command.PersistentFlags().Lookup(internal.GitUsernameVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.GitTokenFile, internal.GitTokenFileVar,
+		viper.GetString(internal.GitTokenFileVar), "path of a file containing a personal access token for the repo")
+	err = viper.BindPFlag(internal.GitTokenFileVar, command.PersistentFlags().Lookup(internal.GitTokenFileVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.GitTokenSecret, internal.GitTokenSecretVar,
+		viper.GetString(internal.GitTokenSecretVar),
+		"<name> or <name>/<key> of a secret containing a personal access token for the repo, key defaults to token")
+	err = viper.BindPFlag(internal.GitTokenSecretVar, command.PersistentFlags().Lookup(internal.GitTokenSecretVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.GitSSHKey, internal.GitSSHKeyVar,
+		viper.GetString(internal.GitSSHKeyVar), "path of a private deploy key used when the repo is an ssh remote")
+	err = viper.BindPFlag(internal.GitSSHKeyVar, command.PersistentFlags().Lookup(internal.GitSSHKeyVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.GitSSHPassphrase, internal.GitSSHPassphraseVar,
+		viper.GetString(internal.GitSSHPassphraseVar),
+		"passphrase of an encrypted deploy key, prefer setting GITSSHPASSPHRASE from a secret")
+	err = viper.BindPFlag(internal.GitSSHPassphraseVar, command.PersistentFlags().Lookup(internal.GitSSHPassphraseVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.GitKnownHosts, internal.GitKnownHostsVar,
+		viper.GetString(internal.GitKnownHostsVar), "path of a known_hosts file used to verify ssh remotes")
+	err = viper.BindPFlag(internal.GitKnownHostsVar, command.PersistentFlags().Lookup(internal.GitKnownHostsVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().IntVar(&internal.CloneDepth, internal.CloneDepthVar,
+		viper.GetInt(internal.CloneDepthVar), "number of commits of history to clone and fetch, 0 for full history")
+	err = viper.BindPFlag(internal.CloneDepthVar, command.PersistentFlags().Lookup(internal.CloneDepthVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().BoolVar(&internal.SingleBranch, internal.SingleBranchVar,
+		viper.GetBool(internal.SingleBranchVar), "clone only the default branch, fetching other branches when built")
+	err = viper.BindPFlag(internal.SingleBranchVar, command.PersistentFlags().Lookup(internal.SingleBranchVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().BoolVar(&internal.NoTags, internal.NoTagsVar,
+		viper.GetBool(internal.NoTagsVar), "do not fetch tags")
+	err = viper.BindPFlag(internal.NoTagsVar, command.PersistentFlags().Lookup(internal.NoTagsVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().BoolVar(&internal.Submodules, internal.SubmodulesVar,
+		viper.GetBool(internal.SubmodulesVar), "initialize and update submodules recursively, eg themes")
+	err = viper.BindPFlag(internal.SubmodulesVar, command.PersistentFlags().Lookup(internal.SubmodulesVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().BoolVar(&internal.CloneInJob, internal.CloneInJobVar,
+		viper.GetBool(internal.CloneInJobVar),
+		"clone the commit being built inside render jobs instead of sharing a source claim")
+	err = viper.BindPFlag(internal.CloneInJobVar, command.PersistentFlags().Lookup(internal.CloneInJobVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.CloneImage, internal.CloneImageVar,
+		viper.GetString(internal.CloneImageVar), "image containing git and sh used to clone inside render jobs")
+	err = viper.BindPFlag(internal.CloneImageVar, command.PersistentFlags().Lookup(internal.CloneImageVar))
+	if err != nil {
+		return err
+	}
+
+	err = addRenderPodFlags(command.PersistentFlags())
+	if err != nil {
+		return err
+	}
+	err = setupPollFlags(command)
+	if err != nil {
+		return err
+	}
+	return setupRetentionFlags(command)
+}
+
+func setupPollFlags(command *cobra.Command) error {
+	command.PersistentFlags().DurationVar(&internal.PollInterval, internal.PollIntervalVar,
+		viper.GetDuration(internal.PollIntervalVar), "how often to poll the repo for new commits, 0 disables polling")
+	err := viper.BindPFlag(internal.PollIntervalVar, command.PersistentFlags().Lookup(internal.PollIntervalVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().Float64Var(&internal.PollJitter, internal.PollJitterVar,
+		viper.GetFloat64(internal.PollJitterVar), "fraction by which each poll interval is randomly varied")
+	err = viper.BindPFlag(internal.PollJitterVar, command.PersistentFlags().Lookup(internal.PollJitterVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().DurationVar(&internal.PollMaxBackoff, internal.PollMaxBackoffVar,
+		viper.GetDuration(internal.PollMaxBackoffVar), "longest wait between polls after polls fail")
+	err = viper.BindPFlag(internal.PollMaxBackoffVar, command.PersistentFlags().Lookup(internal.PollMaxBackoffVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().StringVar(&internal.PollBranches, internal.PollBranchesVar,
+		viper.GetString(internal.PollBranchesVar), "comma separated branches to poll, default every branch")
+	return viper.BindPFlag(internal.PollBranchesVar, command.PersistentFlags().Lookup(internal.PollBranchesVar))
+}
+
+func setupRetentionFlags(command *cobra.Command) error {
+	command.PersistentFlags().DurationVar(&internal.SucceededRetention, internal.SucceededRetentionVar,
+		viper.GetDuration(internal.SucceededRetentionVar), "how long to keep succeeded render jobs, 0 deletes immediately")
+	err := viper.BindPFlag(internal.SucceededRetentionVar,
+		command.PersistentFlags().Lookup(internal.SucceededRetentionVar))
+	if err != nil {
+		return err
+	}
+
+	command.PersistentFlags().DurationVar(&internal.FailedRetention, internal.FailedRetentionVar,
+		viper.GetDuration(internal.FailedRetentionVar), "how long to keep failed render jobs, negative keeps them forever")
+	return viper.BindPFlag(internal.FailedRetentionVar, command.PersistentFlags().Lookup(internal.FailedRetentionVar))
+}
+
+// getRetentionPolicy returns the configured retention for finished render jobs
+func getRetentionPolicy() jobmanager.RetentionPolicy {
+	policy := jobmanager.RetentionPolicy{Succeeded: internal.SucceededRetention, Failed: internal.FailedRetention}
+	if policy.Succeeded < 0 {
+		policy.Succeeded = jobmanager.KeepForever
+	}
+	if policy.Failed < 0 {
+		policy.Failed = jobmanager.KeepForever
+	}
+	return policy
 }
 
 func getConfig(ib bool, wl bool) (*rest.Config, error) {
@@ -133,10 +339,13 @@ func getConfig(ib bool, wl bool) (*rest.Config, error) {
 	var c *rest.Config
 	var err error
 	if internal.KubeConfigPath == "" {
+		if internal.KubeContext != "" {
+			return nil, fmt.Errorf("%v requires %v", internal.KubeContextVar, internal.KubeConfigPathVar)
+		}
 		c, err = kubelayer.GetConfigIncluster()
 		clarkezoneLog.Successf("launching inside kubernetes cluster with cluster config")
 	} else {
-		c, err = kubelayer.GetConfigOutofCluster(internal.KubeConfigPath)
+		c, err = kubelayer.GetConfigOutofClusterWithContext(internal.KubeConfigPath, internal.KubeContext)
 		clarkezoneLog.Successf("launching from outside kubernetes cluster with config %v",
 			internal.KubeConfigPath)
 	}
@@ -146,20 +355,11 @@ func getConfig(ib bool, wl bool) (*rest.Config, error) {
 // PerformActions runs the webhook logic
 func PerformActions(provider providers, repo string, localRootDir string, initialBranch string,
 	namespace string, webhooklisten bool, serve bool, initialbuild bool, initialclone bool) error {
-	sourceDir := path.Join(localRootDir, "sourceroot")
 	clarkezoneLog.Debugf("PerformActions() with providers:%v, repo:%v, localRootDir:%v, initialBranch:%v,",
-		provider, repo, localRootDir, initialBranch)
+		provider, llrm.RedactURL(repo), localRootDir, initialBranch)
 	clarkezoneLog.Debugf(" namespace:%v, webhooklisten:%v, serve:%v, initialBuild:%v, initialClone:%v",
 		namespace, webhooklisten, serve, initialbuild, initialclone)
 
-	fileinfo, res := os.Stat(sourceDir)
-	if fileinfo != nil && res == nil {
-		err := os.RemoveAll(sourceDir)
-		if err != nil {
-			return err
-		}
-	}
-
 	var err error
 
 	// When running unit tests, don't initialize dependencies
@@ -204,14 +404,11 @@ func PerformActions(provider providers, repo string, localRootDir string, initia
 func intitializeDependencies(provider providers, webhooklisten bool, initialbuild bool,
 	namespace string, localRootDir string) error {
 	if provider.needInitialization() {
-		c, err := getConfig(internal.InitialBuild, internal.WebhookListen)
-		if err != nil {
-			return err
-		}
+		var err error
 		if webhooklisten || initialbuild {
 			// possible that integration tests has preconfigured job manager
 			if jm == nil {
-				jm, err = jobmanager.Newjobmanager(c, namespace, true, false)
+				jm, err = createJobManager(namespace, localRootDir)
 				if err != nil {
 					return err
 				}
@@ -222,17 +419,138 @@ func intitializeDependencies(provider providers, webhooklisten bool, initialbuil
 			clarkezoneLog.Debugf("Unable to create localrepomanager via CreateLocalRepoManager")
 			return err
 		}
+		spec, err := getRenderSpec()
+		if err != nil {
+			return err
+		}
+		lrm.SetRenderSpec(spec)
+		lrm.SetGitUsername(internal.GitUsername)
+		lrm.SetCloneOptions(internal.CloneDepth, internal.SingleBranch, internal.NoTags)
+		lrm.SetSubmodules(internal.Submodules)
+		if internal.GitSSHKey != "" {
+			lrm.SetSSHKey(internal.GitSSHKey, internal.GitSSHPassphrase, internal.GitKnownHosts)
+		}
+		repoToken, err = getGitToken(namespace)
+		if err != nil {
+			return err
+		}
+		if internal.CloneInJob {
+			lrm.SetCloneInJob(internal.TargetRepo)
+		}
 		whl = webhooklistener.CreateWebhookListener(lrm)
+		if internal.PollInterval > 0 {
+			whl.SetPolling(splitList(internal.PollBranches), internal.PollInterval, internal.PollJitter,
+				internal.PollMaxBackoff)
+		}
 	}
 	return nil
 }
 
+// getRenderSpec returns the Jekyll render spec with any configured claims and environment
+func getRenderSpec() (jobmanager.RenderSpec, error) {
+	spec := jobmanager.GetJekyllRenderSpec()
+	if internal.RenderClaim != "" {
+		spec.RenderClaim = internal.RenderClaim
+	}
+	if internal.SourceClaim != "" {
+		spec.SourceClaim = internal.SourceClaim
+	}
+	spec.CloneImage = internal.CloneImage
+	if internal.GitTokenSecret != "" {
+		// render jobs read the token from the secret themselves, it must exist in the namespace they run in
+		selector, err := kubelayer.ParseSecretKeySelector(internal.GitTokenSecret, gitTokenKey)
+		if err != nil {
+			return jobmanager.RenderSpec{}, err
+		}
+		spec.CloneTokenSecret = &selector
+		spec.CloneUsername = internal.GitUsername
+	}
+	for _, value := range splitList(internal.RenderEnv) {
+		env, err := kubelayer.ParseEnvVar(value)
+		if err != nil {
+			return jobmanager.RenderSpec{}, err
+		}
+		spec.Env = append(spec.Env, env)
+	}
+	for _, value := range splitList(internal.RenderEnvFrom) {
+		envFrom, err := kubelayer.ParseEnvFromSource(value)
+		if err != nil {
+			return jobmanager.RenderSpec{}, err
+		}
+		spec.EnvFrom = append(spec.EnvFrom, envFrom)
+	}
+	return spec, nil
+}
+
+// createJobManager creates a jobmanager for the configured executor
+func createJobManager(namespace string, localRootDir string) (*jobmanager.Jobmanager, error) {
+	if internal.Executor == internal.LocalExecutor {
+		outputDir := internal.OutputDir
+		if outputDir == "" {
+			outputDir = path.Join(localRootDir, "output")
+		}
+		clarkezoneLog.Successf("running render jobs locally with output to %v", outputDir)
+		// render jobs mount the local root at /src and output at /site
+		mounts := map[string]string{"/src": localRootDir, "/site": outputDir}
+		localjm, err := jobmanager.NewLocalJobmanager(path.Join(localRootDir, "source"), mounts)
+		if err != nil {
+			return nil, err
+		}
+		localjm.SetRetention(getRetentionPolicy())
+		return localjm, nil
+	}
+
+	c, err := getConfig(internal.InitialBuild, internal.WebhookListen)
+	if err != nil {
+		return nil, err
+	}
+	buildConfig, separate, err := getBuildConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	kubejm, err := jobmanager.Newjobmanager(buildConfig, namespace, true, false)
+	if err != nil {
+		return nil, err
+	}
+	// owner references cannot refer to the previewd pod from another cluster
+	if !separate {
+		setJobOwner(kubejm.KubeSession(), namespace)
+	}
+	mode, err := kubelayer.ParseDryRunMode(internal.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	if mode.IsDryRun() {
+		clarkezoneLog.Successf("dry-run %v: kubernetes objects will be printed, not created", mode)
+	}
+	kubejm.KubeSession().SetDryRun(mode)
+	kubejm.SetRetention(getRetentionPolicy())
+	err = applyRenderPodOptions(kubejm, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return kubejm, nil
+}
+
+// setJobOwner makes the pod previewd is running in the owner of render jobs
+// so that jobs are garbage collected along with it
+func setJobOwner(ks *kubelayer.KubeSession, namespace string) {
+	if internal.PodName == "" {
+		clarkezoneLog.Debugf("setJobOwner() no pod name configured, render jobs will have no owner")
+		return
+	}
+	err := ks.SetJobOwnerFromPod(internal.PodName, namespace)
+	if err != nil {
+		clarkezoneLog.Errorf("unable to find pod %v to own render jobs: %v", internal.PodName, err)
+	}
+}
+
 func (xxxProvider) needInitialization() bool {
 	return true
 }
 
 func (xxxProvider) initialClone(repo string, initialBranch string) error {
-	err := lrm.InitialClone(repo, "")
+	err := lrm.InitialClone(repo, repoToken)
 	if err != nil {
 		return err
 	}
@@ -253,7 +571,7 @@ func (xxxProvider) waitForInterupt() error {
 
 func (xxxProvider) initialBuild(namespace string) error {
 	clarkezoneLog.Debugf("initialbuild() with namespace %v", namespace)
-	return jobmanager.CreateJekyllJob(namespace, jm.KubeSession(), jm)
+	return jobmanager.CreateRenderJob(namespace, jm.KubeSession(), jm, lrm.RenderSpec(), lrm.CurrentBuild())
 }
 
 func init() {
@@ -8,6 +8,7 @@ package cmd
 
 import (
 	"log"
+	"strings"
 	"testing"
 	"time"
 
@@ -100,7 +101,7 @@ func TestCreateJobRenderSimulateK8sDeployment(t *testing.T) {
 	args := []string{"runwebhookserver", "--targetrepo=https://github.com/clarkezone/clarkezone.github.io.git",
 		"--localdir=/src", " --initialclone=false",
 		"--initialbuild=false", "--webhooklisten=true", "--loglevel=debug"}
-	_, err := ks.CreateJob("rendertopv", testNamespace, previewdImagePath, cmd, args, nil, false, refs)
+	_, err := ks.CreateJob("rendertopv", testNamespace, previewdImagePath, cmd, args, nil, false, refs, nil)
 	if err != nil {
 		t.Fatalf("create job failed: %v", err)
 	}
@@ -122,18 +123,21 @@ func TestFullE2eTestWithWebhook(t *testing.T) {
 	wp := newE2mockprovider(p)
 	cmd := getRunWebhookServerCmd(wp)
 
+	// each build's job is named after the render spec's job name and the build id
+	renderJob := mock.MatchedBy(func(name string) bool { return strings.HasPrefix(name, "jekyll-render-container-") })
 	cm.On("CreateJob",
-		"jekyll-render-container", testNamespace,
+		renderJob, testNamespace,
 		mock.AnythingOfType("string"),                // image
 		mock.AnythingOfType("[]string"),              // command
 		mock.AnythingOfType("[]string"),              // args
 		mock.AnythingOfType("kubelayer.JobNotifier"), // notifier
 		false, // autodelete
 		mock.AnythingOfType("[]kubelayer.PVClaimMountRef"), // mountlist
+		mock.AnythingOfType("*kubelayer.JobOptions"),       // opts
 		nil, // this is the result returned by the underlying createjob implementation.  Used to ensure job creation succeeded
 	)
 
-	cm.On("DeleteJob", "jekyll-render-container", testNamespace)
+	cm.On("DeleteJob", renderJob, testNamespace)
 
 	// targetrepo and localdir are unused as no initial clone
 	// webhook will run job in cluster
@@ -159,7 +163,7 @@ func TestFullE2eTestWithWebhook(t *testing.T) {
 		t.Fatalf("Incorrect deletejob count")
 	}
 
-	err := lrm.HandleWebhook("main", false)
+	err := lrm.HandleWebhook("main", "", false)
 	if err != nil {
 		t.Fatalf("body read failed: %v", err)
 	}
@@ -269,7 +273,7 @@ func createJobForTestServerWithMountedVols(t *testing.T, ks *kubelayer.KubeSessi
 	refs := []kubelayer.PVClaimMountRef{renderref, srcref}
 	cmd := []string{"./previewd"}
 	args := []string{"testserver"}
-	_, err := ks.CreateJob("testserver", testNamespace, previewdImagePath, cmd, args, nil, false, refs)
+	_, err := ks.CreateJob("testserver", testNamespace, previewdImagePath, cmd, args, nil, false, refs, nil)
 	if err != nil {
 		t.Fatalf("create job failed: %v", err)
 	}
@@ -281,7 +285,7 @@ func runTestJod(ks *kubelayer.KubeSession, jobName string, testNamespace string,
 	mountlist []kubelayer.PVClaimMountRef) batchv1.Job {
 	defer ks.Close()
 	_, err := ks.CreateJob(jobName, testNamespace, imageUrl,
-		command, args, notifier, false, mountlist)
+		command, args, notifier, false, mountlist, nil)
 	if err != nil {
 		t.Fatalf("Unable to create job %v", err)
 	}
@@ -361,10 +365,10 @@ type CompletionTrackingJobManager struct {
 
 func (o *CompletionTrackingJobManager) CreateJob(name string, namespace string,
 	image string, command []string, args []string, notifier kubelayer.JobNotifier,
-	autoDelete bool, mountlist []kubelayer.PVClaimMountRef) (*batchv1.Job, error) {
+	autoDelete bool, mountlist []kubelayer.PVClaimMountRef, opts *kubelayer.JobOptions) (*batchv1.Job, error) {
 	job, err := o.wrappedJob.CreateJob(name, namespace, image, command,
-		args, notifier, autoDelete, mountlist)
-	o.Called(name, namespace, image, command, args, notifier, autoDelete, mountlist, err)
+		args, notifier, autoDelete, mountlist, opts)
+	o.Called(name, namespace, image, command, args, notifier, autoDelete, mountlist, opts, err)
 	return job, err
 }
 
@@ -381,6 +385,12 @@ func (o *CompletionTrackingJobManager) FailedJob(name string, namespace string)
 	o.done <- true
 }
 
+func (o *CompletionTrackingJobManager) SucceededJob(name string, namespace string) {
+	o.Called(name, namespace)
+	o.wrappedJob.SucceededJob(name, namespace)
+	o.done <- true
+}
+
 func (o *CompletionTrackingJobManager) InProgress() bool {
 	return o.wrappedJob.InProgress()
 }
@@ -1,12 +1,16 @@
 package cmd
 
 import (
+	"os"
+	"path"
 	"testing"
 
 	"github.com/clarkezone/previewd/internal"
 	"github.com/clarkezone/previewd/pkg/kubelayer"
 	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/mock"
 	"k8s.io/client-go/rest"
 )
@@ -151,3 +155,42 @@ func GetTestConfig(t *testing.T) *rest.Config {
 	}
 	return c
 }
+
+func TestGetGitTokenFromFile(t *testing.T) {
+	tokenFile := path.Join(t.TempDir(), "token")
+	err := os.WriteFile(tokenFile, []byte("secrettoken\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous string) { internal.GitTokenFile = previous }(internal.GitTokenFile)
+	internal.GitTokenFile = tokenFile
+	token, err := getGitToken("")
+	if err != nil || token != "secrettoken" {
+		t.Fatalf("unexpected token %v %v", token, err)
+	}
+	internal.GitTokenFile = path.Join(t.TempDir(), "missing")
+	_, err = getGitToken("")
+	if err == nil {
+		t.Fatalf("expected missing token file to fail")
+	}
+}
+
+func TestRenderPodFlagsBound(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	err := addRenderPodFlags(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = flags.Parse([]string{"--" + internal.RenderServiceAccountVar + "=renderer",
+		"--" + internal.RenderRunAsUserVar + "=1000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if viper.GetString(internal.RenderServiceAccountVar) != "renderer" ||
+		viper.GetInt64(internal.RenderRunAsUserVar) != 1000 {
+		t.Fatalf("render pod flags not bound")
+	}
+	if viper.GetString(internal.RenderImagePullPolicyVar) != "Always" || viper.GetBool(internal.RenderNetworkPolicyVar) {
+		t.Fatalf("render pod flag defaults not applied")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 
 	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
 	"github.com/spf13/viper"
@@ -29,6 +30,21 @@ const (
 	// KubeConfigPathVar is name of environment variable for kube config path
 	KubeConfigPathVar = "kubeconfigpath"
 
+	// KubeContextVar is name of environment variable for the kube config context
+	KubeContextVar = "kubecontext"
+
+	// ImpersonateVar is name of environment variable for the user or service account render jobs are created as
+	ImpersonateVar = "impersonate"
+
+	// ImpersonateGroupsVar is name of environment variable for the groups render jobs are created as
+	ImpersonateGroupsVar = "impersonategroups"
+
+	// BuildKubeConfigPathVar is name of environment variable for the kube config path of the build cluster
+	BuildKubeConfigPathVar = "buildkubeconfigpath"
+
+	// BuildKubeContextVar is name of environment variable for the kube config context of the build cluster
+	BuildKubeContextVar = "buildkubecontext"
+
 	// NamespaceVar is name of environment variable for kube namespace
 	NamespaceVar = "namespace"
 
@@ -43,6 +59,123 @@ const (
 
 	// InitialBranchVar is the name environment variable for the webhook listen flag
 	InitialBranchVar = "initialbranch"
+
+	// ExecutorVar is the name of environment variable selecting where render jobs run
+	ExecutorVar = "executor"
+	// KubeExecutor runs render jobs as kubernetes jobs
+	KubeExecutor = "kube"
+	// LocalExecutor runs render jobs as local processes
+	LocalExecutor = "local"
+
+	// OutputDirVar is the name of environment variable for the local executor's output dir
+	OutputDirVar = "outputdir"
+
+	// GitUsernameVar is the name of environment variable for the username sent with the repo access token
+	GitUsernameVar = "gitusername"
+
+	// GitTokenFileVar is the name of environment variable for the path of a file containing the repo access token
+	GitTokenFileVar = "gittokenfile"
+
+	// GitTokenSecretVar is the name of environment variable for the secret containing the repo access token
+	GitTokenSecretVar = "gittokensecret"
+
+	// GitSSHKeyVar is the name of environment variable for the path of the deploy key used for ssh remotes
+	GitSSHKeyVar = "gitsshkey"
+
+	// GitSSHPassphraseVar is the name of environment variable for the passphrase of an encrypted deploy key
+	GitSSHPassphraseVar = "gitsshpassphrase"
+
+	// GitKnownHostsVar is the name of environment variable for the path of the known_hosts file used to
+	// verify ssh remotes
+	GitKnownHostsVar = "gitknownhosts"
+
+	// CloneDepthVar is the name of environment variable for the number of commits of history cloned
+	CloneDepthVar = "clonedepth"
+
+	// SingleBranchVar is the name of environment variable selecting cloning only the default branch
+	SingleBranchVar = "singlebranch"
+
+	// NoTagsVar is the name of environment variable selecting not fetching tags
+	NoTagsVar = "notags"
+
+	// SubmodulesVar is the name of environment variable selecting cloning submodules recursively
+	SubmodulesVar = "submodules"
+
+	// CloneInJobVar is the name of environment variable selecting cloning inside render jobs
+	CloneInJobVar = "cloneinjob"
+
+	// CloneImageVar is the name of environment variable for the image used to clone inside render jobs
+	CloneImageVar = "cloneimage"
+
+	// DryRunVar is the name of environment variable selecting dry-run mode: none, client or server
+	DryRunVar = "dryrun"
+
+	// SucceededRetentionVar is the name of environment variable for how long succeeded jobs are kept
+	SucceededRetentionVar = "succeededjobretention"
+
+	// FailedRetentionVar is the name of environment variable for how long failed jobs are kept
+	FailedRetentionVar = "failedjobretention"
+
+	// PollIntervalVar is the name of environment variable for how often the remote is polled for new commits
+	PollIntervalVar = "pollinterval"
+
+	// PollJitterVar is the name of environment variable for the fraction poll intervals are randomly varied by
+	PollJitterVar     = "polljitter"
+	defaultPollJitter = 0.1
+
+	// PollMaxBackoffVar is the name of environment variable for the longest wait between failed polls
+	PollMaxBackoffVar = "pollmaxbackoff"
+
+	// PollBranchesVar is the name of environment variable for the branches polled
+	PollBranchesVar = "pollbranches"
+
+	// RenderRunAsNonRootVar is the name of environment variable requiring render pods to run as non-root
+	RenderRunAsNonRootVar = "renderrunasnonroot"
+
+	// RenderRunAsUserVar is the name of environment variable for the uid render pods run as
+	RenderRunAsUserVar = "renderrunasuser"
+
+	// RenderFSGroupVar is the name of environment variable for the fsGroup of render pods
+	RenderFSGroupVar = "renderfsgroup"
+
+	// RenderReadOnlyRootFSVar is the name of environment variable making render containers' root filesystem read only
+	RenderReadOnlyRootFSVar = "renderreadonlyrootfs"
+
+	// RenderSeccompProfileVar is the name of environment variable for the seccomp profile of render pods
+	RenderSeccompProfileVar = "renderseccompprofile"
+
+	// RenderDropCapabilitiesVar is the name of environment variable listing capabilities dropped by render containers
+	RenderDropCapabilitiesVar = "renderdropcapabilities"
+
+	// RenderNetworkPolicyVar is the name of environment variable enabling the render egress network policy
+	RenderNetworkPolicyVar = "rendernetworkpolicy"
+
+	// RenderEgressAllowVar is the name of environment variable listing CIDRs render pods may connect to
+	RenderEgressAllowVar = "renderegressallow"
+
+	// RenderServiceAccountVar is the name of environment variable for the service account render pods run as
+	RenderServiceAccountVar = "renderserviceaccount"
+
+	// RenderImagePullSecretsVar is the name of environment variable listing pull secrets for render images
+	RenderImagePullSecretsVar = "renderimagepullsecrets"
+
+	// RenderImagePullPolicyVar is the name of environment variable for the pull policy of render images
+	RenderImagePullPolicyVar = "renderimagepullpolicy"
+
+	// RenderClaimVar is the name of environment variable for the name or label selector of the render claim
+	RenderClaimVar = "renderclaim"
+
+	// SourceClaimVar is the name of environment variable for the name or label selector of the source claim
+	SourceClaimVar = "sourceclaim"
+
+	// RenderEnvVar is the name of environment variable for the environment variables set in render jobs
+	RenderEnvVar = "renderenv"
+
+	// RenderEnvFromVar is the name of environment variable for the secrets and configmaps exposed to render jobs
+	RenderEnvFromVar = "renderenvfrom"
+
+	// PodNameVar is the name of environment variable containing the name of the pod previewd is running in
+	PodNameVar = "podname"
 )
 
 var (
@@ -61,6 +194,21 @@ var (
 	// KubeConfigPath is the path to a valid KubeConfig file
 	KubeConfigPath string
 
+	// KubeContext selects a context from KubeConfigPath, empty uses the current context
+	KubeContext string
+
+	// Impersonate is the user or service account, system:serviceaccount:<namespace>:<name>, render jobs are created as
+	Impersonate string
+
+	// ImpersonateGroups is a comma separated list of groups render jobs are created as
+	ImpersonateGroups string
+
+	// BuildKubeConfigPath is the path to a kube config for a separate cluster that render jobs run in
+	BuildKubeConfigPath string
+
+	// BuildKubeContext selects the context of the build cluster
+	BuildKubeContext string
+
 	// Namespace is the kubernetes namespace to create resources in
 	Namespace string
 
@@ -75,6 +223,119 @@ var (
 
 	// InitialBranch holds the branch that should be cloned on startup
 	InitialBranch string
+
+	// Executor selects whether render jobs run in kubernetes or as local processes
+	Executor string
+
+	// OutputDir is the local directory the local executor renders into
+	OutputDir string
+
+	// GitUsername is sent with the repo access token, Gitea and GitLab require the token's owner
+	GitUsername string
+
+	// GitTokenFile is the path of a file containing a personal access token used to clone TargetRepo
+	GitTokenFile string
+
+	// GitTokenSecret is <name> or <name>/<key> of a secret containing a personal access token used to
+	// clone TargetRepo, the key defaults to token
+	GitTokenSecret string
+
+	// GitSSHKey is the path of a private deploy key used to clone TargetRepo when it is an ssh remote
+	GitSSHKey string
+
+	// GitSSHPassphrase decrypts GitSSHKey if it is encrypted, it is never logged
+	GitSSHPassphrase string
+
+	// GitKnownHosts is the path of a known_hosts file that ssh remotes' host keys are verified against
+	GitKnownHosts string
+
+	// CloneDepth limits the history cloned and fetched to the given number of commits, 0 for full history
+	CloneDepth int
+
+	// SingleBranch clones only the default branch of TargetRepo, other branches are fetched when built
+	SingleBranch bool
+
+	// NoTags skips fetching tags of TargetRepo
+	NoTags bool
+
+	// Submodules initializes and updates the submodules of TargetRepo recursively, eg themes
+	Submodules bool
+
+	// CloneInJob makes render jobs fetch the commit being built rather than mounting a shared source claim
+	CloneInJob bool
+
+	// CloneImage is the image, containing git and sh, used to clone inside render jobs
+	CloneImage string
+
+	// DryRun selects whether kubernetes objects are printed or sent with server-side dry-run instead of created
+	DryRun string
+
+	// SucceededRetention is how long succeeded render jobs are kept, 0 deletes immediately
+	SucceededRetention time.Duration
+
+	// FailedRetention is how long failed render jobs are kept, negative keeps them indefinitely
+	FailedRetention time.Duration
+
+	// PollInterval is how often the remote is polled for branches whose head changed, 0 disables polling
+	PollInterval time.Duration
+
+	// PollJitter is the fraction each poll interval is randomly lengthened or shortened by
+	PollJitter float64
+
+	// PollMaxBackoff caps the interval, doubled after each failed poll, between failed polls
+	PollMaxBackoff time.Duration
+
+	// PollBranches is a comma separated list of the branches polled, empty polls every branch
+	PollBranches string
+
+	// RenderRunAsNonRoot requires render pods to run as a non-root user
+	RenderRunAsNonRoot bool
+
+	// RenderRunAsUser is the uid render pods run as, 0 leaves it to the image
+	RenderRunAsUser int64
+
+	// RenderFSGroup is the fsGroup of render pods and should match the owner of files on the claims
+	RenderFSGroup int64
+
+	// RenderReadOnlyRootFS makes the root filesystem of render containers read only
+	RenderReadOnlyRootFS bool
+
+	// RenderSeccompProfile is RuntimeDefault, Unconfined or Localhost/<profile>
+	RenderSeccompProfile string
+
+	// RenderDropCapabilities is a comma separated list of capabilities dropped by render containers, eg ALL
+	RenderDropCapabilities string
+
+	// RenderNetworkPolicy enables a network policy limiting render pod egress to RenderEgressAllow
+	RenderNetworkPolicy bool
+
+	// RenderEgressAllow is a comma separated list of CIDRs, optionally suffixed with :port, render pods may reach
+	RenderEgressAllow string
+
+	// RenderServiceAccount is the service account render pods run as, empty uses the namespace default
+	RenderServiceAccount string
+
+	// RenderImagePullSecrets is a comma separated list of secrets used to pull render images
+	RenderImagePullSecrets string
+
+	// RenderImagePullPolicy is Always, IfNotPresent or Never
+	RenderImagePullPolicy string
+
+	// RenderClaim is the name or label selector of the claim render jobs write output to
+	RenderClaim string
+
+	// SourceClaim is the name or label selector of the claim holding the cloned source
+	SourceClaim string
+
+	// RenderEnv is a comma separated list of NAME=value environment variables set in render jobs
+	RenderEnv string
+
+	// RenderEnvFrom is a comma separated list of secret/<name> or configmap/<name> whose keys are
+	// set as environment variables in render jobs
+	RenderEnvFrom string
+
+	// PodName is the name of the pod previewd is running in, used as the owner of render jobs
+	PodName string
 )
 
 func init() {
@@ -85,6 +346,24 @@ func init() {
 	viper.SetDefault(InitialBuildVar, true)
 	viper.SetDefault(InitialCloneVar, true)
 	viper.SetDefault(WebhookListenVar, true)
+	viper.SetDefault(ExecutorVar, KubeExecutor)
+	viper.SetDefault(DryRunVar, "none")
+	viper.SetDefault(SucceededRetentionVar, "0s")
+	viper.SetDefault(FailedRetentionVar, "-1s")
+	viper.SetDefault(PollIntervalVar, "0s")
+	viper.SetDefault(PollJitterVar, defaultPollJitter)
+	viper.SetDefault(PollMaxBackoffVar, "10m")
+	viper.SetDefault(RenderServiceAccountVar, "")
+	viper.SetDefault(RenderImagePullSecretsVar, "")
+	viper.SetDefault(RenderImagePullPolicyVar, "Always")
+	viper.SetDefault(RenderRunAsNonRootVar, false)
+	viper.SetDefault(RenderRunAsUserVar, 0)
+	viper.SetDefault(RenderFSGroupVar, 0)
+	viper.SetDefault(RenderReadOnlyRootFSVar, false)
+	viper.SetDefault(RenderSeccompProfileVar, "")
+	viper.SetDefault(RenderDropCapabilitiesVar, "")
+	viper.SetDefault(RenderNetworkPolicyVar, false)
+	viper.SetDefault(RenderEgressAllowVar, "")
 
 	Port = viper.GetInt(PortVar)
 	LogLevel = viper.GetString(LogLevelVar)
@@ -92,10 +371,52 @@ func init() {
 	LocalDir = viper.GetString(LocalDirVar)
 	KubeConfigPath = viper.GetString(KubeConfigPathVar)
 	Namespace = viper.GetString(NamespaceVar)
+	KubeContext = viper.GetString(KubeContextVar)
+	Impersonate = viper.GetString(ImpersonateVar)
+	ImpersonateGroups = viper.GetString(ImpersonateGroupsVar)
+	BuildKubeConfigPath = viper.GetString(BuildKubeConfigPathVar)
+	BuildKubeContext = viper.GetString(BuildKubeContextVar)
 	InitialClone = viper.GetBool(InitialCloneVar)
 	InitialBuild = viper.GetBool(InitialBuildVar)
 	WebhookListen = viper.GetBool(WebhookListenVar)
 	InitialBranch = viper.GetString(InitialBranchVar)
+	Executor = viper.GetString(ExecutorVar)
+	OutputDir = viper.GetString(OutputDirVar)
+	DryRun = viper.GetString(DryRunVar)
+	GitUsername = viper.GetString(GitUsernameVar)
+	GitTokenFile = viper.GetString(GitTokenFileVar)
+	GitTokenSecret = viper.GetString(GitTokenSecretVar)
+	GitSSHKey = viper.GetString(GitSSHKeyVar)
+	GitSSHPassphrase = viper.GetString(GitSSHPassphraseVar)
+	GitKnownHosts = viper.GetString(GitKnownHostsVar)
+	CloneDepth = viper.GetInt(CloneDepthVar)
+	SingleBranch = viper.GetBool(SingleBranchVar)
+	NoTags = viper.GetBool(NoTagsVar)
+	Submodules = viper.GetBool(SubmodulesVar)
+	CloneInJob = viper.GetBool(CloneInJobVar)
+	CloneImage = viper.GetString(CloneImageVar)
+	SucceededRetention = viper.GetDuration(SucceededRetentionVar)
+	FailedRetention = viper.GetDuration(FailedRetentionVar)
+	PollInterval = viper.GetDuration(PollIntervalVar)
+	PollJitter = viper.GetFloat64(PollJitterVar)
+	PollMaxBackoff = viper.GetDuration(PollMaxBackoffVar)
+	PollBranches = viper.GetString(PollBranchesVar)
+	RenderRunAsNonRoot = viper.GetBool(RenderRunAsNonRootVar)
+	RenderRunAsUser = viper.GetInt64(RenderRunAsUserVar)
+	RenderFSGroup = viper.GetInt64(RenderFSGroupVar)
+	RenderReadOnlyRootFS = viper.GetBool(RenderReadOnlyRootFSVar)
+	RenderSeccompProfile = viper.GetString(RenderSeccompProfileVar)
+	RenderDropCapabilities = viper.GetString(RenderDropCapabilitiesVar)
+	RenderNetworkPolicy = viper.GetBool(RenderNetworkPolicyVar)
+	RenderEgressAllow = viper.GetString(RenderEgressAllowVar)
+	RenderServiceAccount = viper.GetString(RenderServiceAccountVar)
+	RenderImagePullSecrets = viper.GetString(RenderImagePullSecretsVar)
+	RenderImagePullPolicy = viper.GetString(RenderImagePullPolicyVar)
+	RenderClaim = viper.GetString(RenderClaimVar)
+	SourceClaim = viper.GetString(SourceClaimVar)
+	RenderEnv = viper.GetString(RenderEnvVar)
+	RenderEnvFrom = viper.GetString(RenderEnvFromVar)
+	PodName = viper.GetString(PodNameVar)
 }
 
 func getDefaultKubeConfig() string {
@@ -130,5 +451,64 @@ func ValidateEnv() error {
 		clarkezoneLog.Errorf("LocalDir empty")
 		return fmt.Errorf("LocalDir empty")
 	}
+	if Executor != KubeExecutor && Executor != LocalExecutor {
+		clarkezoneLog.Errorf("unknown executor %v", Executor)
+		return fmt.Errorf("unknown executor %v", Executor)
+	}
+	if DryRun != "" && DryRun != "none" && DryRun != "client" && DryRun != "server" {
+		clarkezoneLog.Errorf("unknown dry-run mode %v", DryRun)
+		return fmt.Errorf("unknown dry-run mode %v", DryRun)
+	}
+	if Executor == LocalExecutor && DryRun != "" && DryRun != "none" {
+		clarkezoneLog.Errorf("dry-run is not supported by the local executor")
+		return fmt.Errorf("dry-run is not supported by the local executor")
+	}
+	if GitTokenFile != "" && GitTokenSecret != "" {
+		clarkezoneLog.Errorf("only one of %v and %v can be set", GitTokenFileVar, GitTokenSecretVar)
+		return fmt.Errorf("only one of %v and %v can be set", GitTokenFileVar, GitTokenSecretVar)
+	}
+	if CloneDepth < 0 {
+		clarkezoneLog.Errorf("%v must not be negative", CloneDepthVar)
+		return fmt.Errorf("%v must not be negative", CloneDepthVar)
+	}
+	if GitSSHKey != "" && GitKnownHosts == "" {
+		clarkezoneLog.Errorf("%v requires %v to verify the remote's host key", GitSSHKeyVar, GitKnownHostsVar)
+		return fmt.Errorf("%v requires %v to verify the remote's host key", GitSSHKeyVar, GitKnownHostsVar)
+	}
+	if Executor == LocalExecutor && CloneInJob {
+		clarkezoneLog.Errorf("%v is not supported by the local executor", CloneInJobVar)
+		return fmt.Errorf("%v is not supported by the local executor", CloneInJobVar)
+	}
+	if CloneInJob && GitTokenFile != "" {
+		// render jobs cannot read a file local to previewd
+		clarkezoneLog.Errorf("%v requires the token in %v rather than %v", CloneInJobVar, GitTokenSecretVar, GitTokenFileVar)
+		return fmt.Errorf("%v requires the token in %v rather than %v", CloneInJobVar, GitTokenSecretVar, GitTokenFileVar)
+	}
+	if CloneInJob && GitSSHKey != "" {
+		clarkezoneLog.Errorf("%v does not support %v", CloneInJobVar, GitSSHKeyVar)
+		return fmt.Errorf("%v does not support %v", CloneInJobVar, GitSSHKeyVar)
+	}
+	err := ValidatePollEnv()
+	if err != nil {
+		return err
+	}
+	if PollInterval > 0 && !WebhookListen {
+		// polled changes are handled by the webhook listener
+		clarkezoneLog.Errorf("%v requires %v", PollIntervalVar, WebhookListenVar)
+		return fmt.Errorf("%v requires %v", PollIntervalVar, WebhookListenVar)
+	}
+	return nil
+}
+
+// ValidatePollEnv validates the poll interval, jitter and backoff
+func ValidatePollEnv() error {
+	if PollInterval < 0 || PollMaxBackoff < 0 {
+		clarkezoneLog.Errorf("%v and %v must not be negative", PollIntervalVar, PollMaxBackoffVar)
+		return fmt.Errorf("%v and %v must not be negative", PollIntervalVar, PollMaxBackoffVar)
+	}
+	if PollJitter < 0 || PollJitter >= 1 {
+		clarkezoneLog.Errorf("%v must be at least 0 and less than 1", PollJitterVar)
+		return fmt.Errorf("%v must be at least 0 and less than 1", PollJitterVar)
+	}
 	return nil
 }
@@ -11,6 +11,12 @@ func GetJekyllImage() string {
 	return "registry.hub.docker.com/clarkezone/jekyll:sha-df0a146"
 }
 
+// GetCloneImage returns the image used to fetch source when cloning inside render jobs, pinned so that
+// builds are reproducible and the credential helper's git 2.31 requirement is met
+func GetCloneImage() string {
+	return "docker.io/alpine/git:v2.45.2"
+}
+
 // GetJekyllCommands returns the command and params used to trigger a render job
 func GetJekyllCommands() ([]string, []string) {
 	command := []string{"sh", "-c", "--"}
@@ -0,0 +1,80 @@
+package jobmanager
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// BranchEnv is the renderer environment variable containing the branch being built
+	BranchEnv = "PREVIEWD_BRANCH"
+	// CommitEnv is the renderer environment variable containing the commit being built
+	CommitEnv = "PREVIEWD_COMMIT"
+	// BuildIDEnv is the renderer environment variable containing the unique id of the build
+	BuildIDEnv = "PREVIEWD_BUILD_ID"
+	// PreviewURLEnv is the renderer environment variable containing the url the build is served from,
+	// only set when branch previews are enabled
+	PreviewURLEnv = "PREVIEWD_PREVIEW_URL"
+	// SubmodulesEnv is the renderer environment variable containing the commit of each submodule,
+	// only set when submodules are checked out
+	SubmodulesEnv = "PREVIEWD_SUBMODULES"
+
+	// buildJobSuffixLength is the number of characters of the build id appended to job names
+	buildJobSuffixLength = 8
+)
+
+var nonAlphanumeric = regexp.MustCompile("[^a-zA-Z0-9]+")
+
+func newBuildID() string {
+	return string(uuid.NewUUID())
+}
+
+// buildJobName returns the name of the job for the build with id, prefix followed by the start of id
+// so that the jobs of successive builds, and those retained for debugging, do not collide
+func buildJobName(prefix string, id string) string {
+	suffix := strings.ToLower(nonAlphanumeric.ReplaceAllString(id, ""))
+	if len(suffix) > buildJobSuffixLength {
+		suffix = suffix[:buildJobSuffixLength]
+	}
+	if suffix == "" {
+		return prefix
+	}
+	// job names are limited to a label value
+	if limit := validation.LabelValueMaxLength - len(suffix) - 1; len(prefix) > limit {
+		prefix = strings.TrimRight(prefix[:limit], "-.")
+	}
+	return prefix + "-" + suffix
+}
+
+// buildEnv returns the environment variables describing build to the renderer.  They follow the
+// site's own variables so that a site cannot override them.
+func buildEnv(build BuildInfo) []apiv1.EnvVar {
+	env := []apiv1.EnvVar{
+		{Name: BranchEnv, Value: build.Branch},
+		{Name: CommitEnv, Value: build.Commit},
+		{Name: BuildIDEnv, Value: build.ID},
+	}
+	if build.PreviewURL != "" {
+		env = append(env, apiv1.EnvVar{Name: PreviewURLEnv, Value: build.PreviewURL})
+	}
+	if len(build.Submodules) > 0 {
+		env = append(env, apiv1.EnvVar{Name: SubmodulesEnv, Value: formatSubmodules(build.Submodules)})
+	}
+	return env
+}
+
+// formatSubmodules returns the submodules of a build as path=commit pairs separated by commas and
+// sorted by path
+func formatSubmodules(submodules map[string]string) string {
+	pairs := make([]string, 0, len(submodules))
+	for path, commit := range submodules {
+		pairs = append(pairs, path+"="+commit)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
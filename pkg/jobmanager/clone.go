@@ -0,0 +1,100 @@
+package jobmanager
+
+import (
+	"net/url"
+
+	apiv1 "k8s.io/api/core/v1"
+
+	"github.com/clarkezone/previewd/internal"
+	kubelayer "github.com/clarkezone/previewd/pkg/kubelayer"
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+const (
+	// RepoEnv is the clone container environment variable containing the url of the repo being built
+	RepoEnv = "PREVIEWD_REPO"
+	// GitTokenEnv is the clone container environment variable set from CloneTokenSecret
+	GitTokenEnv = "PREVIEWD_GIT_TOKEN"
+	// GitUsernameEnv is the clone container environment variable containing the username sent with the token
+	GitUsernameEnv = "PREVIEWD_GIT_USERNAME"
+
+	cloneContainerName = "clone"
+
+	// cloneScript fetches only the commit being built into /src/source, where render commands expect the
+	// source to be.  The repo and commit are passed in the environment so they are never parsed by the shell.
+	cloneScript = `set -e
+git init -q /src/source
+cd /src/source
+git remote add origin "$PREVIEWD_REPO"
+git fetch -q --depth 1 origin "$PREVIEWD_COMMIT"
+git checkout -q FETCH_HEAD`
+
+	// cloneSubmodulesScript additionally fetches the submodules of the commit being built
+	cloneSubmodulesScript = cloneScript + `
+git submodule update -q --init --recursive --depth 1`
+
+	// defaultCloneUsername is sent with the token when no username is set, matching the local clone
+	defaultCloneUsername = "abc123"
+
+	// credentialHelper answers git's requests for credentials, including those of submodules, from the
+	// environment so that the token never appears in the job's spec, the script or git's config files
+	credentialHelper = `!f() { test "$1" = get && echo "username=$` + GitUsernameEnv + `" && echo "password=$` +
+		GitTokenEnv + `"; }; f`
+)
+
+// cloneContainer returns the init container that fetches the commit of build into the emptyDir mounted at /src.
+// Credentials embedded in the repo url are removed so that they are not stored in the job, private repos are
+// fetched with the token in CloneTokenSecret.
+func cloneContainer(spec RenderSpec, build BuildInfo) kubelayer.InitContainer {
+	image := spec.CloneImage
+	if image == "" {
+		image = internal.GetCloneImage()
+	}
+	script := cloneScript
+	if spec.CloneSubmodules {
+		script = cloneSubmodulesScript
+	}
+	repo, redacted := withoutPassword(spec.CloneRepo)
+	if redacted {
+		clarkezoneLog.Infof("credentials in the repo url are not passed to render jobs, use a token secret")
+	}
+	env := []apiv1.EnvVar{
+		{Name: RepoEnv, Value: repo},
+		{Name: CommitEnv, Value: build.Commit},
+	}
+	if spec.CloneTokenSecret != nil {
+		selector := *spec.CloneTokenSecret
+		username := spec.CloneUsername
+		if username == "" {
+			username = defaultCloneUsername
+		}
+		env = append(env,
+			apiv1.EnvVar{Name: GitTokenEnv, ValueFrom: &apiv1.EnvVarSource{SecretKeyRef: &selector}},
+			apiv1.EnvVar{Name: GitUsernameEnv, Value: username},
+			// GIT_CONFIG_* configure every git command run by the script without writing a config file
+			apiv1.EnvVar{Name: "GIT_CONFIG_COUNT", Value: "1"},
+			apiv1.EnvVar{Name: "GIT_CONFIG_KEY_0", Value: "credential.helper"},
+			apiv1.EnvVar{Name: "GIT_CONFIG_VALUE_0", Value: credentialHelper})
+	}
+	return kubelayer.InitContainer{
+		Name:    cloneContainerName,
+		Image:   image,
+		Command: []string{"sh", "-c", "--"},
+		Args:    []string{script},
+		Env:     env,
+	}
+}
+
+// withoutPassword returns repo with any password embedded in its url removed and whether one was removed.
+// Usernames are kept as ssh remotes such as ssh://git@example.com/site.git require them.
+func withoutPassword(repo string) (string, bool) {
+	u, err := url.Parse(repo)
+	if err != nil || u.User == nil {
+		return repo, false
+	}
+	if _, ok := u.User.Password(); !ok {
+		return repo, false
+	}
+	u.User = url.User(u.User.Username())
+	return u.String(), true
+}
@@ -3,8 +3,14 @@ package jobmanager
 
 import (
 	"fmt"
+	"path"
+	"strings"
+	"time"
 
 	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/rest"
 
 	"github.com/clarkezone/previewd/internal"
@@ -12,15 +18,98 @@ import (
 	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
 )
 
+const (
+	// BranchAnnotation is the job annotation recording the branch being built
+	BranchAnnotation = "previewd.io/branch"
+	// CommitAnnotation is the job annotation recording the commit being built
+	CommitAnnotation = "previewd.io/commit"
+	// BuildIDAnnotation is the job annotation recording the unique id of the build
+	BuildIDAnnotation = "previewd.io/build-id"
+	// SubmodulesAnnotation is the job annotation recording the commit of each submodule, see formatSubmodules
+	SubmodulesAnnotation = "previewd.io/submodules"
+	// SiteLabel is the job label recording the site being built
+	SiteLabel = "previewd.io/site"
+
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "previewd"
+	componentLabel = "app.kubernetes.io/component"
+	componentValue = "render"
+
+	renderNetworkPolicyName = "previewd-render-egress"
+
+	reasonBuildQueued    = "BuildQueued"
+	reasonBuildStarted   = "BuildStarted"
+	reasonBuildSucceeded = "BuildSucceeded"
+	reasonBuildFailed    = "BuildFailed"
+	reasonBranchDeleted  = "BranchDeleted"
+)
+
+// BuildInfo identifies the source revision that a render job builds
+type BuildInfo struct {
+	Site   string
+	Branch string
+	Commit string
+	// ID uniquely identifies the build, one is generated when the build is queued if empty
+	ID string
+	// PreviewURL is the url the build is served from when branch previews are enabled
+	PreviewURL string
+	// Submodules maps the path of each submodule checked out to its commit
+	Submodules map[string]string
+}
+
+// BuildObserver is a function prototype for notifications when a render job completes
+type BuildObserver func(job *batchv1.Job, succeeded bool)
+
+// RenderSpec describes the job used to render a site
+type RenderSpec struct {
+	// JobName prefixes the name of render jobs, which is followed by part of the build id so that each
+	// build's job is retained separately
+	JobName string
+	// Site identifies the site being rendered and is recorded in the SiteLabel
+	Site    string
+	Image   string
+	Command []string
+	Args    []string
+	// Namespace overrides the namespace render jobs are created in, eg a branch's preview namespace
+	Namespace string
+	// RenderClaim is the name or label selector of the claim mounted at /site for output
+	RenderClaim string
+	// SourceClaim is the name or label selector of the claim containing the cloned source mounted at /src
+	SourceClaim string
+	// SourceSubPath is the directory of the source claim mounted at /src, empty mounts its root
+	SourceSubPath string
+	// CloneRepo clones the repo inside the render job rather than mounting SourceClaim.  The commit
+	// being built is fetched into an emptyDir mounted at /src by an init container running CloneImage.
+	CloneRepo  string
+	CloneImage string
+	// CloneSubmodules also fetches the submodules of the commit being built when cloning in the job
+	CloneSubmodules bool
+	// CloneTokenSecret selects the key of a Secret in the render job's namespace holding a personal access
+	// token for CloneRepo, which is sent with CloneUsername.  Only the clone container is given the token.
+	CloneTokenSecret *apiv1.SecretKeySelector
+	CloneUsername    string
+	// RenderSubPath is the directory of the render claim mounted at /site, empty mounts its root
+	RenderSubPath string
+	// Volumes are mounted in addition to the render and source claims, eg ConfigMaps or Secrets
+	Volumes []kubelayer.PVClaimMountRef
+	// Env and EnvFrom set environment variables of the renderer, eg tokens read from Secrets
+	Env     []apiv1.EnvVar
+	EnvFrom []apiv1.EnvFromSource
+}
+
 type jobdescriptor struct {
-	name       string
-	namespace  string
-	image      string
-	command    []string
-	args       []string
-	notifier   kubelayer.JobNotifier
-	autoDelete bool
-	mountlist  []kubelayer.PVClaimMountRef
+	name           string
+	namespace      string
+	image          string
+	command        []string
+	args           []string
+	notifier       kubelayer.JobNotifier
+	autoDelete     bool
+	mountlist      []kubelayer.PVClaimMountRef
+	env            []apiv1.EnvVar
+	envFrom        []apiv1.EnvFromSource
+	initContainers []kubelayer.InitContainer
+	build          BuildInfo
 }
 
 type jobupdate struct {
@@ -32,21 +121,33 @@ type jobupdate struct {
 type Jobxxx interface {
 	CreateJob(name string, namespace string,
 		image string, command []string, args []string, notifier kubelayer.JobNotifier,
-		autoDelete bool, mountlist []kubelayer.PVClaimMountRef) (*batchv1.Job, error)
+		autoDelete bool, mountlist []kubelayer.PVClaimMountRef, opts *kubelayer.JobOptions) (*batchv1.Job, error)
 	DeleteJob(name string, namespace string) error
+	// FailedJob is called for a failed job, which is retained for debugging but no longer blocks later jobs
 	FailedJob(name string, namesapce string)
+	// SucceededJob is called for a succeeded job that is retained rather than deleted immediately
+	SucceededJob(name string, namespace string)
 	// InProgress returns true if jobs we have scheduled are in progress
 	InProgress() bool
 }
 
 // Jobmanager enables scheduling and querying of jobs
 type Jobmanager struct {
-	kubeSession   *kubelayer.KubeSession
-	namespace     string
-	addQueue      chan jobdescriptor
-	monitorExit   chan bool
-	monitorDone   chan bool
-	haveFailedJob bool
+	kubeSession *kubelayer.KubeSession
+	namespace   string
+	addQueue    chan jobdescriptor
+	monitorExit chan bool
+	monitorDone chan bool
+	observers   []BuildObserver
+	retention   RetentionPolicy
+	security    *kubelayer.SecurityOptions
+	podOptions  kubelayer.PodOptions
+	retained    map[types.NamespacedName]*time.Timer
+	expiredJobs chan types.NamespacedName
+	jobUIDs     map[types.NamespacedName]types.UID
+	// completed holds the jobs whose completion has been handled, so that later updates of a finished job,
+	// eg status patches or its deletion, do not report the build again
+	completed map[types.NamespacedName]bool
 	// TODO: is there a better way to avoid test need impacting API shape
 	// JobProvider is public to enable integration tests to modify
 	JobProvider Jobxxx
@@ -60,12 +161,15 @@ type kubeJobManager struct {
 // Implement jobxxx interface begin
 func (o *kubeJobManager) CreateJob(name string, namespace string,
 	image string, command []string, args []string, notifier kubelayer.JobNotifier,
-	autoDelete bool, mountlist []kubelayer.PVClaimMountRef) (*batchv1.Job, error) {
+	autoDelete bool, mountlist []kubelayer.PVClaimMountRef, opts *kubelayer.JobOptions) (*batchv1.Job, error) {
 	clarkezoneLog.Debugf("CreateJob called with name:%v, namespace:%v, image:%v", name, namespace,
 		image)
-	o.jobRefs[name] = name
+	// dry-run jobs never complete so tracking them would block the queue
+	if !o.kubeSession.DryRun().IsDryRun() {
+		o.jobRefs[name] = name
+	}
 	return o.kubeSession.CreateJob(name, namespace,
-		image, command, args, notifier, autoDelete, mountlist)
+		image, command, args, notifier, autoDelete, mountlist, opts)
 }
 
 func (o *kubeJobManager) DeleteJob(name string, namespace string) error {
@@ -76,6 +180,12 @@ func (o *kubeJobManager) DeleteJob(name string, namespace string) error {
 
 func (o *kubeJobManager) FailedJob(name string, namespace string) {
 	clarkezoneLog.Debugf("FailedJob called with name:%v, namespace:%v", name, namespace)
+	delete(o.jobRefs, name)
+}
+
+func (o *kubeJobManager) SucceededJob(name string, namespace string) {
+	clarkezoneLog.Debugf("SucceededJob called with name:%v, namespace:%v", name, namespace)
+	delete(o.jobRefs, name)
 }
 
 func (o *kubeJobManager) InProgress() bool {
@@ -126,6 +236,11 @@ func newjobmanagerinternal(config *rest.Config, provider Jobxxx, namespace strin
 	}
 
 	jm.addQueue = make(chan jobdescriptor)
+	jm.retention = DefaultRetentionPolicy()
+	jm.retained = make(map[types.NamespacedName]*time.Timer)
+	jm.expiredJobs = make(chan types.NamespacedName)
+	jm.jobUIDs = make(map[types.NamespacedName]types.UID)
+	jm.completed = make(map[types.NamespacedName]bool)
 	jm.JobProvider = provider
 	jm.namespace = namespace
 	return &jm, nil
@@ -162,6 +277,7 @@ func (jm *Jobmanager) startMonitor(jobcontroller Jobxxx) {
 		clarkezoneLog.Debugf("startmonitor() starting job monitor")
 		defer func() {
 			clarkezoneLog.Debugf(" startMonitor: Loop exited")
+			jm.stopRetention()
 			close(jm.monitorExit)
 		}()
 		for {
@@ -177,26 +293,10 @@ func (jm *Jobmanager) startMonitor(jobcontroller Jobxxx) {
 				}
 			case update := <-jobnotifierchannel:
 				clarkezoneLog.Debugf(" startMonitor(): received job notification from jobnotifierchannel")
-				// k8s job completed is jobcommpleted function
-				readyNext, failed := isCompleted(update)
-				jm.haveFailedJob = failed
-				switch {
-				case readyNext && !failed:
-					// TODO: delete job should only be called once (bug in jobmanager).
-					// As part of this delete job should be smart about the name of the job being deleted
-					// (eg if initial render and webhook differently named)
-					clarkezoneLog.Debugf(" startMonitor(): successfully completed job detected, deleting job")
-					err := jobcontroller.DeleteJob(update.job.Name, update.job.Namespace)
-					if err != nil {
-						clarkezoneLog.Errorf("Unable to delete job %v due to error %v", update.job.Name, err)
-					}
-				case readyNext && failed:
-					clarkezoneLog.Debugf(" startMonitor(): Failed completed job name:%v namespace:%v, cannot process further jobs",
-						update.job.Name, update.job.Namespace)
-					jobcontroller.FailedJob(update.job.Name, update.job.Namespace)
-				default:
-					clarkezoneLog.Debugf(" startMonitor(): Received non completed update")
-				}
+				jm.processJobUpdate(update, jobcontroller)
+			case key := <-jm.expiredJobs:
+				clarkezoneLog.Debugf(" startMonitor(): retention expired for job %v", key)
+				jm.deleteRetainedJob(jobcontroller, key)
 			case <-jm.monitorDone:
 				clarkezoneLog.Debugf(" startMonitor(): jm.monitorDone channel signalled, exiting loop")
 				return
@@ -208,6 +308,75 @@ func (jm *Jobmanager) startMonitor(jobcontroller Jobxxx) {
 	}()
 }
 
+func (jm *Jobmanager) processJobUpdate(update *jobupdate, jobcontroller Jobxxx) {
+	if uid, ok := jm.jobUIDs[jobKey(update.job)]; ok && update.job.UID != "" && update.job.UID != uid {
+		clarkezoneLog.Debugf(" processJobUpdate(): ignoring update for replaced job %v uid:%v",
+			update.job.Name, update.job.UID)
+		return
+	}
+	key := jobKey(update.job)
+	handled := jm.completed[key]
+	if update.typee == kubelayer.Delete {
+		delete(jm.jobUIDs, key)
+		delete(jm.completed, key)
+	}
+	// k8s job completed is jobcommpleted function
+	readyNext, failed := isCompleted(update)
+	if readyNext && handled {
+		clarkezoneLog.Debugf(" processJobUpdate(): ignoring update for completed job %v", update.job.Name)
+		return
+	}
+	if readyNext && update.typee != kubelayer.Delete {
+		jm.completed[key] = true
+	}
+	// jobs that are being deleted have already been through retention
+	deleting := update.job.DeletionTimestamp != nil
+	switch {
+	case readyNext && !failed:
+		jm.recordJobEvent(update.job, apiv1.EventTypeNormal, reasonBuildSucceeded, "Build of %v succeeded",
+			describeJob(update.job))
+		jm.notifyObservers(update.job, true)
+		if jm.retention.Succeeded != 0 && !deleting {
+			clarkezoneLog.Debugf(" startMonitor(): successfully completed job detected, retaining job")
+			jobcontroller.SucceededJob(update.job.Name, update.job.Namespace)
+			if jm.retention.Succeeded > 0 {
+				jm.retainJob(update.job, jm.retention.Succeeded)
+			}
+			return
+		}
+		clarkezoneLog.Debugf(" startMonitor(): successfully completed job detected, deleting job")
+		err := jobcontroller.DeleteJob(update.job.Name, update.job.Namespace)
+		if err != nil {
+			clarkezoneLog.Errorf("Unable to delete job %v due to error %v", update.job.Name, err)
+		}
+	case readyNext && failed:
+		clarkezoneLog.Debugf(" startMonitor(): Failed completed job name:%v namespace:%v, retaining job",
+			update.job.Name, update.job.Namespace)
+		jm.recordJobEvent(update.job, apiv1.EventTypeWarning, reasonBuildFailed, "Build of %v failed",
+			describeJob(update.job))
+		jm.notifyObservers(update.job, false)
+		jobcontroller.FailedJob(update.job.Name, update.job.Namespace)
+		if jm.retention.Failed >= 0 && !deleting {
+			jm.retainJob(update.job, jm.retention.Failed)
+		}
+	default:
+		clarkezoneLog.Debugf(" startMonitor(): Received non completed update")
+	}
+}
+
+// AddBuildObserver registers a function that is called when a render job succeeds or fails.
+// Observers are called from the job monitor goroutine and must not block or add jobs.
+// Must be called before watchers are started.
+func (jm *Jobmanager) AddBuildObserver(observer BuildObserver) {
+	jm.observers = append(jm.observers, observer)
+}
+
+func (jm *Jobmanager) notifyObservers(job *batchv1.Job, succeeded bool) {
+	for _, observer := range jm.observers {
+		observer(job, succeeded)
+	}
+}
+
 func (jm *Jobmanager) scheduleIfPossible(jobqueue *[]jobdescriptor,
 	jobcontroller Jobxxx, jobnotifierchannel chan *jobupdate) {
 	jobQueueLength := len(*jobqueue)
@@ -216,30 +385,58 @@ func (jm *Jobmanager) scheduleIfPossible(jobqueue *[]jobdescriptor,
 		jobQueueLength, jobInProgress)
 	if jobQueueLength > 0 && !jobInProgress {
 		clarkezoneLog.Debugf(" scheduleIfPossible attempting to schedule")
-		if jm.haveFailedJob {
-			clarkezoneLog.Debugf(" scheduleIfPossible jobqueue contains > 1 jobs, but we have a failed job hence not scheduling")
-		} else {
-			clarkezoneLog.Debugf(" scheduleIfPossible jobqueue contains > 1 jobs, scheduling")
-			nextjob := (*jobqueue)[0]
-			*jobqueue = (*jobqueue)[1:]
-			notifier := func(job *batchv1.Job, typee kubelayer.ResourseStateType) {
-				clarkezoneLog.Debugf(" notifier called: Got job in outside world %v", typee)
-
-				clarkezoneLog.Debugf(" notifier begin send job update to jobnotifierchannel")
-				jobnotifierchannel <- &jobupdate{job, typee}
-				clarkezoneLog.Debugf(" notifier end send job update to jobnotifierchannel")
-			}
-			_, err := jobcontroller.CreateJob(nextjob.name, nextjob.namespace, nextjob.image, nextjob.command,
-				nextjob.args, notifier, false, nextjob.mountlist)
-			if err != nil {
-				clarkezoneLog.Debugf(" scheduleIfPossible Error creating job %v", err)
+		nextjob := (*jobqueue)[0]
+		*jobqueue = (*jobqueue)[1:]
+		notifier := func(job *batchv1.Job, typee kubelayer.ResourseStateType) {
+			clarkezoneLog.Debugf(" notifier called: Got job in outside world %v", typee)
+
+			clarkezoneLog.Debugf(" notifier begin send job update to jobnotifierchannel")
+			jobnotifierchannel <- &jobupdate{job, typee}
+			clarkezoneLog.Debugf(" notifier end send job update to jobnotifierchannel")
+		}
+		// a retained job with the same name, which callers of AddJobtoQueue may reuse, must be removed first
+		key := types.NamespacedName{Namespace: nextjob.namespace, Name: nextjob.name}
+		jm.deleteRetainedJob(jobcontroller, key)
+		delete(jm.completed, key)
+		opts := getJobOptions(nextjob.build)
+		opts.Env = append(append([]apiv1.EnvVar{}, nextjob.env...), buildEnv(nextjob.build)...)
+		opts.EnvFrom = nextjob.envFrom
+		opts.InitContainers = nextjob.initContainers
+		opts.Security = jm.security
+		opts.Pod = jm.podOptions
+		autoDelete := jm.retention.autoDelete()
+		if autoDelete {
+			opts.TTLSecondsAfterFinished = jm.retention.ttlSecondsAfterFinished()
+		}
+		job, err := jobcontroller.CreateJob(nextjob.name, nextjob.namespace, nextjob.image, nextjob.command,
+			nextjob.args, notifier, autoDelete, nextjob.mountlist, opts)
+		if err != nil {
+			clarkezoneLog.Errorf(" scheduleIfPossible Error creating job %v", err)
+			jm.createJobFailed(nextjob, opts, err)
+		} else if job != nil {
+			if job.UID != "" {
+				jm.jobUIDs[jobKey(job)] = job.UID
 			}
+			jm.recordJobEvent(job, apiv1.EventTypeNormal, reasonBuildStarted, "Started build of %v",
+				describeBuild(nextjob.build))
 		}
 	} else {
 		clarkezoneLog.Debugf(" scheduleIfPossible: nothing to schedule")
 	}
 }
 
+// createJobFailed reports a build whose job could not be created as failed so that observers do not
+// wait for a job that will never complete
+func (jm *Jobmanager) createJobFailed(desc jobdescriptor, opts *kubelayer.JobOptions, err error) {
+	if jm.kubeSession != nil {
+		jm.kubeSession.RecordOwnerEvent(apiv1.EventTypeWarning, reasonBuildFailed, "Build of %v failed: %v",
+			describeBuild(desc.build), err)
+	}
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: desc.name, Namespace: desc.namespace,
+		Labels: opts.Labels, Annotations: opts.Annotations}}
+	jm.notifyObservers(job, false)
+}
+
 func (jm *Jobmanager) stopMonitor() {
 	clarkezoneLog.Debugf("stopMonitor begin")
 	clarkezoneLog.Debugf(" stopMonitor begin send true to monitorDone channel")
@@ -268,48 +465,221 @@ func isCompleted(ju *jobupdate) (bool, bool) {
 	return false, false
 }
 
+// getJobOptions returns the labels and annotations applied to a render job for build
+func getJobOptions(build BuildInfo) *kubelayer.JobOptions {
+	labels := renderPodSelector()
+	if build.Site != "" {
+		labels[SiteLabel] = build.Site
+	}
+	annotations := map[string]string{
+		BranchAnnotation:  build.Branch,
+		CommitAnnotation:  build.Commit,
+		BuildIDAnnotation: build.ID,
+	}
+	if len(build.Submodules) > 0 {
+		annotations[SubmodulesAnnotation] = formatSubmodules(build.Submodules)
+	}
+	return &kubelayer.JobOptions{Labels: labels, Annotations: annotations}
+}
+
+// renderPodSelector returns the labels identifying render pods
+func renderPodSelector() map[string]string {
+	return map[string]string{managedByLabel: managedByValue, componentLabel: componentValue}
+}
+
+// SetRenderSecurity sets the security options applied to render pods. Must be called before jobs are queued.
+func (jm *Jobmanager) SetRenderSecurity(security *kubelayer.SecurityOptions) {
+	clarkezoneLog.Debugf("JobManager: SetRenderSecurity called with %+v", security)
+	jm.security = security
+}
+
+// SetRenderPodOptions sets the service account, pull secrets and pull policy of render pods.
+// Must be called before jobs are queued.
+func (jm *Jobmanager) SetRenderPodOptions(podOptions kubelayer.PodOptions) {
+	clarkezoneLog.Debugf("JobManager: SetRenderPodOptions called with %+v", podOptions)
+	jm.podOptions = podOptions
+}
+
+// EnsureRenderNetworkPolicy limits egress from render pods in namespace to DNS and rules
+func (jm *Jobmanager) EnsureRenderNetworkPolicy(namespace string, rules []kubelayer.EgressRule) error {
+	if jm.kubeSession == nil {
+		return fmt.Errorf("render network policy requires the kube executor")
+	}
+	return jm.kubeSession.EnsureEgressNetworkPolicy(renderNetworkPolicyName, namespace, renderPodSelector(), rules)
+}
+
+// describeJob returns a description of the build a job is performing for use in events
+func describeJob(job *batchv1.Job) string {
+	return describeBuild(BuildInfo{Branch: job.Annotations[BranchAnnotation],
+		Commit: job.Annotations[CommitAnnotation]})
+}
+
+func describeBuild(build BuildInfo) string {
+	branch := build.Branch
+	if branch == "" {
+		branch = "<unknown>"
+	}
+	commit := build.Commit
+	if commit == "" {
+		commit = "<unknown>"
+	}
+	return fmt.Sprintf("branch %v commit %v", branch, commit)
+}
+
+func (jm *Jobmanager) recordJobEvent(job *batchv1.Job, eventtype string, reason string,
+	messageFmt string, args ...interface{}) {
+	if jm.kubeSession == nil {
+		return
+	}
+	jm.kubeSession.RecordEvent(job, eventtype, reason, messageFmt, args...)
+}
+
 // AddJobtoQueue adds a job to the processing queue
 func (jm *Jobmanager) AddJobtoQueue(name string, namespace string,
 	image string, command []string, args []string,
-	mountlist []kubelayer.PVClaimMountRef) error {
+	mountlist []kubelayer.PVClaimMountRef, build BuildInfo) error {
+	return jm.queueJob(jobdescriptor{name: name, namespace: namespace, image: image, command: command,
+		args: args, notifier: nil, autoDelete: false, mountlist: mountlist, build: build})
+}
+
+func (jm *Jobmanager) queueJob(job jobdescriptor) error {
+	if job.build.ID == "" {
+		job.build.ID = newBuildID()
+	}
 	clarkezoneLog.Debugf("AddJobtoQueue() called with name %v, namespace:%v,"+
-		"image:%v, command:%v, args:%v, pvlist:%v",
-		name, namespace, image, command, args, mountlist)
+		"image:%v, command:%v, args:%v, pvlist:%v, build:%v",
+		job.name, job.namespace, job.image, job.command, job.args, job.mountlist, job.build)
 	// TODO do we need to deep copy command array?
 	clarkezoneLog.Debugf(" addjobtoqueue: begin add job descriptor to jm.addQueue channel")
-	jm.addQueue <- jobdescriptor{name: name, namespace: namespace, image: image, command: command,
-		args: args, notifier: nil, autoDelete: false, mountlist: mountlist}
+	jm.addQueue <- job
 	clarkezoneLog.Debugf(" addjobtoqueue: end add job descriptor to jm.addQueue channel")
+	if jm.kubeSession != nil {
+		jm.kubeSession.RecordOwnerEvent(apiv1.EventTypeNormal, reasonBuildQueued, "Queued build of %v as job %v",
+			describeBuild(job.build), job.name)
+	}
 	return nil
 }
 
+// GetJekyllRenderSpec returns the default spec for rendering a site using Jekyll
+func GetJekyllRenderSpec() RenderSpec {
+	command, params := internal.GetJekyllCommands()
+	return RenderSpec{
+		JobName:     "jekyll-render-container",
+		Image:       internal.GetJekyllImage(),
+		Command:     command,
+		Args:        params,
+		RenderClaim: "render",
+		SourceClaim: "source",
+	}
+}
+
 // CreateJekyllJob creates a render job using Jekyll
-func CreateJekyllJob(ns string, ks *kubelayer.KubeSession, jm *Jobmanager) error {
-	const rendername = "render"
-	const sourcename = "source"
-	render, err := ks.FindpvClaimByName(rendername, ns)
-	if err != nil {
-		clarkezoneLog.Errorf("CreateJekyllJob can't find pvcalim render %v", err)
+func CreateJekyllJob(ns string, ks *kubelayer.KubeSession, jm *Jobmanager, build BuildInfo) error {
+	return CreateRenderJob(ns, ks, jm, GetJekyllRenderSpec(), build)
+}
+
+// CreateRenderJob queues a job to render a site as described by spec.
+// When ks is nil, as it is for the local executor, claim names are used as is.
+// The build fails if either claim cannot be resolved to exactly one persistentvolumeclaim.
+func CreateRenderJob(ns string, ks *kubelayer.KubeSession, jm *Jobmanager, spec RenderSpec, build BuildInfo) error {
+	render, source := spec.RenderClaim, spec.SourceClaim
+	if spec.Namespace != "" {
+		ns = spec.Namespace
 	}
-	if render == "" {
-		clarkezoneLog.Errorf("CreateJekyllJob render name empty")
+	if build.Site == "" {
+		build.Site = spec.Site
 	}
-	source, err := ks.FindpvClaimByName(sourcename, ns)
-	if err != nil {
-		clarkezoneLog.Errorf("CreateJekyllJob can't find pvcalim source %v", err)
+	if build.ID == "" {
+		build.ID = newBuildID()
+	}
+	if ks != nil {
+		var err error
+		render, source, err = findClaims(ns, ks, spec)
+		if err != nil {
+			clarkezoneLog.Errorf("CreateRenderJob unable to resolve claims: %v", err)
+			ks.RecordOwnerEvent(apiv1.EventTypeWarning, reasonBuildFailed, "Build of %v failed: %v",
+				describeBuild(build), err)
+			return err
+		}
 	}
-	if source == "" {
-		clarkezoneLog.Errorf("CreateJekyllJob source name empty")
+	renderref := kubelayer.PVClaimMountRef{PVClaimName: render, MountPath: "/site", ReadOnly: false,
+		SubPath: spec.RenderSubPath}
+	srcref := kubelayer.PVClaimMountRef{PVClaimName: source, MountPath: "/src", ReadOnly: false,
+		SubPath: spec.SourceSubPath}
+	var initContainers []kubelayer.InitContainer
+	if spec.CloneRepo != "" {
+		if build.Commit == "" {
+			err := fmt.Errorf("cloning %v in the render job requires the commit being built", spec.CloneRepo)
+			clarkezoneLog.Errorf("CreateRenderJob %v", err)
+			if ks != nil {
+				ks.RecordOwnerEvent(apiv1.EventTypeWarning, reasonBuildFailed, "Build of %v failed: %v",
+					describeBuild(build), err)
+			}
+			return err
+		}
+		srcref = kubelayer.EmptyDirMountRef("/src")
+		initContainers = []kubelayer.InitContainer{cloneContainer(spec, build)}
 	}
-	renderref := ks.CreatePvCMountReference(render, "/site", false)
-	srcref := ks.CreatePvCMountReference(source, "/src", false)
-	refs := []kubelayer.PVClaimMountRef{renderref, srcref}
-	imagePath := internal.GetJekyllImage()
+	refs := append([]kubelayer.PVClaimMountRef{renderref, srcref}, spec.Volumes...)
 
-	command, params := internal.GetJekyllCommands()
-	err = jm.AddJobtoQueue("jekyll-render-container", ns, imagePath, command, params, refs)
+	err := jm.queueJob(jobdescriptor{name: buildJobName(spec.JobName, build.ID), namespace: ns, image: spec.Image, command: spec.Command,
+		args: spec.Args, mountlist: refs, env: spec.Env, envFrom: spec.EnvFrom, initContainers: initContainers,
+		build: build})
 	if err != nil {
 		clarkezoneLog.Errorf("Failed to create job: %v\n", err.Error())
 	}
 	return err
 }
+
+// CreateRemoveOutputJob queues a job removing the output of a deleted branch, the RenderSubPath
+// directory of spec's render claim, using spec's image.  Being queued it runs after any render of the
+// branch already queued, which would otherwise recreate the output.
+func CreateRemoveOutputJob(ns string, ks *kubelayer.KubeSession, jm *Jobmanager, spec RenderSpec,
+	build BuildInfo) error {
+	dir := path.Clean(spec.RenderSubPath)
+	if spec.RenderSubPath == "" || dir == "." || path.IsAbs(dir) || strings.HasPrefix(dir, "..") {
+		// the output of other branches is in the root of the claim
+		return fmt.Errorf("branch %v has no output directory of its own to remove", build.Branch)
+	}
+	if strings.Contains(dir, "'") {
+		return fmt.Errorf("output directory %v cannot be quoted", dir)
+	}
+	render := spec.RenderClaim
+	if spec.Namespace != "" {
+		ns = spec.Namespace
+	}
+	if build.ID == "" {
+		build.ID = newBuildID()
+	}
+	if ks != nil {
+		var err error
+		render, err = ks.FindpvClaim(spec.RenderClaim, ns)
+		if err != nil {
+			clarkezoneLog.Errorf("CreateRemoveOutputJob unable to resolve render claim: %v", err)
+			return err
+		}
+		ks.RecordOwnerEvent(apiv1.EventTypeNormal, reasonBranchDeleted, "Removing output %v of deleted branch %v",
+			dir, build.Branch)
+	}
+	renderref := kubelayer.PVClaimMountRef{PVClaimName: render, MountPath: "/site", ReadOnly: false}
+	return jm.queueJob(jobdescriptor{name: buildJobName(spec.JobName+"-teardown", build.ID), namespace: ns, image: spec.Image,
+		command: []string{"sh", "-c", "--"}, args: []string{fmt.Sprintf("rm -rf '/site/%v'", dir)},
+		mountlist: []kubelayer.PVClaimMountRef{renderref}, build: build})
+}
+
+// findClaims resolves the render and source claim references of spec, there is no source claim when
+// the repo is cloned in the render job
+func findClaims(ns string, ks *kubelayer.KubeSession, spec RenderSpec) (string, string, error) {
+	render, err := ks.FindpvClaim(spec.RenderClaim, ns)
+	if err != nil {
+		return "", "", fmt.Errorf("render claim: %w", err)
+	}
+	if spec.CloneRepo != "" {
+		return render, "", nil
+	}
+	source, err := ks.FindpvClaim(spec.SourceClaim, ns)
+	if err != nil {
+		return "", "", fmt.Errorf("source claim: %w", err)
+	}
+	return render, source, nil
+}
@@ -30,9 +30,9 @@ type CompletionTrackingJobManager struct {
 
 func (o *CompletionTrackingJobManager) CreateJob(name string, namespace string,
 	image string, command []string, args []string, notifier kubelayer.JobNotifier,
-	autoDelete bool, mountlist []kubelayer.PVClaimMountRef) (*batchv1.Job, error) {
+	autoDelete bool, mountlist []kubelayer.PVClaimMountRef, opts *kubelayer.JobOptions) (*batchv1.Job, error) {
 	return o.wrappedJob.CreateJob(name, namespace, image, command,
-		args, notifier, autoDelete, mountlist)
+		args, notifier, autoDelete, mountlist, opts)
 }
 
 func (o *CompletionTrackingJobManager) DeleteJob(name string, namespace string) error {
@@ -46,6 +46,11 @@ func (o *CompletionTrackingJobManager) FailedJob(name string, namespace string)
 	o.done <- true
 }
 
+func (o *CompletionTrackingJobManager) SucceededJob(name string, namespace string) {
+	o.wrappedJob.SucceededJob(name, namespace)
+	o.done <- true
+}
+
 func (o *CompletionTrackingJobManager) InProgress() bool {
 	return o.wrappedJob.InProgress()
 }
@@ -89,7 +94,7 @@ func TestCreateJobE2E(t *testing.T) {
 	// Watchers must be started after the provider has been wrapped
 	jm.StartWatchers(true)
 	err = jm.AddJobtoQueue("alpinetest", testNamespace, "alpine", nil, nil,
-		[]kubelayer.PVClaimMountRef{})
+		[]kubelayer.PVClaimMountRef{}, BuildInfo{})
 	if err != nil {
 		t.Fatalf("Unable to create job %v", err)
 	}
@@ -115,14 +120,14 @@ func TestCompletionTrackingMultiple(t *testing.T) {
 	// Watchers must be started after the provider has been wrapped
 	jm.StartWatchers(true)
 	err = jm.AddJobtoQueue("alpinetest", testNamespace, "alpine", nil, nil,
-		[]kubelayer.PVClaimMountRef{})
+		[]kubelayer.PVClaimMountRef{}, BuildInfo{})
 	if err != nil {
 		t.Fatalf("Unable to create job %v", err)
 	}
 
 	wrappedProvider.WaitDone(t, 3)
 	err = jm.AddJobtoQueue("alpinetest", testNamespace, "alpine", nil, nil,
-		[]kubelayer.PVClaimMountRef{})
+		[]kubelayer.PVClaimMountRef{}, BuildInfo{})
 	if err != nil {
 		t.Fatalf("Unable to create job %v", err)
 	}
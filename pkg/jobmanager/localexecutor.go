@@ -0,0 +1,224 @@
+package jobmanager
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubelayer "github.com/clarkezone/previewd/pkg/kubelayer"
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+// localJobManager implements Jobxxx by running render commands as local processes
+// so that the webhook to render pipeline can run without a cluster
+type localJobManager struct {
+	workDir string
+	// mounts maps the mount paths used in job specs to local directories
+	mounts  map[string]string
+	running map[string]bool
+	// jobs holds the jobs created and not yet deleted, DeleteJob sends their notifier a Delete update
+	jobs map[string]localJob
+}
+
+type localJob struct {
+	job      *batchv1.Job
+	notifier kubelayer.JobNotifier
+}
+
+// Implement jobxxx interface begin
+func (o *localJobManager) CreateJob(name string, namespace string,
+	image string, command []string, args []string, notifier kubelayer.JobNotifier,
+	autoDelete bool, mountlist []kubelayer.PVClaimMountRef, opts *kubelayer.JobOptions) (*batchv1.Job, error) {
+	clarkezoneLog.Debugf("localJobManager: CreateJob called with name:%v, namespace:%v, command:%v, args:%v",
+		name, namespace, command, args)
+	mounts := o.jobMounts(mountlist)
+	commandline := rewritePaths(mounts, append(append([]string{}, command...), args...))
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	var env []string
+	if opts != nil {
+		job.Labels = opts.Labels
+		job.Annotations = opts.Annotations
+		env = localEnv(opts.Env)
+	}
+	o.running[name] = true
+	o.jobs[name] = localJob{job: job, notifier: notifier}
+
+	go func() {
+		o.notify(notifier, job, batchv1.JobStatus{Active: 1}, kubelayer.Create)
+		err := o.run(mounts, env, commandline)
+		if err != nil {
+			clarkezoneLog.Errorf("localJobManager: job %v failed with %v", name, err)
+			o.notify(notifier, job, batchv1.JobStatus{Failed: 1}, kubelayer.Update)
+			return
+		}
+		clarkezoneLog.Infof("localJobManager: job %v succeeded", name)
+		o.notify(notifier, job, batchv1.JobStatus{Succeeded: 1}, kubelayer.Update)
+	}()
+	return job, nil
+}
+
+func (o *localJobManager) DeleteJob(name string, namespace string) error {
+	clarkezoneLog.Debugf("localJobManager: DeleteJob called with name:%v, namespace:%v", name, namespace)
+	delete(o.running, name)
+	created, ok := o.jobs[name]
+	if !ok {
+		return nil
+	}
+	delete(o.jobs, name)
+	deleted := created.job.DeepCopy()
+	now := metav1.Now()
+	deleted.DeletionTimestamp = &now
+	// the monitor goroutine DeleteJob is called from receives the update, as it would from the kube watcher
+	go o.notify(created.notifier, deleted, batchv1.JobStatus{}, kubelayer.Delete)
+	return nil
+}
+
+func (o *localJobManager) FailedJob(name string, namespace string) {
+	clarkezoneLog.Debugf("localJobManager: FailedJob called with name:%v, namespace:%v", name, namespace)
+	delete(o.running, name)
+}
+
+func (o *localJobManager) SucceededJob(name string, namespace string) {
+	clarkezoneLog.Debugf("localJobManager: SucceededJob called with name:%v, namespace:%v", name, namespace)
+	delete(o.running, name)
+}
+
+func (o *localJobManager) InProgress() bool {
+	return len(o.running) > 0
+}
+
+// Implement jobxxx interface end
+
+func (o *localJobManager) run(mounts map[string]string, env []string, commandline []string) error {
+	if len(commandline) == 0 {
+		return nil
+	}
+	for _, dir := range mounts {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+	// #nosec G204 -- the command comes from the render spec configured by the operator
+	cmd := exec.Command(commandline[0], commandline[1:]...)
+	cmd.Dir = o.workDir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func (o *localJobManager) notify(notifier kubelayer.JobNotifier, job *batchv1.Job,
+	status batchv1.JobStatus, typee kubelayer.ResourseStateType) {
+	if notifier == nil {
+		return
+	}
+	update := job.DeepCopy()
+	update.Status = status
+	notifier(update, typee)
+}
+
+// localEnv returns the environment of a local job, values from Secrets and ConfigMaps are
+// not available outside the cluster and are skipped
+func localEnv(vars []apiv1.EnvVar) []string {
+	env := make([]string, 0, len(vars))
+	for _, v := range vars {
+		if v.ValueFrom != nil {
+			clarkezoneLog.Infof("localJobManager: skipping environment variable %v set from a cluster resource", v.Name)
+			continue
+		}
+		env = append(env, v.Name+"="+v.Value)
+	}
+	return env
+}
+
+// jobMounts returns the local directories of a job's mount paths, mounts with a subpath
+// map to that directory below the configured local directory
+func (o *localJobManager) jobMounts(mountlist []kubelayer.PVClaimMountRef) map[string]string {
+	mounts := make(map[string]string, len(o.mounts))
+	for mountpath, dir := range o.mounts {
+		mounts[mountpath] = dir
+	}
+	for _, mountitem := range mountlist {
+		dir, ok := o.mounts[mountitem.MountPath]
+		if ok && mountitem.SubPath != "" {
+			mounts[mountitem.MountPath] = filepath.Join(dir, filepath.FromSlash(mountitem.SubPath))
+		}
+	}
+	return mounts
+}
+
+// rewritePaths replaces the mount paths used by render jobs with their local directories.  Each argument
+// is rewritten in a single pass so that local directories are never rewritten again, and a mount path is
+// only replaced where it starts a path, eg /src/source or --config=/src but not /usr/src or /srcfoo.
+func rewritePaths(mounts map[string]string, commandline []string) []string {
+	mountpaths := make([]string, 0, len(mounts))
+	for mountpath := range mounts {
+		mountpaths = append(mountpaths, mountpath)
+	}
+	// match longest paths first so that nested mounts resolve correctly
+	sort.Slice(mountpaths, func(i, j int) bool { return len(mountpaths[i]) > len(mountpaths[j]) })
+
+	result := make([]string, len(commandline))
+	for i, item := range commandline {
+		var rewritten strings.Builder
+		for pos := 0; pos < len(item); {
+			mountpath := matchMountPath(item, pos, mountpaths)
+			if mountpath == "" {
+				rewritten.WriteByte(item[pos])
+				pos++
+				continue
+			}
+			rewritten.WriteString(mounts[mountpath])
+			pos += len(mountpath)
+		}
+		result[i] = rewritten.String()
+	}
+	return result
+}
+
+// matchMountPath returns the first of mountpaths that is a whole leading path at pos of item, or empty if none
+func matchMountPath(item string, pos int, mountpaths []string) string {
+	if pos > 0 && isPathChar(item[pos-1]) {
+		return ""
+	}
+	for _, mountpath := range mountpaths {
+		if !strings.HasPrefix(item[pos:], mountpath) {
+			continue
+		}
+		end := pos + len(mountpath)
+		if end == len(item) || item[end] == '/' || !isPathChar(item[end]) {
+			return mountpath
+		}
+	}
+	return ""
+}
+
+// isPathChar returns true for bytes that can be part of a path name, other bytes separate arguments,
+// shell commands or flags from their values
+func isPathChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= utf8.RuneSelf ||
+		strings.IndexByte("._-~/", c) >= 0
+}
+
+// NewLocalJobmanager creates a jobmanager that runs render jobs as local processes in workDir.
+// mounts maps the mount paths used by render jobs, eg /src and /site, to local directories.
+func NewLocalJobmanager(workDir string, mounts map[string]string) (*Jobmanager, error) {
+	clarkezoneLog.Debugf("NewLocalJobmanager called with workDir:%v, mounts:%v", workDir, mounts)
+	localProvider := &localJobManager{workDir: workDir, mounts: mounts}
+	localProvider.running = make(map[string]bool)
+	localProvider.jobs = make(map[string]localJob)
+	jm, err := newjobmanagerinternal(nil, localProvider, "")
+	if err != nil {
+		return nil, err
+	}
+	jm.startMonitor(jm.JobProvider)
+	return jm, nil
+}
@@ -0,0 +1,192 @@
+package jobmanager
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+
+	kubelayer "github.com/clarkezone/previewd/pkg/kubelayer"
+)
+
+func getLocalJobManager(t *testing.T) (*Jobmanager, string, chan bool) {
+	srcDir := t.TempDir()
+	siteDir := path.Join(t.TempDir(), "output")
+	jm, err := NewLocalJobmanager(srcDir, map[string]string{"/src": srcDir, "/site": siteDir})
+	if err != nil {
+		t.Fatalf("unable to create local jobmanager %v", err)
+	}
+	done := make(chan bool, 10)
+	jm.AddBuildObserver(func(job *batchv1.Job, succeeded bool) {
+		done <- succeeded
+	})
+	return jm, siteDir, done
+}
+
+func waitBuild(t *testing.T, done chan bool) bool {
+	select {
+	case succeeded := <-done:
+		return succeeded
+	case <-time.After(10 * time.Second):
+		t.Fatalf("No build completion before 10 second timeout")
+	}
+	return false
+}
+
+func TestLocalJobSuccess(t *testing.T) {
+	jm, siteDir, done := getLocalJobManager(t)
+	defer jm.stopMonitor()
+
+	err := jm.AddJobtoQueue("localtest", "", "", []string{"sh", "-c", "--"},
+		[]string{"echo rendered > /site/index.html"}, []kubelayer.PVClaimMountRef{}, BuildInfo{Branch: "main"})
+	if err != nil {
+		t.Fatalf("AddJobtoQueue failed %v", err)
+	}
+	if !waitBuild(t, done) {
+		t.Fatalf("local job should have succeeded")
+	}
+
+	content, err := os.ReadFile(path.Join(siteDir, "index.html"))
+	if err != nil {
+		t.Fatalf("render output missing %v", err)
+	}
+	if string(content) != "rendered\n" {
+		t.Fatalf("unexpected render output %v", string(content))
+	}
+}
+
+func TestLocalJobBuildEnv(t *testing.T) {
+	jm, siteDir, done := getLocalJobManager(t)
+	defer jm.stopMonitor()
+
+	err := jm.AddJobtoQueue("localtest", "", "", []string{"sh", "-c", "--"},
+		[]string{"echo $PREVIEWD_BRANCH $PREVIEWD_COMMIT > /site/index.html"}, []kubelayer.PVClaimMountRef{},
+		BuildInfo{Branch: "main", Commit: "abc123"})
+	if err != nil {
+		t.Fatalf("AddJobtoQueue failed %v", err)
+	}
+	if !waitBuild(t, done) {
+		t.Fatalf("local job should have succeeded")
+	}
+
+	content, err := os.ReadFile(path.Join(siteDir, "index.html"))
+	if err != nil {
+		t.Fatalf("render output missing %v", err)
+	}
+	if string(content) != "main abc123\n" {
+		t.Fatalf("unexpected render output %v", string(content))
+	}
+}
+
+func TestLocalMultiJobSuccess(t *testing.T) {
+	jm, _, done := getLocalJobManager(t)
+	defer jm.stopMonitor()
+
+	for _, name := range []string{"localtest", "localtest2"} {
+		err := jm.AddJobtoQueue(name, "", "", []string{"true"}, nil, []kubelayer.PVClaimMountRef{}, BuildInfo{})
+		if err != nil {
+			t.Fatalf("AddJobtoQueue failed %v", err)
+		}
+	}
+	if !waitBuild(t, done) || !waitBuild(t, done) {
+		t.Fatalf("local jobs should have succeeded")
+	}
+}
+
+func TestLocalJobFail(t *testing.T) {
+	jm, _, done := getLocalJobManager(t)
+	defer jm.stopMonitor()
+
+	err := jm.AddJobtoQueue("localtest", "", "", []string{"false"}, nil, []kubelayer.PVClaimMountRef{}, BuildInfo{})
+	if err != nil {
+		t.Fatalf("AddJobtoQueue failed %v", err)
+	}
+	if waitBuild(t, done) {
+		t.Fatalf("local job should have failed")
+	}
+	// the failed job is retained but does not block further jobs
+	err = jm.AddJobtoQueue("localtest2", "", "", []string{"true"}, nil, []kubelayer.PVClaimMountRef{}, BuildInfo{})
+	if err != nil {
+		t.Fatalf("AddJobtoQueue failed %v", err)
+	}
+	if !waitBuild(t, done) {
+		t.Fatalf("job after a failed job should have succeeded")
+	}
+}
+
+func TestLocalRewritePaths(t *testing.T) {
+	mounts := map[string]string{"/src": "/tmp/root", "/src/source": "/tmp/checkout"}
+	result := rewritePaths(mounts, []string{"cd /src/source;ls /src"})
+	if result[0] != "cd /tmp/checkout;ls /tmp/root" {
+		t.Fatalf("incorrect rewrite %v", result[0])
+	}
+}
+
+func TestLocalRewritePathsOnce(t *testing.T) {
+	// local directories that contain a mount path must not be rewritten again
+	mounts := map[string]string{"/src": "/home/me/src/blog", "/site": "/home/me/src/blog/output"}
+	result := rewritePaths(mounts, []string{"cd /src/source;bundle exec jekyll build -d /site",
+		"--config=/src/_config.yml", "/usr/src/linux", "--source=/srcfoo", "/site"})
+	expected := []string{"cd /home/me/src/blog/source;bundle exec jekyll build -d /home/me/src/blog/output",
+		"--config=/home/me/src/blog/_config.yml", "/usr/src/linux", "--source=/srcfoo", "/home/me/src/blog/output"}
+	for i := range expected {
+		if result[i] != expected[i] {
+			t.Fatalf("incorrect rewrite %v, expected %v", result[i], expected[i])
+		}
+	}
+}
+
+func TestLocalJobMountsSubPath(t *testing.T) {
+	o := &localJobManager{mounts: map[string]string{"/src": "/tmp/root", "/site": "/tmp/site"}}
+	mounts := o.jobMounts([]kubelayer.PVClaimMountRef{{MountPath: "/site", SubPath: "feature"}, {MountPath: "/src"}})
+	if mounts["/site"] != filepath.Join("/tmp/site", "feature") || mounts["/src"] != "/tmp/root" {
+		t.Fatalf("incorrect mounts %v", mounts)
+	}
+	if o.mounts["/site"] != "/tmp/site" {
+		t.Fatalf("configured mounts were modified")
+	}
+}
+
+func TestLocalDeleteJobNotifies(t *testing.T) {
+	o := &localJobManager{workDir: t.TempDir(), mounts: map[string]string{}, running: make(map[string]bool),
+		jobs: make(map[string]localJob)}
+	updates := make(chan kubelayer.ResourseStateType, 3)
+	notifier := func(job *batchv1.Job, typee kubelayer.ResourseStateType) {
+		if typee == kubelayer.Delete && job.DeletionTimestamp == nil {
+			t.Errorf("deleted job should have a deletion timestamp")
+		}
+		updates <- typee
+	}
+	_, err := o.CreateJob("localtest", "", "", []string{"true"}, nil, notifier, false, nil, nil)
+	if err != nil {
+		t.Fatalf("CreateJob failed %v", err)
+	}
+	for _, expected := range []kubelayer.ResourseStateType{kubelayer.Create, kubelayer.Update} {
+		if typee := waitUpdate(t, updates); typee != expected {
+			t.Fatalf("unexpected update %v, expected %v", typee, expected)
+		}
+	}
+	err = o.DeleteJob("localtest", "")
+	if err != nil {
+		t.Fatalf("DeleteJob failed %v", err)
+	}
+	if typee := waitUpdate(t, updates); typee != kubelayer.Delete {
+		t.Fatalf("unexpected update %v, expected delete", typee)
+	}
+	if o.InProgress() {
+		t.Fatalf("deleted job should not be in progress")
+	}
+}
+
+func waitUpdate(t *testing.T, updates chan kubelayer.ResourseStateType) kubelayer.ResourseStateType {
+	select {
+	case typee := <-updates:
+		return typee
+	case <-time.After(10 * time.Second):
+		t.Fatalf("No job update before 10 second timeout")
+	}
+	return kubelayer.Create
+}
@@ -0,0 +1,102 @@
+package jobmanager
+
+import (
+	"math"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+const (
+	// KeepForever is a retention that never deletes finished jobs
+	KeepForever time.Duration = -1
+
+	// ttlGrace is added to the longest retention when setting TTLSecondsAfterFinished so that
+	// previewd observes completion and enforces retention itself, the TTL only cleans up
+	// jobs left behind when previewd exits
+	ttlGrace = time.Minute
+)
+
+// RetentionPolicy controls how long finished render jobs are kept before being deleted.
+// A retention of 0 deletes jobs as soon as they finish, KeepForever never deletes them.
+type RetentionPolicy struct {
+	Succeeded time.Duration
+	Failed    time.Duration
+}
+
+// DefaultRetentionPolicy deletes succeeded jobs immediately and keeps failed jobs for debugging
+func DefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{Succeeded: 0, Failed: KeepForever}
+}
+
+// autoDelete returns true if every finished job is eventually deleted so that a TTL can act as a backstop
+func (p RetentionPolicy) autoDelete() bool {
+	return p.Succeeded >= 0 && p.Failed >= 0
+}
+
+// ttlSecondsAfterFinished returns the TTL backstop for jobs created under this policy
+func (p RetentionPolicy) ttlSecondsAfterFinished() *int32 {
+	longest := p.Succeeded
+	if p.Failed > longest {
+		longest = p.Failed
+	}
+	seconds := math.Ceil((longest + ttlGrace).Seconds())
+	if seconds > math.MaxInt32 {
+		seconds = math.MaxInt32
+	}
+	ttl := int32(seconds)
+	return &ttl
+}
+
+// SetRetention sets the retention policy for finished jobs. Must be called before jobs are queued.
+func (jm *Jobmanager) SetRetention(policy RetentionPolicy) {
+	clarkezoneLog.Debugf("JobManager: SetRetention called with succeeded:%v failed:%v", policy.Succeeded, policy.Failed)
+	jm.retention = policy
+}
+
+func jobKey(job *batchv1.Job) types.NamespacedName {
+	return types.NamespacedName{Namespace: job.Namespace, Name: job.Name}
+}
+
+// retainJob schedules deletion of a finished job once retention has elapsed.
+// Must only be called from the monitor goroutine.
+func (jm *Jobmanager) retainJob(job *batchv1.Job, retention time.Duration) {
+	key := jobKey(job)
+	if timer, ok := jm.retained[key]; ok {
+		timer.Stop()
+	}
+	clarkezoneLog.Debugf(" retainJob(): deleting job %v after %v", key, retention)
+	jm.retained[key] = time.AfterFunc(retention, func() {
+		select {
+		case jm.expiredJobs <- key:
+		case <-jm.monitorExit:
+		}
+	})
+}
+
+// deleteRetainedJob deletes a retained job now rather than waiting for its retention to expire.
+// Must only be called from the monitor goroutine.
+func (jm *Jobmanager) deleteRetainedJob(jobcontroller Jobxxx, key types.NamespacedName) {
+	timer, ok := jm.retained[key]
+	if !ok {
+		return
+	}
+	timer.Stop()
+	delete(jm.retained, key)
+	clarkezoneLog.Debugf(" deleteRetainedJob(): deleting job %v", key)
+	err := jobcontroller.DeleteJob(key.Name, key.Namespace)
+	if err != nil {
+		clarkezoneLog.Errorf("Unable to delete job %v due to error %v", key.Name, err)
+	}
+}
+
+// stopRetention cancels pending deletions when the monitor exits
+func (jm *Jobmanager) stopRetention() {
+	for key, timer := range jm.retained {
+		timer.Stop()
+		delete(jm.retained, key)
+	}
+}
@@ -0,0 +1,160 @@
+package kubelayer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+const nodeNameField = "metadata.name"
+
+// claimAttachment records the node a ReadWriteOnce claim is in use on
+type claimAttachment struct {
+	claim string
+	node  string
+}
+
+// readWriteOnceOnly returns true if a claim can only be mounted by pods on a single node
+func readWriteOnceOnly(pvc *apiv1.PersistentVolumeClaim) bool {
+	modes := pvc.Status.AccessModes
+	if len(modes) == 0 {
+		// not yet bound, use the requested modes
+		modes = pvc.Spec.AccessModes
+	}
+	if len(modes) == 0 {
+		return false
+	}
+	for _, mode := range modes {
+		if mode == apiv1.ReadWriteMany || mode == apiv1.ReadOnlyMany {
+			return false
+		}
+	}
+	return true
+}
+
+// ClaimAffinity returns node affinity that schedules a pod mounting mountlist onto the node that
+// its ReadWriteOnce claims are attached to, or nil if none of them are attached.  A pod that
+// cannot be co-scheduled, because claims are attached to different nodes or a ReadWriteOncePod
+// claim is in use, would stay Pending forever so this is returned as an error instead.
+func ClaimAffinity(clientset kubernetes.Interface, namespace string,
+	mountlist []PVClaimMountRef) (*apiv1.Affinity, error) {
+	if namespace == "" {
+		namespace = apiv1.NamespaceDefault
+	}
+	var attached []claimAttachment
+	var pods *apiv1.PodList
+	for _, mountitem := range mountlist {
+		if mountitem.Source != nil || mountitem.PVClaimName == "" {
+			continue
+		}
+		pvc, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(),
+			mountitem.PVClaimName, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if !readWriteOnceOnly(pvc) {
+			continue
+		}
+		if pods == nil {
+			pods, err = clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+			if err != nil {
+				return nil, err
+			}
+		}
+		node, err := claimNode(clientset, pvc, pods)
+		if err != nil {
+			return nil, err
+		}
+		if node != "" {
+			attached = append(attached, claimAttachment{claim: pvc.Name, node: node})
+		}
+	}
+	if len(attached) == 0 {
+		return nil, nil
+	}
+	for _, item := range attached[1:] {
+		if item.node != attached[0].node {
+			return nil, fmt.Errorf("ReadWriteOnce claims %v on node %v and %v on node %v cannot be mounted by one pod, "+
+				"use ReadWriteMany claims or run the pods using them on the same node",
+				attached[0].claim, attached[0].node, item.claim, item.node)
+		}
+	}
+	clarkezoneLog.Debugf("ClaimAffinity: scheduling onto node %v where %v is attached", attached[0].node,
+		attached[0].claim)
+	return nodeAffinity(attached[0].node), nil
+}
+
+// claimNode returns the node a ReadWriteOnce claim is in use on, found from running pods that mount it
+// or from the volume attachment of its persistent volume, or empty if it is not attached
+func claimNode(clientset kubernetes.Interface, pvc *apiv1.PersistentVolumeClaim,
+	pods *apiv1.PodList) (string, error) {
+	var users []string
+	node := ""
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName == "" || pod.Status.Phase == apiv1.PodSucceeded || pod.Status.Phase == apiv1.PodFailed ||
+			!mountsClaim(pod, pvc.Name) {
+			continue
+		}
+		users = append(users, pod.Name)
+		node = pod.Spec.NodeName
+	}
+	if node != "" {
+		for _, mode := range pvc.Spec.AccessModes {
+			if mode == apiv1.ReadWriteOncePod {
+				return "", fmt.Errorf("ReadWriteOncePod claim %v is in use by pods %v", pvc.Name, strings.Join(users, ", "))
+			}
+		}
+		return node, nil
+	}
+	if pvc.Spec.VolumeName == "" {
+		return "", nil
+	}
+	attachments, err := clientset.StorageV1().VolumeAttachments().List(context.TODO(), metav1.ListOptions{})
+	if errors.IsForbidden(err) {
+		// volumeattachments are cluster scoped, without access only pods are used to find the node
+		clarkezoneLog.Debugf("claimNode: unable to list volumeattachments: %v", err)
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, attachment := range attachments.Items {
+		source := attachment.Spec.Source.PersistentVolumeName
+		if source != nil && *source == pvc.Spec.VolumeName && attachment.Status.Attached {
+			return attachment.Spec.NodeName, nil
+		}
+	}
+	return "", nil
+}
+
+func mountsClaim(pod *apiv1.Pod, claim string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claim {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeAffinity returns affinity requiring a pod to be scheduled onto node
+func nodeAffinity(node string) *apiv1.Affinity {
+	return &apiv1.Affinity{NodeAffinity: &apiv1.NodeAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: &apiv1.NodeSelector{
+			NodeSelectorTerms: []apiv1.NodeSelectorTerm{{
+				MatchFields: []apiv1.NodeSelectorRequirement{{
+					Key:      nodeNameField,
+					Operator: apiv1.NodeSelectorOpIn,
+					Values:   []string{node},
+				}},
+			}},
+		},
+	}}
+}
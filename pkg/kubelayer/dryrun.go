@@ -0,0 +1,70 @@
+package kubelayer
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+)
+
+// DryRunMode controls whether objects are actually created in the cluster
+type DryRunMode string
+
+const (
+	// DryRunNone creates objects normally
+	DryRunNone DryRunMode = "none"
+	// DryRunClient prints objects as YAML without sending them to the cluster
+	DryRunClient DryRunMode = "client"
+	// DryRunServer sends objects with server-side dry-run and prints the result as YAML
+	DryRunServer DryRunMode = "server"
+)
+
+// dryRunOutput is where dry-run manifests are written
+var dryRunOutput io.Writer = os.Stdout
+
+// ParseDryRunMode converts a flag value into a DryRunMode, empty meaning DryRunNone
+func ParseDryRunMode(value string) (DryRunMode, error) {
+	switch DryRunMode(value) {
+	case "", DryRunNone:
+		return DryRunNone, nil
+	case DryRunClient, DryRunServer:
+		return DryRunMode(value), nil
+	}
+	return DryRunNone, fmt.Errorf("unknown dry-run mode %v, must be one of %v, %v or %v",
+		value, DryRunNone, DryRunClient, DryRunServer)
+}
+
+// IsDryRun returns true if objects will not be created
+func (mode DryRunMode) IsDryRun() bool {
+	return mode == DryRunClient || mode == DryRunServer
+}
+
+func createOptions(mode DryRunMode) metav1.CreateOptions {
+	if mode == DryRunServer {
+		return metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}}
+	}
+	return metav1.CreateOptions{}
+}
+
+// printManifest writes obj to dryRunOutput as a YAML document
+func printManifest(obj runtime.Object) error {
+	obj = obj.DeepCopyObject()
+	// typed clients drop TypeMeta from results so restore it for a usable manifest
+	if obj.GetObjectKind().GroupVersionKind().Empty() {
+		gvks, _, err := scheme.Scheme.ObjectKinds(obj)
+		if err != nil {
+			return err
+		}
+		obj.GetObjectKind().SetGroupVersionKind(gvks[0])
+	}
+	data, err := yaml.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(dryRunOutput, "---\n%s", data)
+	return err
+}
@@ -0,0 +1,34 @@
+package kubelayer
+
+import (
+	"fmt"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// ParseEnvVar parses an environment variable of the form NAME=value
+func ParseEnvVar(value string) (apiv1.EnvVar, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return apiv1.EnvVar{}, fmt.Errorf("invalid environment variable %v, must be NAME=value", value)
+	}
+	return apiv1.EnvVar{Name: parts[0], Value: parts[1]}, nil
+}
+
+// ParseEnvFromSource parses a reference to a Secret or ConfigMap whose keys become environment variables,
+// of the form secret/<name> or configmap/<name>
+func ParseEnvFromSource(value string) (apiv1.EnvFromSource, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) == 2 && parts[1] != "" {
+		ref := apiv1.LocalObjectReference{Name: parts[1]}
+		switch strings.ToLower(parts[0]) {
+		case "secret":
+			return apiv1.EnvFromSource{SecretRef: &apiv1.SecretEnvSource{LocalObjectReference: ref}}, nil
+		case "configmap":
+			return apiv1.EnvFromSource{ConfigMapRef: &apiv1.ConfigMapEnvSource{LocalObjectReference: ref}}, nil
+		}
+	}
+	return apiv1.EnvFromSource{}, fmt.Errorf("invalid environment source %v, must be secret/<name> or configmap/<name>",
+		value)
+}
@@ -4,7 +4,9 @@ package kubelayer
 import (
 	"context"
 	"fmt"
+	"path"
 	"strings"
+	"time"
 
 	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/kubernetes/typed/batch/v1"
@@ -12,22 +14,91 @@ import (
 
 	batchv1 "k8s.io/api/batch/v1"
 	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
 
 	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
 )
 
 const (
-	//	jobttlsecondsafterfinished int32 = 1
-	volumeName = "vol"
+	jobttlsecondsafterfinished int32 = 1
+	volumeName                       = "vol"
+	jobDeletionPollInterval          = time.Second
 )
 
-// PVClaimMountRef is a reference used to identify PVCs
+// PVClaimMountRef is a reference used to identify PVCs, or any other volume when Source is set
 type PVClaimMountRef struct {
 	PVClaimName string
 	MountPath   string
 	ReadOnly    bool
+	// Source mounts a volume other than a claim, eg a ConfigMap, Secret, emptyDir or projected volume,
+	// PVClaimName is ignored when it is set
+	Source *apiv1.VolumeSource
+	// SubPath mounts a directory of the claim rather than its root, eg a branch's output directory
+	SubPath string
+	// SubPathExpr is like SubPath but expands $(VAR) references to the container's environment,
+	// it is mutually exclusive with SubPath
+	SubPathExpr string
+}
+
+// InitContainer runs to completion before the job's container starts, with the same volume mounts
+type InitContainer struct {
+	Name    string
+	Image   string
+	Command []string
+	Args    []string
+	Env     []apiv1.EnvVar
+}
+
+// PodOptions configures the identity and image pulling of pods created by CreateJob
+type PodOptions struct {
+	// ServiceAccountName runs the pod as a dedicated service account, empty uses the namespace default
+	ServiceAccountName string
+	// ImagePullSecrets names secrets holding credentials for private registries
+	ImagePullSecrets []string
+	// ImagePullPolicy defaults to Always
+	ImagePullPolicy apiv1.PullPolicy
+}
+
+// ParsePullPolicy converts a flag value into a PullPolicy, empty meaning Always
+func ParsePullPolicy(value string) (apiv1.PullPolicy, error) {
+	switch apiv1.PullPolicy(value) {
+	case "":
+		return apiv1.PullAlways, nil
+	case apiv1.PullAlways, apiv1.PullIfNotPresent, apiv1.PullNever:
+		return apiv1.PullPolicy(value), nil
+	}
+	return "", fmt.Errorf("unknown image pull policy %v, must be one of %v, %v or %v",
+		value, apiv1.PullAlways, apiv1.PullIfNotPresent, apiv1.PullNever)
+}
+
+// JobOptions holds optional metadata applied to jobs created by CreateJob
+type JobOptions struct {
+	// Labels are applied to both the job and its pod template
+	Labels map[string]string
+	// Annotations are applied to the job
+	Annotations map[string]string
+	// OwnerReferences cause the job to be garbage collected along with its owner
+	OwnerReferences []metav1.OwnerReference
+	// TTLSecondsAfterFinished is applied when autoDelete is set, defaulting to jobttlsecondsafterfinished
+	TTLSecondsAfterFinished *int32
+	// Pod sets the service account, pull secrets and pull policy of the job's pod
+	Pod PodOptions
+	// Security hardens the job's pod, nil leaves the pod and container security contexts unset
+	Security *SecurityOptions
+	// Env sets environment variables of the job's containers, including values from Secret and ConfigMap keys
+	Env []apiv1.EnvVar
+	// EnvFrom sets environment variables of the job's containers from every key of Secrets and ConfigMaps
+	EnvFrom []apiv1.EnvFromSource
+	// Affinity constrains the nodes the job's pod is scheduled onto, see ClaimAffinity
+	Affinity *apiv1.Affinity
+	// InitContainers run in order before the job's container, eg to fetch source into an emptyDir
+	InitContainers []InitContainer
+	// DryRun prints the job or submits it with server-side dry-run instead of creating it
+	DryRun DryRunMode
 }
 
 // PingAPI tests if server is working
@@ -44,9 +115,17 @@ func PingAPI(clientset kubernetes.Interface) {
 func CreateJob(clientset kubernetes.Interface,
 	name string,
 	namespace string, image string, command []string,
-	args []string, always bool, autoDelete bool, mountlist []PVClaimMountRef) (*batchv1.Job, error) {
+	args []string, always bool, autoDelete bool, mountlist []PVClaimMountRef,
+	opts *JobOptions) (*batchv1.Job, error) {
 	clarkezoneLog.Debugf("CreateJob called with name %v namespace %v image %v command %v args %v always %v",
 		name, namespace, image, command, args, always)
+	if opts == nil {
+		opts = &JobOptions{}
+	}
+	err := validateMounts(mountlist)
+	if err != nil {
+		return nil, err
+	}
 
 	var jobsClient v1.JobInterface
 	if namespace == "" {
@@ -55,23 +134,58 @@ func CreateJob(clientset kubernetes.Interface,
 		jobsClient = clientset.BatchV1().Jobs(namespace)
 	}
 
-	// TODO hook up pull policy
+	job := newJob(name, namespace, image, command, args, mountlist, opts)
+	if autoDelete {
+		job.Spec.TTLSecondsAfterFinished = int32Ptr(jobttlsecondsafterfinished)
+		if opts.TTLSecondsAfterFinished != nil {
+			job.Spec.TTLSecondsAfterFinished = int32Ptr(*opts.TTLSecondsAfterFinished)
+		}
+	}
+	if opts.DryRun == DryRunClient {
+		return job, printManifest(job)
+	}
+	result, err := jobsClient.Create(context.TODO(), job, createOptions(opts.DryRun))
+	if err != nil {
+		clarkezoneLog.Errorf("CreateJob: jobsClient.Create failed %v", err)
+		return nil, err
+	}
+	if opts.DryRun == DryRunServer {
+		return result, printManifest(result)
+	}
+	clarkezoneLog.Infof("Created job %v.", result.GetObjectMeta().GetName())
+	return result, nil
+}
+
+// newJob returns the job object submitted by CreateJob
+func newJob(name string, namespace string, image string, command []string,
+	args []string, mountlist []PVClaimMountRef, opts *JobOptions) *batchv1.Job {
 	job := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
 		ObjectMeta: metav1.ObjectMeta{
 			Name: name,
 			// TODO: parameterize
-			Namespace: namespace,
+			Namespace:       namespace,
+			Labels:          opts.Labels,
+			Annotations:     opts.Annotations,
+			OwnerReferences: opts.OwnerReferences,
 		},
 		Spec: batchv1.JobSpec{
 			BackoffLimit: int32Ptr(1),
-			// TTLSecondsAfterFinished: int32Ptr(jobttlsecondsafterfinished),
 			Template: apiv1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{},
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: opts.Labels,
+				},
 
 				Spec: apiv1.PodSpec{
-					Volumes:       getVolumes(mountlist),
-					Containers:    getContainers(name, image, command, args, mountlist),
-					RestartPolicy: apiv1.RestartPolicyNever,
+					Volumes:            getVolumes(mountlist),
+					Containers:         getContainers(name, image, command, args, mountlist, opts.Pod.ImagePullPolicy),
+					RestartPolicy:      apiv1.RestartPolicyNever,
+					ServiceAccountName: opts.Pod.ServiceAccountName,
+					ImagePullSecrets:   getImagePullSecrets(opts.Pod.ImagePullSecrets),
+					Affinity:           opts.Affinity,
 				},
 			},
 		},
@@ -82,50 +196,98 @@ func CreateJob(clientset kubernetes.Interface,
 	if args != nil {
 		job.Spec.Template.Spec.Containers[0].Args = args
 	}
-	result, err := jobsClient.Create(context.TODO(), job, metav1.CreateOptions{})
-	if err != nil {
-		clarkezoneLog.Errorf("CreateJob: jobsClient.Create failed %v", err)
-		return nil, err
+	for i := range job.Spec.Template.Spec.Containers {
+		job.Spec.Template.Spec.Containers[i].Env = opts.Env
+		job.Spec.Template.Spec.Containers[i].EnvFrom = opts.EnvFrom
 	}
-	clarkezoneLog.Infof("Created job %v.", result.GetObjectMeta().GetName())
-	return job, nil
+	job.Spec.Template.Spec.InitContainers = getInitContainers(opts.InitContainers, job.Spec.Template.Spec.Containers[0])
+	opts.Security.applySecurity(&job.Spec.Template.Spec)
+	return job
 }
 
-// FindpvClaimByName searches for a PersistentVolumeClaim
+// FindpvClaim resolves a claim reference that is either the exact name of a PersistentVolumeClaim
+// or a label selector such as previewd.io/role=render,previewd.io/site=blog
+func FindpvClaim(clientset kubernetes.Interface, ref string, namespace string) (string, error) {
+	if IsClaimSelector(ref) {
+		return FindpvClaimBySelector(clientset, ref, namespace)
+	}
+	return FindpvClaimByName(clientset, ref, namespace)
+}
+
+// IsClaimSelector returns true if a claim reference is a label selector rather than a name
+func IsClaimSelector(ref string) bool {
+	// claim names cannot contain the operators used in selectors
+	return strings.ContainsAny(ref, "=!(")
+}
+
+// FindpvClaimByName returns pvname if a PersistentVolumeClaim with exactly that name exists
 func FindpvClaimByName(clientset kubernetes.Interface, pvname string, namespace string) (string, error) {
-	var found string
+	if namespace == "" {
+		namespace = apiv1.NamespaceDefault
+	}
 	pvclient := clientset.CoreV1().PersistentVolumeClaims(namespace)
-	pvlist, err := pvclient.List(context.TODO(), metav1.ListOptions{})
+	claim, err := pvclient.Get(context.TODO(), pvname, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return "", fmt.Errorf("persistentvolumeclaim %v not found in namespace %v", pvname, namespace)
+	}
 	if err != nil {
 		return "", err
 	}
+	return claim.Name, nil
+}
+
+// FindpvClaimBySelector returns the name of the only PersistentVolumeClaim matching selector.
+// It is an error for no claims or more than one claim to match.
+func FindpvClaimBySelector(clientset kubernetes.Interface, selector string, namespace string) (string, error) {
+	if namespace == "" {
+		namespace = apiv1.NamespaceDefault
+	}
+	_, err := labels.Parse(selector)
+	if err != nil {
+		return "", fmt.Errorf("invalid persistentvolumeclaim selector %v: %w", selector, err)
+	}
+	pvclient := clientset.CoreV1().PersistentVolumeClaims(namespace)
+	pvlist, err := pvclient.List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return "", err
+	}
+	switch len(pvlist.Items) {
+	case 0:
+		return "", fmt.Errorf("no persistentvolumeclaim matches selector %v in namespace %v", selector, namespace)
+	case 1:
+		return pvlist.Items[0].Name, nil
+	}
+	names := make([]string, 0, len(pvlist.Items))
 	for _, item := range pvlist.Items {
-		if strings.Contains(item.ObjectMeta.Name, pvname) {
-			found = item.ObjectMeta.Name
-			break
-		}
+		names = append(names, item.Name)
 	}
-	return found, nil
+	return "", fmt.Errorf("selector %v is ambiguous in namespace %v, matches persistentvolumeclaims %v",
+		selector, namespace, strings.Join(names, ", "))
 }
 
 // getContainers returns containers based on name, command etc
 func getContainers(name string, image string, command []string,
-	args []string, mountlist []PVClaimMountRef) []apiv1.Container {
+	args []string, mountlist []PVClaimMountRef, pullPolicy apiv1.PullPolicy) []apiv1.Container {
 	containerList := []apiv1.Container{}
 	volumeMountList := []apiv1.VolumeMount{}
 
 	for i, mountitem := range mountlist {
 		volumeMountList = append(volumeMountList, apiv1.VolumeMount{
-			Name:      fmt.Sprintf("%v%v", volumeName, i),
-			ReadOnly:  mountitem.ReadOnly,
-			MountPath: mountitem.MountPath,
+			Name:        fmt.Sprintf("%v%v", volumeName, i),
+			ReadOnly:    mountitem.ReadOnly,
+			MountPath:   mountitem.MountPath,
+			SubPath:     mountitem.SubPath,
+			SubPathExpr: mountitem.SubPathExpr,
 		},
 		)
 	}
+	if pullPolicy == "" {
+		pullPolicy = apiv1.PullAlways
+	}
 	container := apiv1.Container{
 		Name:            name,
 		Image:           image,
-		ImagePullPolicy: "Always",
+		ImagePullPolicy: pullPolicy,
 		VolumeMounts:    volumeMountList,
 	}
 
@@ -142,19 +304,64 @@ func getContainers(name string, image string, command []string,
 	return containerList
 }
 
+// validateMounts checks that mount refs can be turned into valid volume mounts
+func validateMounts(mountlist []PVClaimMountRef) error {
+	for _, mountitem := range mountlist {
+		if mountitem.SubPath != "" && mountitem.SubPathExpr != "" {
+			return fmt.Errorf("mount at %v sets both subPath and subPathExpr", mountitem.MountPath)
+		}
+		subPath := path.Clean(mountitem.SubPath + mountitem.SubPathExpr)
+		if path.IsAbs(subPath) || subPath == ".." || strings.HasPrefix(subPath, "../") {
+			return fmt.Errorf("subpath %v of mount at %v must be relative to the root of the volume",
+				subPath, mountitem.MountPath)
+		}
+	}
+	return nil
+}
+
+// getInitContainers returns init containers that share the volume mounts and pull policy of container
+func getInitContainers(initContainers []InitContainer, container apiv1.Container) []apiv1.Container {
+	var result []apiv1.Container
+	for _, init := range initContainers {
+		result = append(result, apiv1.Container{
+			Name:            init.Name,
+			Image:           init.Image,
+			Command:         init.Command,
+			Args:            init.Args,
+			Env:             init.Env,
+			ImagePullPolicy: container.ImagePullPolicy,
+			VolumeMounts:    append([]apiv1.VolumeMount{}, container.VolumeMounts...),
+		})
+	}
+	return result
+}
+
+// getImagePullSecrets returns references to the named pull secrets
+func getImagePullSecrets(secrets []string) []apiv1.LocalObjectReference {
+	var result []apiv1.LocalObjectReference
+	for _, secret := range secrets {
+		result = append(result, apiv1.LocalObjectReference{Name: secret})
+	}
+	return result
+}
+
 // getVolumes returns volumes based on mount refs
 func getVolumes(mountlist []PVClaimMountRef) []apiv1.Volume {
 	volumelist := []apiv1.Volume{}
 
 	for i, mountitem := range mountlist {
-		volumelist = append(volumelist, apiv1.Volume{
-			Name: fmt.Sprintf("%v%v", volumeName, i),
-			VolumeSource: apiv1.VolumeSource{
-				PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
-					ClaimName: mountitem.PVClaimName,
-					ReadOnly:  mountitem.ReadOnly,
-				},
+		source := apiv1.VolumeSource{
+			PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+				ClaimName: mountitem.PVClaimName,
+				ReadOnly:  mountitem.ReadOnly,
 			},
+		}
+		if mountitem.Source != nil {
+			source = *mountitem.Source.DeepCopy()
+		}
+		volumelist = append(volumelist, apiv1.Volume{
+			Name:         fmt.Sprintf("%v%v", volumeName, i),
+			VolumeSource: source,
 		})
 	}
 
@@ -179,9 +386,24 @@ func DeleteJob(clientset kubernetes.Interface, name string, namespace string) er
 	return jobsClient.Delete(context.TODO(), name, meta)
 }
 
+// WaitForJobDeletion waits until a job that is being deleted no longer exists
+func WaitForJobDeletion(clientset kubernetes.Interface, name string, namespace string, timeout time.Duration) error {
+	if namespace == "" {
+		namespace = apiv1.NamespaceDefault
+	}
+	jobsClient := clientset.BatchV1().Jobs(namespace)
+	return wait.PollImmediate(jobDeletionPollInterval, timeout, func() (bool, error) {
+		_, err := jobsClient.Get(context.TODO(), name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+}
+
 // CreatePersistentVolumeClaim executes create persistentvolumeclaim action against cluster referenced by clientset
 func CreatePersistentVolumeClaim(clientset kubernetes.Interface, name string,
-	namespace string) (*apiv1.PersistentVolumeClaim, error) {
+	namespace string, dryRun DryRunMode) (*apiv1.PersistentVolumeClaim, error) {
 	var pvclient v1core.PersistentVolumeClaimInterface
 	if namespace == "" {
 		pvclient = clientset.CoreV1().PersistentVolumeClaims(apiv1.NamespaceDefault)
@@ -189,9 +411,31 @@ func CreatePersistentVolumeClaim(clientset kubernetes.Interface, name string,
 		pvclient = clientset.CoreV1().PersistentVolumeClaims(namespace)
 	}
 
+	pvclaim := newPersistentVolumeClaim(name, namespace)
+	if dryRun == DryRunClient {
+		return pvclaim, printManifest(pvclaim)
+	}
+
+	meta := createOptions(dryRun)
+	meta.TypeMeta = metav1.TypeMeta{
+		Kind:       "PersistentVolumeClaim",
+		APIVersion: "v1",
+	}
+	created, err := pvclient.Create(context.TODO(), pvclaim, meta)
+	if err != nil {
+		return nil, err
+	}
+	if dryRun == DryRunServer {
+		return created, printManifest(created)
+	}
+	return created, nil
+}
+
+// newPersistentVolumeClaim returns the persistentvolumeclaim object submitted by CreatePersistentVolumeClaim
+func newPersistentVolumeClaim(name string, namespace string) *apiv1.PersistentVolumeClaim {
 	storageClass := "longhorn"
 
-	pvclaim := apiv1.PersistentVolumeClaim{
+	return &apiv1.PersistentVolumeClaim{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "PersistentVolumeClaim",
 			APIVersion: "v1",
@@ -210,14 +454,6 @@ func CreatePersistentVolumeClaim(clientset kubernetes.Interface, name string,
 			StorageClassName: &storageClass,
 		},
 	}
-
-	meta := metav1.CreateOptions{
-		TypeMeta: metav1.TypeMeta{
-			Kind:       "PersistentVolumeClaim",
-			APIVersion: "v1",
-		},
-	}
-	return pvclient.Create(context.TODO(), &pvclaim, meta)
 }
 
 // DeletePersistentVolumeClaim executes delete persistentvolumeclaim action against cluster referenced by clientset
@@ -233,10 +469,26 @@ func DeletePersistentVolumeClaim(clientset kubernetes.Interface, name string, na
 }
 
 // CreateNamespace executes create namespace action against cluster referenced by clientset
-func CreateNamespace(clientset kubernetes.Interface, name string) (*apiv1.Namespace, error) {
+func CreateNamespace(clientset kubernetes.Interface, name string, dryRun DryRunMode) (*apiv1.Namespace, error) {
 	pvclient := clientset.CoreV1().Namespaces()
 
-	ns := &apiv1.Namespace{
+	ns := newNamespace(name)
+	if dryRun == DryRunClient {
+		return ns, printManifest(ns)
+	}
+	created, err := pvclient.Create(context.TODO(), ns, createOptions(dryRun))
+	if err != nil {
+		return nil, err
+	}
+	if dryRun == DryRunServer {
+		return created, printManifest(created)
+	}
+	return created, nil
+}
+
+// newNamespace returns the namespace object submitted by CreateNamespace
+func newNamespace(name string) *apiv1.Namespace {
+	return &apiv1.Namespace{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Namespace",
 			APIVersion: "v1",
@@ -246,12 +498,6 @@ func CreateNamespace(clientset kubernetes.Interface, name string) (*apiv1.Namesp
 			Namespace: name,
 		},
 	}
-	meta := metav1.CreateOptions{}
-	created, err := pvclient.Create(context.TODO(), ns, meta)
-	if err != nil {
-		return nil, err
-	}
-	return created, nil
 }
 
 // GetNamespace executes get namespace action against cluster referenced by clientset
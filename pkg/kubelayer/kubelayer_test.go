@@ -1,13 +1,25 @@
 package kubelayer
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/clarkezone/previewd/internal"
 	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
 	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 )
 
 // TestMain initizlie all tests
@@ -27,8 +39,714 @@ func TestApi(t *testing.T) {
 func TestCreateJobKubeLayer(t *testing.T) {
 	t.Logf("TestCreateJobKubeLayer")
 	clientset := fake.NewSimpleClientset()
-	_, err := CreateJob(clientset, "testns", "", "", nil, nil, false, false, nil)
+	_, err := CreateJob(clientset, "testns", "", "", nil, nil, false, false, nil, nil)
 	if err != nil {
 		t.Fatalf("Create job failed %v", err)
 	}
 }
+
+func TestCreateJobWithOptions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	opts := &JobOptions{
+		Labels:      map[string]string{"app": "previewd"},
+		Annotations: map[string]string{"previewd.io/branch": "main"},
+	}
+	_, err := CreateJob(clientset, "testjob", "testns", "alpine", nil, nil, false, false, nil, opts)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	job, err := clientset.BatchV1().Jobs("testns").Get(context.TODO(), "testjob", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get job failed %v", err)
+	}
+	if job.Labels["app"] != "previewd" || job.Spec.Template.Labels["app"] != "previewd" {
+		t.Fatalf("labels not applied to job and pod template")
+	}
+	if job.Annotations["previewd.io/branch"] != "main" {
+		t.Fatalf("annotations not applied to job")
+	}
+}
+
+func TestCreateJobWithSubPath(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	mounts := []PVClaimMountRef{
+		{PVClaimName: "render", MountPath: "/site", SubPath: "feature"},
+		{PVClaimName: "source", MountPath: "/src", SubPathExpr: "$(BRANCH)"},
+	}
+	job, err := CreateJob(clientset, "testjob", "testns", "alpine", nil, nil, false, false, mounts, nil)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	volumeMounts := job.Spec.Template.Spec.Containers[0].VolumeMounts
+	if volumeMounts[0].SubPath != "feature" || volumeMounts[1].SubPathExpr != "$(BRANCH)" {
+		t.Fatalf("subpaths not applied to volume mounts %v", volumeMounts)
+	}
+
+	for _, mount := range []PVClaimMountRef{
+		{PVClaimName: "render", MountPath: "/site", SubPath: "feature", SubPathExpr: "$(BRANCH)"},
+		{PVClaimName: "render", MountPath: "/site", SubPath: "/feature"},
+		{PVClaimName: "render", MountPath: "/site", SubPath: "../feature"},
+	} {
+		_, err = CreateJob(clientset, "badjob", "testns", "alpine", nil, nil, false, false,
+			[]PVClaimMountRef{mount}, nil)
+		if err == nil {
+			t.Fatalf("expected error for mount %v", mount)
+		}
+	}
+}
+
+func TestCreateJobWithVolumes(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	mounts := []PVClaimMountRef{
+		{PVClaimName: "render", MountPath: "/site"},
+		ConfigMapMountRef("blog-config", "/config"),
+		SecretMountRef("blog-keys", "/keys"),
+		EmptyDirMountRef("/scratch"),
+		ProjectedMountRef([]apiv1.VolumeProjection{
+			{Secret: &apiv1.SecretProjection{LocalObjectReference: apiv1.LocalObjectReference{Name: "blog-keys"}}},
+		}, "/combined"),
+	}
+	job, err := CreateJob(clientset, "testjob", "testns", "alpine", nil, nil, false, false, mounts, nil)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	volumes := job.Spec.Template.Spec.Volumes
+	if volumes[0].PersistentVolumeClaim.ClaimName != "render" || volumes[1].ConfigMap.Name != "blog-config" ||
+		volumes[2].Secret.SecretName != "blog-keys" || volumes[3].EmptyDir == nil || volumes[4].Projected == nil {
+		t.Fatalf("unexpected volumes %v", volumes)
+	}
+	volumeMounts := job.Spec.Template.Spec.Containers[0].VolumeMounts
+	if volumeMounts[1].MountPath != "/config" || !volumeMounts[1].ReadOnly || volumeMounts[3].ReadOnly {
+		t.Fatalf("unexpected volume mounts %v", volumeMounts)
+	}
+}
+
+func TestCreateJobWithEnv(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	token, err := ParseEnvFromSource("secret/blog-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &JobOptions{
+		Env: []apiv1.EnvVar{{Name: "JEKYLL_ENV", Value: "production"}, {Name: "JEKYLL_GITHUB_TOKEN",
+			ValueFrom: &apiv1.EnvVarSource{SecretKeyRef: &apiv1.SecretKeySelector{
+				LocalObjectReference: apiv1.LocalObjectReference{Name: "blog-tokens"}, Key: "github"}}}},
+		EnvFrom: []apiv1.EnvFromSource{token},
+	}
+	job, err := CreateJob(clientset, "testjob", "testns", "alpine", nil, nil, false, false, nil, opts)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	if len(container.Env) != 2 || container.Env[1].ValueFrom.SecretKeyRef.Key != "github" ||
+		container.EnvFrom[0].SecretRef.Name != "blog-tokens" {
+		t.Fatalf("environment not applied %v %v", container.Env, container.EnvFrom)
+	}
+}
+
+func TestCreateJobWithInitContainers(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	security := &SecurityOptions{ReadOnlyRootFilesystem: true, DropCapabilities: []string{"ALL"}}
+	opts := &JobOptions{Security: security, InitContainers: []InitContainer{{Name: "clone", Image: "alpine/git",
+		Command: []string{"sh", "-c"}, Args: []string{"git clone $REPO /src"},
+		Env: []apiv1.EnvVar{{Name: "REPO", Value: "https://github.com/clarkezone/clarkezone.github.io.git"}}}}}
+	mounts := []PVClaimMountRef{{PVClaimName: "render", MountPath: "/site"}, EmptyDirMountRef("/src")}
+	job, err := CreateJob(clientset, "testjob", "testns", "alpine", nil, nil, false, false, mounts, opts)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	initContainers := job.Spec.Template.Spec.InitContainers
+	if len(initContainers) != 1 || initContainers[0].Name != "clone" || initContainers[0].Env[0].Name != "REPO" {
+		t.Fatalf("init containers not applied %v", initContainers)
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	if len(initContainers[0].VolumeMounts) != len(container.VolumeMounts) ||
+		initContainers[0].VolumeMounts[1].MountPath != "/src" {
+		t.Fatalf("init container should share volume mounts %v", initContainers[0].VolumeMounts)
+	}
+	if initContainers[0].SecurityContext == nil || !*initContainers[0].SecurityContext.ReadOnlyRootFilesystem {
+		t.Fatalf("security not applied to init container")
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	env, err := ParseEnvVar("JEKYLL_ENV=production=true")
+	if err != nil || env.Name != "JEKYLL_ENV" || env.Value != "production=true" {
+		t.Fatalf("unexpected env %v %v", env, err)
+	}
+	for _, value := range []string{"JEKYLL_ENV", "=production"} {
+		if _, err = ParseEnvVar(value); err == nil {
+			t.Fatalf("expected error for %v", value)
+		}
+	}
+	envFrom, err := ParseEnvFromSource("configmap/blog-settings")
+	if err != nil || envFrom.ConfigMapRef.Name != "blog-settings" {
+		t.Fatalf("unexpected env source %v %v", envFrom, err)
+	}
+	for _, value := range []string{"blog-settings", "volume/blog", "secret/"} {
+		if _, err = ParseEnvFromSource(value); err == nil {
+			t.Fatalf("expected error for %v", value)
+		}
+	}
+}
+
+func TestReadSecretKey(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&apiv1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "git-credentials", Namespace: "testns"},
+		Data:       map[string][]byte{"token": []byte("secrettoken\n")},
+	})
+	selector, err := ParseSecretKeySelector("git-credentials", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := ReadSecretKey(clientset, "testns", selector)
+	if err != nil || value != "secrettoken" {
+		t.Fatalf("unexpected secret value %v %v", value, err)
+	}
+	selector, err = ParseSecretKeySelector("git-credentials/missing", "token")
+	if err != nil || selector.Key != "missing" {
+		t.Fatalf("unexpected selector %v %v", selector, err)
+	}
+	_, err = ReadSecretKey(clientset, "testns", selector)
+	if err == nil {
+		t.Fatalf("expected missing key to fail")
+	}
+	for _, value := range []string{"", "/token", "git-credentials/"} {
+		if _, err := ParseSecretKeySelector(value, "token"); err == nil {
+			t.Fatalf("expected %v to be rejected", value)
+		}
+	}
+}
+
+func TestCreateJobAutoDelete(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	job, err := CreateJob(clientset, "testjob", "testns", "alpine", nil, nil, false, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	if job.Spec.TTLSecondsAfterFinished != nil {
+		t.Fatalf("ttl should not be set without autoDelete")
+	}
+	job, err = CreateJob(clientset, "testjob2", "testns", "alpine", nil, nil, false, true, nil, nil)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	if *job.Spec.TTLSecondsAfterFinished != jobttlsecondsafterfinished {
+		t.Fatalf("default ttl not applied %v", job.Spec.TTLSecondsAfterFinished)
+	}
+	job, err = CreateJob(clientset, "testjob3", "testns", "alpine", nil, nil, false, true, nil,
+		&JobOptions{TTLSecondsAfterFinished: int32Ptr(300)})
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	if *job.Spec.TTLSecondsAfterFinished != 300 {
+		t.Fatalf("ttl not applied %v", job.Spec.TTLSecondsAfterFinished)
+	}
+}
+
+func TestCreateJobReplacesDeletingJob(t *testing.T) {
+	now := metav1.Now()
+	existing := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "testjob", Namespace: "testns",
+		DeletionTimestamp: &now}}
+	clientset := fake.NewSimpleClientset(existing)
+	ks := newkubesessionwithclientset(clientset)
+	defer ks.Close()
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		err := clientset.BatchV1().Jobs("testns").Delete(context.TODO(), "testjob", metav1.DeleteOptions{})
+		if err != nil {
+			t.Errorf("delete failed %v", err)
+		}
+	}()
+	job, err := ks.CreateJob("testjob", "testns", "alpine", nil, nil, nil, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	if job.DeletionTimestamp != nil {
+		t.Fatalf("expected new job to be created")
+	}
+}
+
+func TestSetJobOwnerFromPod(t *testing.T) {
+	pod := &apiv1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "previewd-abc", Namespace: "testns", UID: "1234"}}
+	clientset := fake.NewSimpleClientset(pod)
+	ks := newkubesessionwithclientset(clientset)
+	defer ks.Close()
+	recorder := record.NewFakeRecorder(10)
+	ks.recorder = recorder
+
+	err := ks.SetJobOwnerFromPod("previewd-abc", "testns")
+	if err != nil {
+		t.Fatalf("SetJobOwnerFromPod failed %v", err)
+	}
+	job, err := ks.CreateJob("testjob", "testns", "alpine", nil, nil, nil, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	if len(job.OwnerReferences) != 1 || job.OwnerReferences[0].UID != "1234" ||
+		job.OwnerReferences[0].Kind != "Pod" {
+		t.Fatalf("owner reference not set %v", job.OwnerReferences)
+	}
+
+	ks.RecordOwnerEvent(apiv1.EventTypeNormal, "BuildQueued", "queued %v", "main")
+	event := <-recorder.Events
+	if event != "Normal BuildQueued queued main" {
+		t.Fatalf("unexpected event %v", event)
+	}
+}
+
+func TestSetJobOwnerFromPodMissing(t *testing.T) {
+	ks := newkubesessionwithclientset(fake.NewSimpleClientset())
+	defer ks.Close()
+	err := ks.SetJobOwnerFromPod("missing", "testns")
+	if err == nil {
+		t.Fatalf("expected error for missing pod")
+	}
+}
+
+func TestClientDryRun(t *testing.T) {
+	var out bytes.Buffer
+	dryRunOutput = &out
+	defer func() { dryRunOutput = os.Stdout }()
+	clientset := fake.NewSimpleClientset()
+	ks := newkubesessionwithclientset(clientset)
+	defer ks.Close()
+	ks.SetDryRun(DryRunClient)
+
+	err := ks.CreateNamespace("testns", nil)
+	if err != nil {
+		t.Fatalf("CreateNamespace failed %v", err)
+	}
+	err = ks.CreatePersistentVolumeClaim("render", "testns")
+	if err != nil {
+		t.Fatalf("CreatePersistentVolumeClaim failed %v", err)
+	}
+	mountlist := []PVClaimMountRef{ks.CreatePvCMountReference("render", "/site", false)}
+	_, err = ks.CreateJob("testjob", "testns", "alpine", nil, nil,
+		func(*batchv1.Job, ResourseStateType) {}, false, mountlist, nil)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+
+	if len(clientset.Actions()) != 0 {
+		t.Fatalf("client dry-run should not call the api server %v", clientset.Actions())
+	}
+	if len(ks.jobnotifiers) != 0 {
+		t.Fatalf("client dry-run should not register notifiers")
+	}
+	manifest := out.String()
+	for _, expected := range []string{"kind: Namespace", "kind: PersistentVolumeClaim", "kind: Job",
+		"apiVersion: batch/v1", "claimName: render", "image: alpine"} {
+		if !strings.Contains(manifest, expected) {
+			t.Fatalf("manifest missing %v:\n%v", expected, manifest)
+		}
+	}
+	if strings.Count(manifest, "---\n") != 3 {
+		t.Fatalf("expected three yaml documents:\n%v", manifest)
+	}
+}
+
+func TestServerDryRunOptions(t *testing.T) {
+	if opts := createOptions(DryRunServer); len(opts.DryRun) != 1 || opts.DryRun[0] != metav1.DryRunAll {
+		t.Fatalf("server dry-run should set DryRunAll %v", opts.DryRun)
+	}
+	if opts := createOptions(DryRunNone); len(opts.DryRun) != 0 {
+		t.Fatalf("dry-run set when disabled %v", opts.DryRun)
+	}
+}
+
+func TestServerDryRunPrintsResult(t *testing.T) {
+	var out bytes.Buffer
+	dryRunOutput = &out
+	defer func() { dryRunOutput = os.Stdout }()
+	clientset := fake.NewSimpleClientset()
+	_, err := CreateJob(clientset, "testjob", "testns", "alpine", nil, nil, false, false, nil,
+		&JobOptions{DryRun: DryRunServer})
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	if !strings.Contains(out.String(), "kind: Job") {
+		t.Fatalf("server dry-run result not printed %v", out.String())
+	}
+}
+
+func TestParseDryRunMode(t *testing.T) {
+	for value, expected := range map[string]DryRunMode{"": DryRunNone, "none": DryRunNone,
+		"client": DryRunClient, "server": DryRunServer} {
+		mode, err := ParseDryRunMode(value)
+		if err != nil || mode != expected {
+			t.Fatalf("ParseDryRunMode(%v) returned %v %v", value, mode, err)
+		}
+	}
+	_, err := ParseDryRunMode("all")
+	if err == nil {
+		t.Fatalf("expected error for unknown mode")
+	}
+}
+
+func TestCreateJobWithSecurity(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	security := &SecurityOptions{RunAsNonRoot: true, RunAsUser: 1000, FSGroup: 1000,
+		ReadOnlyRootFilesystem: true, SeccompProfile: "RuntimeDefault", DropCapabilities: []string{"ALL"}}
+	mountlist := []PVClaimMountRef{{PVClaimName: "render", MountPath: "/site"}}
+	job, err := CreateJob(clientset, "testjob", "testns", "alpine", nil, nil, false, false, mountlist,
+		&JobOptions{Security: security})
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	podSecurity := job.Spec.Template.Spec.SecurityContext
+	if podSecurity == nil || !*podSecurity.RunAsNonRoot || *podSecurity.RunAsUser != 1000 ||
+		*podSecurity.FSGroup != 1000 || podSecurity.SeccompProfile.Type != apiv1.SeccompProfileTypeRuntimeDefault {
+		t.Fatalf("pod security context not applied %v", podSecurity)
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	if container.SecurityContext == nil || !*container.SecurityContext.ReadOnlyRootFilesystem ||
+		*container.SecurityContext.AllowPrivilegeEscalation || container.SecurityContext.Capabilities.Drop[0] != "ALL" {
+		t.Fatalf("container security context not applied %v", container.SecurityContext)
+	}
+	if len(job.Spec.Template.Spec.Volumes) != 2 || len(container.VolumeMounts) != 2 ||
+		container.VolumeMounts[1].MountPath != tmpMountPath {
+		t.Fatalf("writable tmp not mounted for read only root filesystem")
+	}
+
+	job, err = CreateJob(clientset, "testjob2", "testns", "alpine", nil, nil, false, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	if job.Spec.Template.Spec.SecurityContext != nil || job.Spec.Template.Spec.Containers[0].SecurityContext != nil {
+		t.Fatalf("security context should not be set by default")
+	}
+}
+
+func TestSeccompProfile(t *testing.T) {
+	for _, profile := range []string{"", "RuntimeDefault", "Unconfined", "Localhost/profiles/render.json"} {
+		if err := ValidateSeccompProfile(profile); err != nil {
+			t.Fatalf("profile %v should be valid %v", profile, err)
+		}
+	}
+	for _, profile := range []string{"runtime/default", "Localhost/"} {
+		if err := ValidateSeccompProfile(profile); err == nil {
+			t.Fatalf("profile %v should be invalid", profile)
+		}
+	}
+}
+
+func TestParseEgressRule(t *testing.T) {
+	for value, expected := range map[string]EgressRule{
+		"10.0.0.0/8":          {CIDR: "10.0.0.0/8"},
+		"140.82.112.0/20:443": {CIDR: "140.82.112.0/20", Port: 443},
+		"2606:50c0::/32":      {CIDR: "2606:50c0::/32"},
+		"2606:50c0::/32:443":  {CIDR: "2606:50c0::/32", Port: 443},
+		"151.101.0.0/16:80":   {CIDR: "151.101.0.0/16", Port: 80},
+	} {
+		rule, err := ParseEgressRule(value)
+		if err != nil || rule != expected {
+			t.Fatalf("ParseEgressRule(%v) returned %v %v", value, rule, err)
+		}
+	}
+	for _, value := range []string{"github.com", "10.0.0.0/8:https", "10.0.0.0/8:70000"} {
+		if _, err := ParseEgressRule(value); err == nil {
+			t.Fatalf("ParseEgressRule(%v) should fail", value)
+		}
+	}
+}
+
+func TestEnsureEgressNetworkPolicy(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	ks := newkubesessionwithclientset(clientset)
+	defer ks.Close()
+	selector := map[string]string{"app.kubernetes.io/component": "render"}
+	err := ks.EnsureEgressNetworkPolicy("render-egress", "testns", selector,
+		[]EgressRule{{CIDR: "140.82.112.0/20", Port: 443}})
+	if err != nil {
+		t.Fatalf("EnsureEgressNetworkPolicy failed %v", err)
+	}
+	// applying again updates the existing policy
+	err = ks.EnsureEgressNetworkPolicy("render-egress", "testns", selector,
+		[]EgressRule{{CIDR: "140.82.112.0/20", Port: 443}, {CIDR: "10.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("EnsureEgressNetworkPolicy update failed %v", err)
+	}
+	policy, err := clientset.NetworkingV1().NetworkPolicies("testns").Get(context.TODO(), "render-egress",
+		metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Get networkpolicy failed %v", err)
+	}
+	if policy.Spec.PodSelector.MatchLabels["app.kubernetes.io/component"] != "render" {
+		t.Fatalf("pod selector not applied %v", policy.Spec.PodSelector)
+	}
+	// dns plus one rule per allowlist entry
+	if len(policy.Spec.Egress) != 3 || policy.Spec.Egress[1].Ports[0].Port.IntValue() != 443 ||
+		policy.Spec.Egress[2].To[0].IPBlock.CIDR != "10.0.0.0/8" || policy.Spec.Egress[2].Ports != nil {
+		t.Fatalf("egress rules incorrect %v", policy.Spec.Egress)
+	}
+}
+
+func TestCreateJobWithPodOptions(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	job, err := CreateJob(clientset, "testjob", "testns", "alpine", nil, nil, false, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	if job.Spec.Template.Spec.Containers[0].ImagePullPolicy != apiv1.PullAlways {
+		t.Fatalf("pull policy should default to Always")
+	}
+	pod := PodOptions{ServiceAccountName: "previewd-render-sa", ImagePullSecrets: []string{"regcred"},
+		ImagePullPolicy: apiv1.PullIfNotPresent}
+	job, err = CreateJob(clientset, "testjob2", "testns", "alpine", nil, nil, false, false, nil, &JobOptions{Pod: pod})
+	if err != nil {
+		t.Fatalf("Create job failed %v", err)
+	}
+	spec := job.Spec.Template.Spec
+	if spec.ServiceAccountName != "previewd-render-sa" || len(spec.ImagePullSecrets) != 1 ||
+		spec.ImagePullSecrets[0].Name != "regcred" || spec.Containers[0].ImagePullPolicy != apiv1.PullIfNotPresent {
+		t.Fatalf("pod options not applied %v", spec)
+	}
+}
+
+func TestParsePullPolicy(t *testing.T) {
+	for value, expected := range map[string]apiv1.PullPolicy{"": apiv1.PullAlways, "Always": apiv1.PullAlways,
+		"IfNotPresent": apiv1.PullIfNotPresent, "Never": apiv1.PullNever} {
+		policy, err := ParsePullPolicy(value)
+		if err != nil || policy != expected {
+			t.Fatalf("ParsePullPolicy(%v) returned %v %v", value, policy, err)
+		}
+	}
+	if _, err := ParsePullPolicy("always"); err == nil {
+		t.Fatalf("expected error for unknown pull policy")
+	}
+}
+
+func getTestClaim(name string, labels map[string]string) *apiv1.PersistentVolumeClaim {
+	return &apiv1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "testns", Labels: labels}}
+}
+
+func TestFindpvClaim(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		getTestClaim("blogrender-pvc", map[string]string{"previewd.io/role": "render", "previewd.io/site": "blog"}),
+		getTestClaim("docsrender-pvc", map[string]string{"previewd.io/role": "render", "previewd.io/site": "docs"}),
+		getTestClaim("blogsource-pvc", map[string]string{"previewd.io/role": "source", "previewd.io/site": "blog"}))
+
+	for ref, expected := range map[string]string{
+		"blogrender-pvc": "blogrender-pvc",
+		"previewd.io/role=render,previewd.io/site=blog": "blogrender-pvc",
+		"previewd.io/role=source":                       "blogsource-pvc",
+	} {
+		name, err := FindpvClaim(clientset, ref, "testns")
+		if err != nil || name != expected {
+			t.Fatalf("FindpvClaim(%v) returned %v %v", ref, name, err)
+		}
+	}
+	// partial names, ambiguous and missing selectors and invalid selectors are errors
+	for _, ref := range []string{"render", "previewd.io/role=render", "previewd.io/site=wiki", "previewd.io/role=="} {
+		name, err := FindpvClaim(clientset, ref, "testns")
+		if err == nil {
+			t.Fatalf("FindpvClaim(%v) should fail, returned %v", ref, name)
+		}
+	}
+}
+
+const testKubeConfig = `apiVersion: v1
+kind: Config
+current-context: local
+clusters:
+- name: local
+  cluster:
+    server: https://local.example.com:6443
+- name: build
+  cluster:
+    server: https://build.example.com:6443
+users:
+- name: admin
+  user:
+    token: testtoken
+contexts:
+- name: local
+  context:
+    cluster: local
+    user: admin
+- name: build
+  context:
+    cluster: build
+    user: admin
+`
+
+func TestGetConfigOutofClusterWithContext(t *testing.T) {
+	kubepath := t.TempDir() + "/config"
+	err := os.WriteFile(kubepath, []byte(testKubeConfig), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kubecontext, expected := range map[string]string{
+		"":      "https://local.example.com:6443",
+		"local": "https://local.example.com:6443",
+		"build": "https://build.example.com:6443",
+	} {
+		config, err := GetConfigOutofClusterWithContext(kubepath, kubecontext)
+		if err != nil || config.Host != expected {
+			t.Fatalf("context '%v' returned %v %v", kubecontext, config, err)
+		}
+	}
+	if _, err := GetConfigOutofClusterWithContext(kubepath, "missing"); err == nil {
+		t.Fatalf("expected error for missing context")
+	}
+}
+
+func TestWithImpersonation(t *testing.T) {
+	config, err := clientcmd.RESTConfigFromKubeConfig([]byte(testKubeConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if WithImpersonation(config, "", nil) != config {
+		t.Fatalf("config should be unchanged without a user")
+	}
+	user := "system:serviceaccount:previewd:previewd-render-sa"
+	impersonating := WithImpersonation(config, user, []string{"builders"})
+	if impersonating.Impersonate.UserName != user || len(impersonating.Impersonate.Groups) != 1 ||
+		impersonating.Host != config.Host {
+		t.Fatalf("unexpected impersonation %v", impersonating.Impersonate)
+	}
+	if config.Impersonate.UserName != "" {
+		t.Fatalf("original config was modified")
+	}
+}
+
+func getTestRWOClaim(name string, volume string,
+	modes ...apiv1.PersistentVolumeAccessMode) *apiv1.PersistentVolumeClaim {
+	claim := getTestClaim(name, nil)
+	claim.Spec.AccessModes = modes
+	claim.Spec.VolumeName = volume
+	return claim
+}
+
+func getTestClaimPod(name string, node string, phase apiv1.PodPhase, claim string) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "testns"},
+		Spec: apiv1.PodSpec{NodeName: node, Volumes: []apiv1.Volume{{Name: "vol0", VolumeSource: apiv1.VolumeSource{
+			PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{ClaimName: claim}}}}},
+		Status: apiv1.PodStatus{Phase: phase},
+	}
+}
+
+func TestEnsurePreviewEnvironment(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	size := resource.MustParse("2Gi")
+	env := PreviewEnvironment{
+		Namespace:   "testns-blog-featurefoo",
+		Labels:      map[string]string{"previewd.io/site": "blog"},
+		Annotations: map[string]string{"previewd.io/last-build": "2022-06-01T00:00:00Z"},
+		Quota:       apiv1.ResourceList{apiv1.ResourceRequestsStorage: resource.MustParse("5Gi")},
+		ClaimSize:   &size,
+	}
+	err := EnsurePreviewEnvironment(clientset, env, DryRunNone)
+	if err != nil {
+		t.Fatalf("EnsurePreviewEnvironment failed %v", err)
+	}
+	claim, err := clientset.CoreV1().PersistentVolumeClaims(env.Namespace).Get(context.TODO(), PreviewRenderClaim,
+		metav1.GetOptions{})
+	if err != nil || claim.Spec.Resources.Requests.Storage().String() != "2Gi" ||
+		claim.Spec.AccessModes[0] != apiv1.ReadWriteMany {
+		t.Fatalf("render claim not created %v %v", claim, err)
+	}
+	deployment, err := clientset.AppsV1().Deployments(env.Namespace).Get(context.TODO(), PreviewServiceName,
+		metav1.GetOptions{})
+	if err != nil || deployment.Spec.Template.Spec.Volumes[0].PersistentVolumeClaim.ClaimName != PreviewRenderClaim {
+		t.Fatalf("nginx deployment not created %v %v", deployment, err)
+	}
+	_, err = clientset.CoreV1().Services(env.Namespace).Get(context.TODO(), PreviewServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("nginx service not created %v", err)
+	}
+
+	env.Annotations = map[string]string{"previewd.io/last-build": "2022-06-02T00:00:00Z"}
+	env.Quota = apiv1.ResourceList{apiv1.ResourceRequestsStorage: resource.MustParse("10Gi")}
+	err = EnsurePreviewEnvironment(clientset, env, DryRunNone)
+	if err != nil {
+		t.Fatalf("EnsurePreviewEnvironment of existing environment failed %v", err)
+	}
+	namespaces, err := ListNamespaces(clientset, "previewd.io/site=blog")
+	if err != nil || len(namespaces) != 1 ||
+		namespaces[0].Annotations["previewd.io/last-build"] != "2022-06-02T00:00:00Z" {
+		t.Fatalf("namespace not updated %v %v", namespaces, err)
+	}
+	quota, err := clientset.CoreV1().ResourceQuotas(env.Namespace).Get(context.TODO(), previewQuotaName,
+		metav1.GetOptions{})
+	if err != nil || quota.Spec.Hard.Name(apiv1.ResourceRequestsStorage, resource.BinarySI).String() != "10Gi" {
+		t.Fatalf("quota not updated %v %v", quota, err)
+	}
+}
+
+func TestEnsurePreviewEnvironmentToken(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	env := PreviewEnvironment{Namespace: "testns-blog-featurefoo", Token: "secrettoken"}
+	err := EnsurePreviewEnvironment(clientset, env, DryRunNone)
+	if err != nil {
+		t.Fatalf("EnsurePreviewEnvironment failed %v", err)
+	}
+	env.Token = "rotatedtoken"
+	err = EnsurePreviewEnvironment(clientset, env, DryRunNone)
+	if err != nil {
+		t.Fatalf("EnsurePreviewEnvironment of existing environment failed %v", err)
+	}
+	token, err := ReadSecretKey(clientset, env.Namespace, apiv1.SecretKeySelector{
+		LocalObjectReference: apiv1.LocalObjectReference{Name: PreviewTokenSecret}, Key: PreviewTokenKey})
+	if err != nil || token != "rotatedtoken" {
+		t.Fatalf("token not copied into the preview namespace %v %v", token, err)
+	}
+
+	var out bytes.Buffer
+	dryRunOutput = &out
+	defer func() { dryRunOutput = os.Stdout }()
+	err = EnsurePreviewEnvironment(clientset, env, DryRunClient)
+	if err != nil {
+		t.Fatalf("dry-run failed %v", err)
+	}
+	if !strings.Contains(out.String(), PreviewTokenSecret) || strings.Contains(out.String(), "rotatedtoken") ||
+		strings.Contains(out.String(), base64.StdEncoding.EncodeToString([]byte("rotatedtoken"))) {
+		t.Fatalf("dry-run should print the secret without its token\n%v", out.String())
+	}
+}
+
+func TestClaimAffinity(t *testing.T) {
+	volume := "pv-source"
+	clientset := fake.NewSimpleClientset(
+		getTestRWOClaim("shared", "", apiv1.ReadWriteMany),
+		getTestRWOClaim("render", "", apiv1.ReadWriteOnce),
+		getTestRWOClaim("source", volume, apiv1.ReadWriteOnce),
+		getTestRWOClaim("other", "", apiv1.ReadWriteOnce),
+		getTestRWOClaim("exclusive", "", apiv1.ReadWriteOncePod),
+		getTestClaimPod("nginx", "node1", apiv1.PodRunning, "render"),
+		getTestClaimPod("oldrender", "node2", apiv1.PodSucceeded, "render"),
+		getTestClaimPod("previewd", "node2", apiv1.PodRunning, "other"),
+		getTestClaimPod("owner", "node1", apiv1.PodRunning, "exclusive"),
+		&storagev1.VolumeAttachment{
+			ObjectMeta: metav1.ObjectMeta{Name: "attachment"},
+			Spec: storagev1.VolumeAttachmentSpec{NodeName: "node1",
+				Source: storagev1.VolumeAttachmentSource{PersistentVolumeName: &volume}},
+			Status: storagev1.VolumeAttachmentStatus{Attached: true},
+		})
+	mount := func(claim string) PVClaimMountRef { return PVClaimMountRef{PVClaimName: claim, MountPath: "/" + claim} }
+
+	affinity, err := ClaimAffinity(clientset, "testns", []PVClaimMountRef{mount("shared"), EmptyDirMountRef("/tmp")})
+	if err != nil || affinity != nil {
+		t.Fatalf("ReadWriteMany claims should not constrain scheduling %v %v", affinity, err)
+	}
+	affinity, err = ClaimAffinity(clientset, "testns", []PVClaimMountRef{mount("render"), mount("source")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	terms := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if terms[0].MatchFields[0].Values[0] != "node1" {
+		t.Fatalf("expected affinity to node1 %v", terms)
+	}
+	// claims on different nodes and ReadWriteOncePod claims in use would leave the pod pending
+	for _, claims := range [][]PVClaimMountRef{{mount("render"), mount("other")}, {mount("exclusive")}} {
+		affinity, err = ClaimAffinity(clientset, "testns", claims)
+		if err == nil {
+			t.Fatalf("expected error for %v, got %v", claims, affinity)
+		}
+	}
+	if _, err = ClaimAffinity(clientset, "testns", []PVClaimMountRef{mount("missing")}); err == nil {
+		t.Fatalf("expected error for missing claim")
+	}
+}
@@ -3,13 +3,20 @@ package kubelayer
 import (
 	"context"
 	"fmt"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 
 	batchv1 "k8s.io/api/batch/v1"
 
@@ -21,7 +28,7 @@ type ResourseStateType int
 
 const (
 	// Create indicates a job was just created
-	Create = 0
+	Create ResourseStateType = iota
 	// Update indicates a job was just updated
 	Update
 	// Delete indicates a job was just deleted
@@ -34,6 +41,11 @@ type JobNotifier func(*batchv1.Job, ResourseStateType)
 // NamespaceNotifier is a function prototype for notifications for job state changes
 type NamespaceNotifier func(*corev1.Namespace, ResourseStateType)
 
+const (
+	eventComponent     = "previewd"
+	jobDeletionTimeout = 2 * time.Minute
+)
+
 // KubeSession is a session to a k8s cluster
 type KubeSession struct {
 	currentConfig      *rest.Config
@@ -42,6 +54,10 @@ type KubeSession struct {
 	cancel             context.CancelFunc
 	jobnotifiers       map[string]JobNotifier
 	namespacenotifiers map[string]NamespaceNotifier
+	broadcaster        record.EventBroadcaster
+	recorder           record.EventRecorder
+	owner              *corev1.Pod
+	dryRun             DryRunMode
 }
 
 // Newkubesession creates a new kubesession from a config
@@ -51,39 +67,140 @@ func Newkubesession(config *rest.Config) (*KubeSession, error) {
 		return nil, fmt.Errorf("config supplied is nil")
 	}
 
-	ks := KubeSession{currentConfig: config}
-
-	clientset, err := kubernetes.NewForConfig(ks.currentConfig)
+	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		clarkezoneLog.Errorf("unable to create new clientset for config:%v", err)
 		return nil, err
 	}
-	ks.currentClientset = clientset
+	ks := newkubesessionwithclientset(clientset)
+	ks.currentConfig = config
+	return ks, nil
+}
+
+func newkubesessionwithclientset(clientset kubernetes.Interface) *KubeSession {
+	ks := KubeSession{currentClientset: clientset, dryRun: DryRunNone}
 	ctx, cancel := context.WithCancel(context.Background())
 	ks.ctx = ctx
 	ks.cancel = cancel
 	ks.jobnotifiers = make(map[string]JobNotifier)
 	ks.namespacenotifiers = make(map[string]NamespaceNotifier)
-	return &ks, nil
+	ks.broadcaster = record.NewBroadcaster()
+	ks.broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	ks.recorder = ks.broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+	return &ks
+}
+
+// SetJobOwnerFromPod looks up the named pod and makes it the owner of all jobs subsequently
+// created by this session so that they are garbage collected along with it
+func (ks *KubeSession) SetJobOwnerFromPod(podname string, namespace string) error {
+	clarkezoneLog.Debugf("KubeSession: SetJobOwnerFromPod() called with podname:%v namespace:%v", podname, namespace)
+	if namespace == "" {
+		namespace = corev1.NamespaceDefault
+	}
+	pod, err := ks.currentClientset.CoreV1().Pods(namespace).Get(ks.ctx, podname, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	ks.owner = pod
+	return nil
+}
+
+// SetDryRun controls whether objects created by this session are printed or submitted with
+// server-side dry-run rather than created. Notifiers and events are suppressed in dry-run.
+func (ks *KubeSession) SetDryRun(mode DryRunMode) {
+	clarkezoneLog.Debugf("KubeSession: SetDryRun() called with mode:%v", mode)
+	ks.dryRun = mode
+}
+
+// SetEventRecorder replaces the recorder events are recorded with, eg with a record.FakeRecorder in tests
+func (ks *KubeSession) SetEventRecorder(recorder record.EventRecorder) {
+	ks.recorder = recorder
+}
+
+// DryRun returns the dry-run mode of this session
+func (ks *KubeSession) DryRun() DryRunMode {
+	return ks.dryRun
+}
+
+func (ks *KubeSession) ownerReferences() []metav1.OwnerReference {
+	if ks.owner == nil {
+		return nil
+	}
+	return []metav1.OwnerReference{{
+		APIVersion: "v1",
+		Kind:       "Pod",
+		Name:       ks.owner.Name,
+		UID:        ks.owner.UID,
+	}}
+}
+
+// RecordEvent records a kubernetes event against the given object
+func (ks *KubeSession) RecordEvent(object runtime.Object, eventtype string, reason string,
+	messageFmt string, args ...interface{}) {
+	if ks.dryRun.IsDryRun() {
+		clarkezoneLog.Debugf("KubeSession: RecordEvent() dry-run, dropping event %v", reason)
+		return
+	}
+	ks.recorder.Eventf(object, eventtype, reason, messageFmt, args...)
+}
+
+// RecordOwnerEvent records a kubernetes event against the owner of this session's jobs.
+// The event is dropped if no owner has been set.
+func (ks *KubeSession) RecordOwnerEvent(eventtype string, reason string, messageFmt string, args ...interface{}) {
+	if ks.owner == nil || ks.dryRun.IsDryRun() {
+		clarkezoneLog.Debugf("KubeSession: RecordOwnerEvent() no owner or dry-run, dropping event %v", reason)
+		return
+	}
+	ks.recorder.Eventf(ks.owner, eventtype, reason, messageFmt, args...)
 }
 
 // CreatePersistentVolumeClaim creates a new persistentvolumeclaim
 func (ks *KubeSession) CreatePersistentVolumeClaim(name string, namespace string) error {
 	clarkezoneLog.Debugf("KubeSession: CreateVolume() called with name:%v namespace:%v", name, namespace)
-	_, err := CreatePersistentVolumeClaim(ks.currentClientset, name, namespace)
+	_, err := CreatePersistentVolumeClaim(ks.currentClientset, name, namespace, ks.dryRun)
 	return err
 }
 
 // CreateNamespace creates a new namespace
 func (ks *KubeSession) CreateNamespace(namespace string, notifier NamespaceNotifier) error {
 	clarkezoneLog.Debugf("KubeSession: CreateNamespace() called with namespace:%v", namespace)
-	if notifier != nil {
+	if notifier != nil && !ks.dryRun.IsDryRun() {
 		ks.namespacenotifiers[namespace] = notifier
 	}
-	_, err := CreateNamespace(ks.currentClientset, namespace)
+	_, err := CreateNamespace(ks.currentClientset, namespace, ks.dryRun)
+	return err
+}
+
+// EnsureEgressNetworkPolicy creates or updates a networkpolicy limiting egress from pods
+// matching podSelector to DNS and the supplied rules
+func (ks *KubeSession) EnsureEgressNetworkPolicy(name string, namespace string, podSelector map[string]string,
+	rules []EgressRule) error {
+	clarkezoneLog.Debugf("KubeSession: EnsureEgressNetworkPolicy() called with name:%v namespace:%v rules:%v",
+		name, namespace, rules)
+	_, err := CreateOrUpdateEgressNetworkPolicy(ks.currentClientset, name, namespace, podSelector, rules, ks.dryRun)
 	return err
 }
 
+// EnsurePreviewEnvironment creates or updates the namespace and objects a branch preview is rendered
+// into and served from
+func (ks *KubeSession) EnsurePreviewEnvironment(env PreviewEnvironment) error {
+	clarkezoneLog.Debugf("KubeSession: EnsurePreviewEnvironment() called with namespace:%v", env.Namespace)
+	return EnsurePreviewEnvironment(ks.currentClientset, env, ks.dryRun)
+}
+
+// ListNamespaces returns the namespaces matching a label selector
+func (ks *KubeSession) ListNamespaces(selector string) ([]corev1.Namespace, error) {
+	clarkezoneLog.Debugf("KubeSession: ListNamespaces() called with selector:%v", selector)
+	return ListNamespaces(ks.currentClientset, selector)
+}
+
+// ReadSecretKey returns the value of a key of a Secret in namespace
+func (ks *KubeSession) ReadSecretKey(namespace string, selector corev1.SecretKeySelector) (string, error) {
+	clarkezoneLog.Debugf("KubeSession: ReadSecretKey() called with namespace:%v name:%v key:%v", namespace,
+		selector.Name, selector.Key)
+	return ReadSecretKey(ks.currentClientset, namespace, selector)
+}
+
 // GetNamespace creates a new namespace
 func (ks *KubeSession) GetNamespace(namespace string) (*corev1.Namespace, error) {
 	clarkezoneLog.Debugf("KubeSession: GetNamespace() called with namespace:%v", namespace)
@@ -104,22 +221,55 @@ func (ks *KubeSession) DeleteNamespace(namespace string, notifier NamespaceNotif
 // CreateJob makes a new job
 func (ks *KubeSession) CreateJob(name string, namespace string,
 	image string, command []string, args []string, notifier JobNotifier,
-	autoDelete bool, mountlist []PVClaimMountRef) (*batchv1.Job, error) {
+	autoDelete bool, mountlist []PVClaimMountRef, opts *JobOptions) (*batchv1.Job, error) {
 	clarkezoneLog.Debugf("KubeSession: CreateJob() called with name %v, namespace:%v,"+
 		"image:%v, command:%v, args:%v, notifier:%v, autodelete:%v, pvlist:%v",
 		name, namespace, image, command, args, notifier, autoDelete, mountlist)
+	jobopts := JobOptions{}
+	if opts != nil {
+		jobopts = *opts
+	}
+	jobopts.OwnerReferences = append(jobopts.OwnerReferences, ks.ownerReferences()...)
+	jobopts.DryRun = ks.dryRun
+	if jobopts.Affinity == nil && ks.dryRun != DryRunClient {
+		// ReadWriteOnce claims can only be mounted on the node they are attached to
+		affinity, err := ClaimAffinity(ks.currentClientset, namespace, mountlist)
+		if err != nil {
+			return nil, err
+		}
+		jobopts.Affinity = affinity
+	}
 	// TODO: if job exists, delete it
 	job, err := CreateJob(ks.currentClientset, name, namespace,
-		image, command, args, true, autoDelete, mountlist)
+		image, command, args, true, autoDelete, mountlist, &jobopts)
+	if errors.IsAlreadyExists(err) && ks.jobBeingDeleted(name, namespace) {
+		// a retained job with the same name was just deleted, wait for foreground deletion to finish
+		clarkezoneLog.Infof("KubeSession: CreateJob() waiting for previous job %v to be deleted", name)
+		err = WaitForJobDeletion(ks.currentClientset, name, namespace, jobDeletionTimeout)
+		if err != nil {
+			return nil, err
+		}
+		job, err = CreateJob(ks.currentClientset, name, namespace,
+			image, command, args, true, autoDelete, mountlist, &jobopts)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if notifier != nil {
+	// jobs created in dry-run never progress so there is nothing to notify
+	if notifier != nil && !ks.dryRun.IsDryRun() {
 		ks.jobnotifiers[job.Name] = notifier
 	}
 	return job, nil
 }
 
+func (ks *KubeSession) jobBeingDeleted(name string, namespace string) bool {
+	if namespace == "" {
+		namespace = corev1.NamespaceDefault
+	}
+	job, err := ks.currentClientset.BatchV1().Jobs(namespace).Get(ks.ctx, name, metav1.GetOptions{})
+	return err == nil && job.DeletionTimestamp != nil
+}
+
 // DeleteJob deletes a job
 func (ks *KubeSession) DeleteJob(name string, namespace string) error {
 	clarkezoneLog.Debugf("KubeSession: DeleteJob() called with name:%v namespace:%v", name, namespace)
@@ -223,14 +373,14 @@ func (ks *KubeSession) getNamespaceHandlers() *cache.ResourceEventHandlerFuncs {
 			ns := obj.(*corev1.Namespace)
 			clarkezoneLog.Debugf("Namespace added: %s", ns.Name)
 			if val, ok := ks.namespacenotifiers[ns.Name]; ok {
-				val(ns, Update)
+				val(ns, Create)
 			}
 		},
 		DeleteFunc: func(obj interface{}) {
 			ns := obj.(*corev1.Namespace)
 			clarkezoneLog.Debugf("Namespace deleted: %s", ns.Name)
 			if val, ok := ks.namespacenotifiers[ns.Name]; ok {
-				val(ns, Update)
+				val(ns, Delete)
 			}
 		},
 	}
@@ -241,6 +391,11 @@ func (ks *KubeSession) FindpvClaimByName(pvname string, namespace string) (strin
 	return FindpvClaimByName(ks.currentClientset, pvname, namespace)
 }
 
+// FindpvClaim searches for a persistentvolumeclaim by name or label selector
+func (ks *KubeSession) FindpvClaim(ref string, namespace string) (string, error) {
+	return FindpvClaim(ks.currentClientset, ref, namespace)
+}
+
 // CreatePvCMountReference creates a reference based on name and mountpoint
 func (ks *KubeSession) CreatePvCMountReference(claimname string,
 	mountPath string, readOnly bool) PVClaimMountRef {
@@ -277,7 +432,37 @@ func GetConfigOutofCluster(kubepath string) (*rest.Config, error) {
 	return config, err
 }
 
+// GetConfigOutofClusterWithContext returns a config loaded from the supplied path using the named
+// context, or the kubeconfig's current context if kubecontext is empty
+func GetConfigOutofClusterWithContext(kubepath string, kubecontext string) (*rest.Config, error) {
+	clarkezoneLog.Debugf("Kubesession: GetConfigOutofClusterWithContext() called with kubepath:%v, context:%v",
+		kubepath, kubecontext)
+	if kubecontext == "" {
+		return GetConfigOutofCluster(kubepath)
+	}
+	rules := &clientcmd.ClientConfigLoadingRules{ExplicitPath: kubepath}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: kubecontext}
+	config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+	if err != nil {
+		clarkezoneLog.Errorf("Kubesession: unable to load context %v from %v: %v", kubecontext, kubepath, err)
+	}
+	return config, err
+}
+
+// WithImpersonation returns a copy of config that impersonates user, which may be a service account
+// in the form system:serviceaccount:<namespace>:<name>, and groups.  config is returned if user is empty.
+func WithImpersonation(config *rest.Config, user string, groups []string) *rest.Config {
+	if config == nil || user == "" {
+		return config
+	}
+	clarkezoneLog.Debugf("Kubesession: WithImpersonation() called with user:%v, groups:%v", user, groups)
+	impersonating := rest.CopyConfig(config)
+	impersonating.Impersonate = rest.ImpersonationConfig{UserName: user, Groups: groups}
+	return impersonating
+}
+
 // Close cancels all jobmanager go routines
 func (ks *KubeSession) Close() {
 	ks.cancel()
+	ks.broadcaster.Shutdown()
 }
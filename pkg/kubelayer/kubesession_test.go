@@ -91,8 +91,8 @@ func TestFindVolumeFail(t *testing.T) {
 	ks := getKubeSession(t)
 	createNSIfMissing(ks, false, t)
 	render, err := ks.FindpvClaimByName(name, testNamespace)
-	if err != nil {
-		t.Fatalf("error finding pvcalim %v: %v", name, err)
+	if err == nil {
+		t.Fatalf("expected error finding missing pvcalim %v", name)
 	}
 	if render != "" {
 		t.Fatalf("render should be nil")
@@ -250,7 +250,7 @@ func runTestJob(ks *KubeSession, jobName string, testNamespace string, imageUrl
 	mountlist []PVClaimMountRef) batchv1.Job {
 	defer ks.Close()
 
-	_, err := ks.CreateJob(jobName, testNamespace, imageUrl, command, nil, notifier, false, mountlist)
+	_, err := ks.CreateJob(jobName, testNamespace, imageUrl, command, nil, notifier, false, mountlist, nil)
 	if err != nil {
 		t.Fatalf("Unable to create job %v", err)
 	}
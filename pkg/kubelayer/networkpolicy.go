@@ -0,0 +1,119 @@
+package kubelayer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+const dnsPort = 53
+
+// EgressRule allows egress to a CIDR, on any port if Port is 0
+type EgressRule struct {
+	CIDR string
+	Port int32
+}
+
+// ParseEgressRule parses a CIDR optionally followed by :port, eg 140.82.112.0/20:443
+func ParseEgressRule(value string) (EgressRule, error) {
+	rule := EgressRule{CIDR: value}
+	slash := strings.LastIndex(value, "/")
+	colon := strings.LastIndex(value, ":")
+	// a colon after the prefix length separates the port, ipv6 addresses contain colons before it
+	if slash >= 0 && colon > slash {
+		port, err := strconv.ParseInt(value[colon+1:], 10, 32)
+		if err != nil || port <= 0 || port > 65535 {
+			return EgressRule{}, fmt.Errorf("invalid port in egress rule %v", value)
+		}
+		rule.CIDR = value[:colon]
+		rule.Port = int32(port)
+	}
+	_, _, err := net.ParseCIDR(rule.CIDR)
+	if err != nil {
+		return EgressRule{}, fmt.Errorf("invalid cidr in egress rule %v: %w", value, err)
+	}
+	return rule, nil
+}
+
+// CreateOrUpdateEgressNetworkPolicy executes create or update networkpolicy action against cluster
+// referenced by clientset.  The policy limits egress from pods matching podSelector to DNS and rules.
+func CreateOrUpdateEgressNetworkPolicy(clientset kubernetes.Interface, name string, namespace string,
+	podSelector map[string]string, rules []EgressRule, dryRun DryRunMode) (*networkingv1.NetworkPolicy, error) {
+	if namespace == "" {
+		namespace = apiv1.NamespaceDefault
+	}
+	npclient := clientset.NetworkingV1().NetworkPolicies(namespace)
+
+	policy := newEgressNetworkPolicy(name, namespace, podSelector, rules)
+	if dryRun == DryRunClient {
+		return policy, printManifest(policy)
+	}
+	result, err := npclient.Create(context.TODO(), policy, createOptions(dryRun))
+	if errors.IsAlreadyExists(err) {
+		var existing *networkingv1.NetworkPolicy
+		existing, err = npclient.Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		existing.Spec = policy.Spec
+		updateOptions := metav1.UpdateOptions{DryRun: createOptions(dryRun).DryRun}
+		result, err = npclient.Update(context.TODO(), existing, updateOptions)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if dryRun == DryRunServer {
+		return result, printManifest(result)
+	}
+	clarkezoneLog.Infof("Applied networkpolicy %v with %v egress rules.", name, len(rules))
+	return result, nil
+}
+
+// newEgressNetworkPolicy returns the networkpolicy object submitted by CreateOrUpdateEgressNetworkPolicy
+func newEgressNetworkPolicy(name string, namespace string, podSelector map[string]string,
+	rules []EgressRule) *networkingv1.NetworkPolicy {
+	udp := apiv1.ProtocolUDP
+	tcp := apiv1.ProtocolTCP
+	dns := intstr.FromInt(dnsPort)
+	egress := []networkingv1.NetworkPolicyEgressRule{{
+		// without DNS no allowlisted host can be resolved
+		Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dns}, {Protocol: &tcp, Port: &dns}},
+	}}
+	for _, rule := range rules {
+		egressRule := networkingv1.NetworkPolicyEgressRule{
+			To: []networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: rule.CIDR}}},
+		}
+		if rule.Port != 0 {
+			port := intstr.FromInt(int(rule.Port))
+			egressRule.Ports = []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port}}
+		}
+		egress = append(egress, egressRule)
+	}
+
+	return &networkingv1.NetworkPolicy{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "NetworkPolicy",
+			APIVersion: "networking.k8s.io/v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: podSelector},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress:      egress,
+		},
+	}
+}
@@ -0,0 +1,289 @@
+package kubelayer
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+const (
+	// PreviewRenderClaim is the name of the claim render jobs write to in a preview namespace
+	PreviewRenderClaim = "previewd-render"
+	// PreviewServiceName is the name of the service serving a preview namespace's render claim
+	PreviewServiceName = "previewd-nginx"
+	// PreviewTokenSecret is the name of the Secret holding the repo access token in a preview namespace
+	PreviewTokenSecret = "previewd-git-token"
+	// PreviewTokenKey is the key of PreviewTokenSecret holding the token
+	PreviewTokenKey = "token"
+
+	previewQuotaName    = "previewd-quota"
+	previewAppLabel     = "app"
+	defaultNginxImage   = "nginx:1.20-alpine"
+	defaultPreviewClaim = "1Gi"
+	nginxHTMLPath       = "/usr/share/nginx/html"
+)
+
+// PreviewEnvironment describes a namespace that a branch preview is rendered into and served from,
+// isolated from production and from other previews
+type PreviewEnvironment struct {
+	Namespace   string
+	Labels      map[string]string
+	Annotations map[string]string
+	// Quota is the hard limit of the namespace's ResourceQuota, no quota is created if empty
+	Quota apiv1.ResourceList
+	// ClaimSize is the size of the render claim, 1Gi if nil
+	ClaimSize        *resource.Quantity
+	StorageClassName string
+	// AccessMode of the render claim, ReadWriteMany if empty so that render pods and nginx can share it
+	AccessMode apiv1.PersistentVolumeAccessMode
+	// NginxImage serves the render claim, nginx:1.20-alpine if empty
+	NginxImage string
+	// Token is copied into PreviewTokenSecret so that render jobs can clone a private repo, no secret is
+	// created if empty.  The token is never printed by dry-run.
+	Token string
+}
+
+// EnsurePreviewEnvironment creates the namespace, quota, render claim and nginx deployment and service
+// described by env, or updates the labels, annotations and quota of an existing environment.  The
+// render claim and nginx are left untouched if they already exist.
+func EnsurePreviewEnvironment(clientset kubernetes.Interface, env PreviewEnvironment, dryRun DryRunMode) error {
+	clarkezoneLog.Debugf("EnsurePreviewEnvironment() called with namespace:%v", env.Namespace)
+	objects := []runtime.Object{newPreviewNamespace(env)}
+	if len(env.Quota) > 0 {
+		objects = append(objects, newPreviewQuota(env))
+	}
+	objects = append(objects, newPreviewClaim(env), newPreviewDeployment(env), newPreviewService(env))
+	if env.Token != "" {
+		objects = append(objects, newPreviewTokenSecret(env))
+	}
+	if dryRun == DryRunClient {
+		for _, object := range objects {
+			err := printManifest(redactSecret(object))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, object := range objects {
+		result, err := ensurePreviewObject(clientset, object, dryRun)
+		if err != nil {
+			return err
+		}
+		if dryRun == DryRunServer {
+			err = printManifest(redactSecret(result))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	clarkezoneLog.Infof("Applied preview environment in namespace %v", env.Namespace)
+	return nil
+}
+
+// ensurePreviewObject creates object, or updates the labels and annotations of an existing namespace,
+// the limits of an existing quota and the data of an existing secret
+func ensurePreviewObject(clientset kubernetes.Interface, object runtime.Object,
+	dryRun DryRunMode) (runtime.Object, error) {
+	ctx := context.TODO()
+	opts := createOptions(dryRun)
+	updateOptions := metav1.UpdateOptions{DryRun: opts.DryRun}
+	switch o := object.(type) {
+	case *apiv1.Namespace:
+		client := clientset.CoreV1().Namespaces()
+		result, err := client.Create(ctx, o, opts)
+		if !errors.IsAlreadyExists(err) {
+			return result, err
+		}
+		existing, err := client.Get(ctx, o.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		existing.Labels = mergeStrings(existing.Labels, o.Labels)
+		existing.Annotations = mergeStrings(existing.Annotations, o.Annotations)
+		return client.Update(ctx, existing, updateOptions)
+	case *apiv1.ResourceQuota:
+		client := clientset.CoreV1().ResourceQuotas(o.Namespace)
+		result, err := client.Create(ctx, o, opts)
+		if !errors.IsAlreadyExists(err) {
+			return result, err
+		}
+		existing, err := client.Get(ctx, o.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		existing.Spec = o.Spec
+		return client.Update(ctx, existing, updateOptions)
+	case *apiv1.Secret:
+		client := clientset.CoreV1().Secrets(o.Namespace)
+		result, err := client.Create(ctx, o, opts)
+		if !errors.IsAlreadyExists(err) {
+			return result, err
+		}
+		existing, err := client.Get(ctx, o.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		// the token in the site's namespace may have been rotated
+		existing.Data = o.Data
+		return client.Update(ctx, existing, updateOptions)
+	case *apiv1.PersistentVolumeClaim:
+		result, err := clientset.CoreV1().PersistentVolumeClaims(o.Namespace).Create(ctx, o, opts)
+		if errors.IsAlreadyExists(err) {
+			return o, nil
+		}
+		return result, err
+	case *appsv1.Deployment:
+		result, err := clientset.AppsV1().Deployments(o.Namespace).Create(ctx, o, opts)
+		if errors.IsAlreadyExists(err) {
+			return o, nil
+		}
+		return result, err
+	case *apiv1.Service:
+		result, err := clientset.CoreV1().Services(o.Namespace).Create(ctx, o, opts)
+		if errors.IsAlreadyExists(err) {
+			return o, nil
+		}
+		return result, err
+	}
+	return object, nil
+}
+
+func mergeStrings(existing map[string]string, values map[string]string) map[string]string {
+	if existing == nil && len(values) > 0 {
+		existing = make(map[string]string)
+	}
+	for key, value := range values {
+		existing[key] = value
+	}
+	return existing
+}
+
+func newPreviewNamespace(env PreviewEnvironment) *apiv1.Namespace {
+	ns := newNamespace(env.Namespace)
+	ns.Namespace = ""
+	ns.Labels = env.Labels
+	ns.Annotations = env.Annotations
+	return ns
+}
+
+func newPreviewQuota(env PreviewEnvironment) *apiv1.ResourceQuota {
+	return &apiv1.ResourceQuota{
+		TypeMeta:   metav1.TypeMeta{Kind: "ResourceQuota", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: previewQuotaName, Namespace: env.Namespace, Labels: env.Labels},
+		Spec:       apiv1.ResourceQuotaSpec{Hard: env.Quota},
+	}
+}
+
+func newPreviewTokenSecret(env PreviewEnvironment) *apiv1.Secret {
+	return &apiv1.Secret{
+		TypeMeta:   metav1.TypeMeta{Kind: "Secret", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: PreviewTokenSecret, Namespace: env.Namespace, Labels: env.Labels},
+		Type:       apiv1.SecretTypeOpaque,
+		Data:       map[string][]byte{PreviewTokenKey: []byte(env.Token)},
+	}
+}
+
+// redactSecret returns a copy of a Secret with its values replaced so that dry-run output never contains
+// them, other objects are returned unchanged
+func redactSecret(object runtime.Object) runtime.Object {
+	secret, ok := object.(*apiv1.Secret)
+	if !ok {
+		return object
+	}
+	secret = secret.DeepCopy()
+	for key := range secret.Data {
+		secret.Data[key] = []byte("redacted")
+	}
+	return secret
+}
+
+func newPreviewClaim(env PreviewEnvironment) *apiv1.PersistentVolumeClaim {
+	size := resource.MustParse(defaultPreviewClaim)
+	if env.ClaimSize != nil {
+		size = *env.ClaimSize
+	}
+	accessMode := env.AccessMode
+	if accessMode == "" {
+		accessMode = apiv1.ReadWriteMany
+	}
+	claim := &apiv1.PersistentVolumeClaim{
+		TypeMeta:   metav1.TypeMeta{Kind: "PersistentVolumeClaim", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: PreviewRenderClaim, Namespace: env.Namespace, Labels: env.Labels},
+		Spec: apiv1.PersistentVolumeClaimSpec{
+			AccessModes: []apiv1.PersistentVolumeAccessMode{accessMode},
+			Resources:   apiv1.ResourceRequirements{Requests: apiv1.ResourceList{apiv1.ResourceStorage: size}},
+		},
+	}
+	if env.StorageClassName != "" {
+		storageClass := env.StorageClassName
+		claim.Spec.StorageClassName = &storageClass
+	}
+	return claim
+}
+
+func newPreviewDeployment(env PreviewEnvironment) *appsv1.Deployment {
+	image := env.NginxImage
+	if image == "" {
+		image = defaultNginxImage
+	}
+	selector := map[string]string{previewAppLabel: PreviewServiceName}
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: PreviewServiceName, Namespace: env.Namespace, Labels: env.Labels},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: int32Ptr(1),
+			Selector: &metav1.LabelSelector{MatchLabels: selector},
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: selector},
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{{
+						Name:  "serve",
+						Image: image,
+						Ports: []apiv1.ContainerPort{{ContainerPort: 80}},
+						// quota may require requests and limits on every container
+						Resources: apiv1.ResourceRequirements{
+							Requests: apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("10m"),
+								apiv1.ResourceMemory: resource.MustParse("16Mi")},
+							Limits: apiv1.ResourceList{apiv1.ResourceCPU: resource.MustParse("100m"),
+								apiv1.ResourceMemory: resource.MustParse("64Mi")},
+						},
+						VolumeMounts: []apiv1.VolumeMount{{Name: "render", MountPath: nginxHTMLPath, ReadOnly: true}},
+					}},
+					Volumes: []apiv1.Volume{{Name: "render", VolumeSource: apiv1.VolumeSource{
+						PersistentVolumeClaim: &apiv1.PersistentVolumeClaimVolumeSource{
+							ClaimName: PreviewRenderClaim, ReadOnly: true}}}},
+				},
+			},
+		},
+	}
+}
+
+func newPreviewService(env PreviewEnvironment) *apiv1.Service {
+	return &apiv1.Service{
+		TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: PreviewServiceName, Namespace: env.Namespace, Labels: env.Labels},
+		Spec: apiv1.ServiceSpec{
+			Selector: map[string]string{previewAppLabel: PreviewServiceName},
+			Ports:    []apiv1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromInt(80)}},
+		},
+	}
+}
+
+// ListNamespaces returns the namespaces matching a label selector
+func ListNamespaces(clientset kubernetes.Interface, selector string) ([]apiv1.Namespace, error) {
+	list, err := clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
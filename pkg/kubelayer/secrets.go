@@ -0,0 +1,45 @@
+package kubelayer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ParseSecretKeySelector parses a reference to a key of a Secret of the form <name>/<key>, or <name>
+// to select defaultKey
+func ParseSecretKeySelector(value string, defaultKey string) (apiv1.SecretKeySelector, error) {
+	parts := strings.SplitN(value, "/", 2)
+	if parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+		return apiv1.SecretKeySelector{}, fmt.Errorf("invalid secret reference %v, must be <name> or <name>/<key>",
+			value)
+	}
+	selector := apiv1.SecretKeySelector{LocalObjectReference: apiv1.LocalObjectReference{Name: parts[0]},
+		Key: defaultKey}
+	if len(parts) == 2 {
+		selector.Key = parts[1]
+	}
+	return selector, nil
+}
+
+// ReadSecretKey returns the value of a key of a Secret with surrounding whitespace removed.  Errors
+// name the secret and key but never include the value.
+func ReadSecretKey(clientset kubernetes.Interface, namespace string, selector apiv1.SecretKeySelector) (string,
+	error) {
+	if namespace == "" {
+		namespace = apiv1.NamespaceDefault
+	}
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), selector.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	value, ok := secret.Data[selector.Key]
+	if !ok || len(strings.TrimSpace(string(value))) == 0 {
+		return "", fmt.Errorf("secret %v/%v has no value for key %v", namespace, selector.Name, selector.Key)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
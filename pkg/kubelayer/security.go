@@ -0,0 +1,129 @@
+package kubelayer
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	apiv1 "k8s.io/api/core/v1"
+
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+const (
+	tmpVolumeName          = "tmp"
+	tmpMountPath           = "/tmp"
+	localhostSeccompPrefix = "Localhost/"
+)
+
+// SecurityOptions hardens the pods created by CreateJob
+type SecurityOptions struct {
+	RunAsNonRoot bool
+	// RunAsUser and FSGroup should match the ownership of files on mounted claims, 0 leaves them unset
+	RunAsUser int64
+	FSGroup   int64
+	// ReadOnlyRootFilesystem also mounts a writable emptyDir at /tmp for renderer scratch files
+	ReadOnlyRootFilesystem bool
+	// SeccompProfile is RuntimeDefault, Unconfined or Localhost/<profile>, empty leaves it unset
+	SeccompProfile   string
+	DropCapabilities []string
+}
+
+// ValidateSeccompProfile checks that profile is a value accepted by SecurityOptions
+func ValidateSeccompProfile(profile string) error {
+	_, err := seccompProfile(profile)
+	return err
+}
+
+func seccompProfile(profile string) (*apiv1.SeccompProfile, error) {
+	switch {
+	case profile == "":
+		return nil, nil
+	case profile == string(apiv1.SeccompProfileTypeRuntimeDefault):
+		return &apiv1.SeccompProfile{Type: apiv1.SeccompProfileTypeRuntimeDefault}, nil
+	case profile == string(apiv1.SeccompProfileTypeUnconfined):
+		return &apiv1.SeccompProfile{Type: apiv1.SeccompProfileTypeUnconfined}, nil
+	case strings.HasPrefix(profile, localhostSeccompPrefix) && len(profile) > len(localhostSeccompPrefix):
+		localhostProfile := strings.TrimPrefix(profile, localhostSeccompPrefix)
+		return &apiv1.SeccompProfile{Type: apiv1.SeccompProfileTypeLocalhost, LocalhostProfile: &localhostProfile}, nil
+	}
+	return nil, fmt.Errorf("unknown seccomp profile %v, must be RuntimeDefault, Unconfined or Localhost/<profile>",
+		profile)
+}
+
+// podSecurityContext returns the pod level security context or nil if nothing is configured
+func (s *SecurityOptions) podSecurityContext() *apiv1.PodSecurityContext {
+	if s == nil {
+		return nil
+	}
+	result := &apiv1.PodSecurityContext{}
+	if s.RunAsNonRoot {
+		result.RunAsNonRoot = boolPtr(true)
+	}
+	if s.RunAsUser != 0 {
+		result.RunAsUser = int64Ptr(s.RunAsUser)
+	}
+	if s.FSGroup != 0 {
+		result.FSGroup = int64Ptr(s.FSGroup)
+	}
+	profile, err := seccompProfile(s.SeccompProfile)
+	if err != nil {
+		clarkezoneLog.Errorf("SecurityOptions: ignoring %v", err)
+	}
+	result.SeccompProfile = profile
+	if reflect.DeepEqual(*result, apiv1.PodSecurityContext{}) {
+		return nil
+	}
+	return result
+}
+
+// containerSecurityContext returns the container level security context or nil if nothing is configured
+func (s *SecurityOptions) containerSecurityContext() *apiv1.SecurityContext {
+	if s == nil || (!s.ReadOnlyRootFilesystem && len(s.DropCapabilities) == 0) {
+		return nil
+	}
+	result := &apiv1.SecurityContext{}
+	if s.ReadOnlyRootFilesystem {
+		result.ReadOnlyRootFilesystem = boolPtr(true)
+	}
+	if len(s.DropCapabilities) > 0 {
+		result.AllowPrivilegeEscalation = boolPtr(false)
+		result.Capabilities = &apiv1.Capabilities{}
+		for _, capability := range s.DropCapabilities {
+			result.Capabilities.Drop = append(result.Capabilities.Drop, apiv1.Capability(capability))
+		}
+	}
+	return result
+}
+
+// applySecurity hardens the pod spec of a job
+func (s *SecurityOptions) applySecurity(spec *apiv1.PodSpec) {
+	if s == nil {
+		return
+	}
+	spec.SecurityContext = s.podSecurityContext()
+	containers := []*apiv1.Container{}
+	for i := range spec.InitContainers {
+		containers = append(containers, &spec.InitContainers[i])
+	}
+	for i := range spec.Containers {
+		containers = append(containers, &spec.Containers[i])
+	}
+	for _, container := range containers {
+		container.SecurityContext = s.containerSecurityContext()
+	}
+	if s.ReadOnlyRootFilesystem {
+		spec.Volumes = append(spec.Volumes, apiv1.Volume{
+			Name:         tmpVolumeName,
+			VolumeSource: apiv1.VolumeSource{EmptyDir: &apiv1.EmptyDirVolumeSource{}},
+		})
+		for _, container := range containers {
+			container.VolumeMounts = append(container.VolumeMounts,
+				apiv1.VolumeMount{Name: tmpVolumeName, MountPath: tmpMountPath})
+		}
+	}
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func int64Ptr(i int64) *int64 { return &i }
@@ -0,0 +1,33 @@
+package kubelayer
+
+import (
+	apiv1 "k8s.io/api/core/v1"
+)
+
+// ConfigMapMountRef returns a read only mount of the keys of a ConfigMap as files, eg configuration overrides
+func ConfigMapMountRef(configMap string, mountPath string) PVClaimMountRef {
+	return PVClaimMountRef{MountPath: mountPath, ReadOnly: true, Source: &apiv1.VolumeSource{
+		ConfigMap: &apiv1.ConfigMapVolumeSource{LocalObjectReference: apiv1.LocalObjectReference{Name: configMap}},
+	}}
+}
+
+// SecretMountRef returns a read only mount of the keys of a Secret as files, eg API keys used by the renderer
+func SecretMountRef(secret string, mountPath string) PVClaimMountRef {
+	return PVClaimMountRef{MountPath: mountPath, ReadOnly: true, Source: &apiv1.VolumeSource{
+		Secret: &apiv1.SecretVolumeSource{SecretName: secret},
+	}}
+}
+
+// EmptyDirMountRef returns a mount of scratch space that lives as long as the pod
+func EmptyDirMountRef(mountPath string) PVClaimMountRef {
+	return PVClaimMountRef{MountPath: mountPath, Source: &apiv1.VolumeSource{
+		EmptyDir: &apiv1.EmptyDirVolumeSource{},
+	}}
+}
+
+// ProjectedMountRef returns a read only mount combining ConfigMaps, Secrets and other sources in one directory
+func ProjectedMountRef(sources []apiv1.VolumeProjection, mountPath string) PVClaimMountRef {
+	return PVClaimMountRef{MountPath: mountPath, ReadOnly: true, Source: &apiv1.VolumeSource{
+		Projected: &apiv1.ProjectedVolumeSource{Sources: sources},
+	}}
+}
@@ -1,30 +1,103 @@
 package localrepomanager
 
 import (
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
 
 	"github.com/go-git/go-git/v5/plumbing"
 
 	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
 )
 
+// defaultTokenUsername is sent with a personal access token when no username is configured, GitHub
+// accepts any username but Gitea and GitLab require the token owner's
+const defaultTokenUsername = "abc123"
+
+// alternatesFile lists the object directories of other repos that a repo reads objects from
+const alternatesFile = "alternates"
+
 type gitlayer struct {
 	repo *git.Repository
 	wt   *git.Worktree
-	pat  string
+	auth transport.AuthMethod
+	opts cloneOptions
+	// shared is the clone whose objects a worktree created by newWorktree reads, nil for clones
+	shared *gitlayer
+}
+
+// cloneOptions limit how much of a repo is cloned, the zero value clones all history, branches and tags
+type cloneOptions struct {
+	// depth truncates history to the given number of commits, 0 for full history
+	depth int
+	// singleBranch clones only the default branch, other branches are fetched when switched to
+	singleBranch bool
+	// noTags skips fetching tags
+	noTags bool
+	// submodules initializes and updates submodules recursively after every clone and checkout
+	submodules bool
+	// branch is checked out by clones rather than the remote's default branch
+	branch string
+}
+
+// tags returns the tag mode of clones and fetches, the invalid mode selects go-git's defaults
+func (o cloneOptions) tags() git.TagMode {
+	if o.noTags {
+		return git.NoTags
+	}
+	return git.InvalidTagMode
+}
+
+// tokenAuth returns basic auth sending a personal access token as the password, or nil for
+// anonymous access if pat is empty
+func tokenAuth(username string, pat string) transport.AuthMethod {
+	if pat == "" {
+		return nil
+	}
+	if username == "" {
+		username = defaultTokenUsername
+	}
+	return &http.BasicAuth{Username: username, Password: pat}
+}
+
+// RedactURL removes credentials embedded in a repo url so that it can be logged
+func RedactURL(repo string) string {
+	u, err := url.Parse(repo)
+	if err != nil || u.User == nil {
+		return repo
+	}
+	u.User = url.User("redacted")
+	return u.String()
 }
 
-func clone(repo string, localfolder string) (*gitlayer, error) {
-	clarkezoneLog.Debugf("gitlayer::clone repo:%v localfolder:%v", repo, localfolder)
-	gl := &gitlayer{}
+func clone(repo string, localfolder string, auth transport.AuthMethod, opts cloneOptions) (*gitlayer, error) {
+	clarkezoneLog.Debugf("gitlayer::clone repo:%v localfolder:%v authenticated:%v depth:%v singleBranch:%v"+
+		" noTags:%v", RedactURL(repo), localfolder, auth != nil, opts.depth, opts.singleBranch, opts.noTags)
+	gl := &gitlayer{auth: auth, opts: opts}
 
 	var clo = &git.CloneOptions{
-		URL:      repo,
-		Progress: os.Stdout,
+		URL:          repo,
+		Progress:     os.Stdout,
+		Auth:         auth,
+		Depth:        opts.depth,
+		SingleBranch: opts.singleBranch,
+		Tags:         opts.tags(),
+	}
+	if opts.submodules {
+		clo.RecurseSubmodules = git.DefaultSubmoduleRecursionDepth
+	}
+	if opts.branch != "" {
+		clo.ReferenceName = plumbing.NewBranchReferenceName(opts.branch)
 	}
 
 	err := doClone(gl, localfolder, clo)
@@ -32,10 +105,206 @@ func clone(repo string, localfolder string) (*gitlayer, error) {
 		clarkezoneLog.Errorf("gitlayer::clone doclone failed with %v", err)
 		return nil, err
 	}
+	err = gl.fetchLFS()
+	if err != nil {
+		clarkezoneLog.Errorf("gitlayer::clone fetchLFS failed with %v", err)
+		return nil, err
+	}
 
 	return gl, nil
 }
 
+// sameRemote returns true if two repo urls name the same remote, ignoring credentials and a trailing
+// .git or slash
+func sameRemote(a string, b string) bool {
+	normalize := func(repo string) string {
+		return strings.TrimSuffix(strings.TrimSuffix(RedactURL(repo), "/"), ".git")
+	}
+	return normalize(a) == normalize(b)
+}
+
+// reuseClone opens an existing clone of repo in localfolder and resets it to opts.branch, or the
+// remote's default branch if it is empty, removing untracked files, so that restarts do not clone from
+// scratch.  It returns nil and no error if localfolder does not hold a clone of repo or the clone is
+// corrupt, in which case it should be wiped and cloned again, and an error if the remote cannot be fetched.
+func reuseClone(repo string, localfolder string, auth transport.AuthMethod,
+	opts cloneOptions) (*gitlayer, string, error) {
+	re, err := git.PlainOpen(localfolder)
+	if err != nil {
+		if !errors.Is(err, git.ErrRepositoryNotExists) {
+			clarkezoneLog.Infof("gitlayer::reuseClone unable to open clone in %v: %v", localfolder, err)
+		}
+		return nil, "", nil
+	}
+	origin, err := re.Remote("origin")
+	if err != nil || len(origin.Config().URLs) == 0 || !sameRemote(origin.Config().URLs[0], repo) {
+		clarkezoneLog.Infof("gitlayer::reuseClone clone in %v is not of %v", localfolder, RedactURL(repo))
+		return nil, "", nil
+	}
+	head, err := re.Head()
+	if err == nil {
+		_, err = re.CommitObject(head.Hash())
+	}
+	if err != nil {
+		clarkezoneLog.Infof("gitlayer::reuseClone clone in %v is corrupt: %v", localfolder, err)
+		return nil, "", nil
+	}
+	wt, err := re.Worktree()
+	if err != nil {
+		clarkezoneLog.Infof("gitlayer::reuseClone clone in %v has no worktree: %v", localfolder, err)
+		return nil, "", nil
+	}
+	if origin.Config().URLs[0] != repo {
+		// only the credentials differ, eg a rotated token
+		cfg, err := re.Config()
+		if err != nil {
+			return nil, "", err
+		}
+		cfg.Remotes["origin"].URLs = []string{repo}
+		err = re.SetConfig(cfg)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	branch := opts.branch
+	if branch == "" {
+		branch, _, err = lsRemote(repo, "", auth)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	gl := &gitlayer{repo: re, wt: wt, auth: auth, opts: opts}
+	err = gl.fetch(branch)
+	if err != nil {
+		return nil, "", err
+	}
+	err = gl.wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewRemoteReferenceName("origin", branch), Force: true})
+	if err == nil {
+		err = gl.wt.Clean(&git.CleanOptions{Dir: true})
+	}
+	if err == nil {
+		err = gl.updateSubmodules()
+	}
+	if err != nil {
+		clarkezoneLog.Infof("gitlayer::reuseClone unable to reset clone in %v: %v", localfolder, err)
+		return nil, "", nil
+	}
+	err = gl.fetchLFS()
+	if err != nil {
+		return nil, "", err
+	}
+	clarkezoneLog.Infof("gitlayer::reuseClone reusing clone in %v at branch %v", localfolder, branch)
+	return gl, branch, nil
+}
+
+// newWorktree creates an empty repo in localfolder that reads the objects of shared through
+// objects/info/alternates, so that a branch's worktree only adds the files checked out.  The worktree
+// never fetches from the remote itself, pull fetches into shared and checks out the result.  The
+// alternates path is relative so the worktree stays usable wherever the claim holding both is mounted,
+// but render jobs mount only the worktree, so git commands run by a renderer cannot read its objects.
+func newWorktree(shared *gitlayer, repo string, localfolder string) (*gitlayer, error) {
+	clarkezoneLog.Debugf("gitlayer::newWorktree repo:%v localfolder:%v", RedactURL(repo), localfolder)
+	re, err := git.PlainInit(localfolder, false)
+	if err != nil {
+		return nil, err
+	}
+	// origin is only read to find the LFS server and by reuseWorktree
+	_, err = re.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{repo}})
+	if err != nil {
+		return nil, err
+	}
+	err = writeAlternates(shared, localfolder)
+	if err != nil {
+		return nil, err
+	}
+	wt, err := re.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	return &gitlayer{repo: re, wt: wt, auth: shared.auth, opts: shared.opts, shared: shared}, nil
+}
+
+// reuseWorktree opens a worktree of repo created by newWorktree in localfolder by a previous run.  It
+// returns nil if localfolder does not hold one, in which case it should be wiped and created again.
+func reuseWorktree(shared *gitlayer, repo string, localfolder string) *gitlayer {
+	re, err := git.PlainOpen(localfolder)
+	if err != nil {
+		return nil
+	}
+	origin, err := re.Remote("origin")
+	if err != nil || len(origin.Config().URLs) == 0 || !sameRemote(origin.Config().URLs[0], repo) {
+		return nil
+	}
+	// full clones made before worktrees shared objects are replaced
+	_, err = os.Stat(path.Join(localfolder, ".git", "objects", "info", alternatesFile))
+	if err != nil {
+		return nil
+	}
+	// worktrees made by earlier versions list the absolute path of shared's objects
+	err = writeAlternates(shared, localfolder)
+	if err != nil {
+		return nil
+	}
+	wt, err := re.Worktree()
+	if err != nil {
+		return nil
+	}
+	clarkezoneLog.Infof("gitlayer::reuseWorktree reusing worktree in %v", localfolder)
+	return &gitlayer{repo: re, wt: wt, auth: shared.auth, opts: shared.opts, shared: shared}
+}
+
+// writeAlternates points the repo in localfolder at the objects of shared by a path relative to its own
+// objects directory, which is what git resolves relative alternates against
+func writeAlternates(shared *gitlayer, localfolder string) error {
+	objects := path.Join(localfolder, ".git", "objects")
+	err := os.MkdirAll(path.Join(objects, "info"), 0755)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(objects, path.Join(shared.wt.Filesystem.Root(), ".git", "objects"))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path.Join(objects, "info", alternatesFile), []byte(filepath.ToSlash(rel)+"\n"), 0600)
+}
+
+// pullShared fetches branch into the clone a worktree shares objects with and checks out the fetched
+// commit, removing untracked files
+func (gl *gitlayer) pullShared(branch string) error {
+	err := gl.shared.fetch(branch)
+	if err != nil {
+		return err
+	}
+	name := plumbing.NewRemoteReferenceName("origin", branch)
+	ref, err := gl.shared.repo.Reference(name, true)
+	if err != nil {
+		return err
+	}
+	// history is truncated where the shared clone's is
+	shallow, err := gl.shared.repo.Storer.Shallow()
+	if err != nil {
+		return err
+	}
+	err = gl.repo.Storer.SetShallow(shallow)
+	if err != nil {
+		return err
+	}
+	err = gl.repo.Storer.SetReference(plumbing.NewHashReference(name, ref.Hash()))
+	if err != nil {
+		return err
+	}
+	err = gl.wt.Checkout(&git.CheckoutOptions{Branch: name, Force: true})
+	if err != nil {
+		return err
+	}
+	err = gl.wt.Clean(&git.CleanOptions{Dir: true})
+	if err != nil {
+		return err
+	}
+	return gl.updateWorktree()
+}
+
 func doClone(gl *gitlayer, localfolder string, clo *git.CloneOptions) error {
 	re, err := git.PlainClone(localfolder, false, clo)
 	if err != nil {
@@ -57,88 +326,248 @@ func doClone(gl *gitlayer, localfolder string, clo *git.CloneOptions) error {
 	return nil
 }
 
-// func secureClone(repo string, localfolder string, pw string) (*gitlayer, error) {
-// 	gl := &gitlayer{}
-//
-// 	gl.pat = pw
-// 	var clo = &git.CloneOptions{
-// 		URL:      repo,
-// 		Progress: os.Stdout,
-// 		Auth: &http.BasicAuth{
-// 			Username: "abc123", // yes, this can be anything except an empty string
-// 			Password: pw,
-// 		},
-// 	}
-//
-// 	err := doClone(gl, localfolder, clo)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-//
-// 	return gl, nil
-// }
+// fetch updates the remote tracking ref of branch.  Only branch is fetched so that single branch
+// clones can switch to branches they did not clone, and shallow clones are deepened only by the
+// history of the branch switched to.
+func (gl *gitlayer) fetch(branch string) error {
+	refspec := config.RefSpec(fmt.Sprintf("+%v:%v", plumbing.NewBranchReferenceName(branch),
+		plumbing.NewRemoteReferenceName("origin", branch)))
+	origin, err := gl.repo.Remote("origin")
+	if err != nil {
+		clarkezoneLog.Errorf("gitlayer::fetch unable to get remote origin: %v", err)
+		return err
+	}
+	s, err := newShallowStorer(gl.repo.Storer)
+	if err != nil {
+		return err
+	}
+	err = git.NewRemote(s, origin.Config()).Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{refspec},
+		Depth:      gl.opts.depth,
+		Tags:       gl.opts.tags(),
+		Force:      true,
+		Auth:       gl.auth,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		clarkezoneLog.Errorf("gitlayer::fetch fetch of branch %v failed with %v", branch, err)
+		return err
+	}
+	return nil
+}
 
 func (gl *gitlayer) checkout(branch string) error {
-	remote, err := gl.repo.Remote("origin")
+	err := gl.fetch(branch)
 	if err != nil {
-		fmt.Printf("Get remote %v\n", err.Error())
 		return err
 	}
 
-	var feo *git.FetchOptions
+	nm := plumbing.NewRemoteReferenceName("origin", branch)
 
-	if gl.pat == "" {
-		feo = &git.FetchOptions{Force: true}
-	} else {
-		feo = &git.FetchOptions{
-			Auth: &http.BasicAuth{
-				Username: "abc123", // yes, this can be anything except an empty string
-				Password: gl.pat,
-			},
-		}
+	fmt.Printf("Checking out new branch %v with force", nm)
+	err = gl.wt.Checkout(&git.CheckoutOptions{Branch: nm, Force: true})
+
+	if err != nil {
+		fmt.Printf("Checkout new branch failed %v\n", err.Error())
+		return err
 	}
+	return gl.updateWorktree()
+}
 
-	err = remote.Fetch(feo)
-	if err != nil && err.Error() != "already up-to-date" {
-		fmt.Printf("Fetch failed %v\n", err.Error())
+// updateWorktree completes a checkout by updating submodules and replacing LFS pointers with their objects
+func (gl *gitlayer) updateWorktree() error {
+	err := gl.updateSubmodules()
+	if err != nil {
+		return err
+	}
+	err = gl.fetchLFS()
+	if err != nil {
+		clarkezoneLog.Errorf("gitlayer::fetchLFS failed with %v", err)
 		return err
 	}
+	return nil
+}
 
-	nm := plumbing.NewRemoteReferenceName(remote.Config().Name, branch)
+// updateSubmodules initializes and updates submodules recursively to the commits recorded in the
+// worktree, authenticating as the parent repo does
+func (gl *gitlayer) updateSubmodules() error {
+	if !gl.opts.submodules {
+		return nil
+	}
+	submodules, err := gl.wt.Submodules()
+	if err != nil {
+		return err
+	}
+	err = submodules.Update(&git.SubmoduleUpdateOptions{Init: true,
+		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth, Auth: gl.auth})
+	if err != nil {
+		clarkezoneLog.Errorf("gitlayer::updateSubmodules failed with %v", err)
+		return err
+	}
+	return nil
+}
 
-	fmt.Printf("Checking out new branch %v with force", nm)
-	err = gl.wt.Checkout(&git.CheckoutOptions{Branch: nm, Force: true})
+// submoduleCommits returns the commit checked out in each submodule, including nested submodules,
+// keyed by path
+func (gl *gitlayer) submoduleCommits() (map[string]string, error) {
+	if !gl.opts.submodules {
+		return nil, nil
+	}
+	commits := make(map[string]string)
+	err := addSubmoduleCommits(gl.wt, "", commits)
+	if err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
 
+func addSubmoduleCommits(wt *git.Worktree, prefix string, commits map[string]string) error {
+	submodules, err := wt.Submodules()
 	if err != nil {
-		fmt.Printf("Checkout new branch failed %v\n", err.Error())
 		return err
 	}
+	for _, submodule := range submodules {
+		status, err := submodule.Status()
+		if err != nil {
+			return err
+		}
+		if status.Current.IsZero() {
+			// not initialized
+			continue
+		}
+		subpath := path.Join(prefix, status.Path)
+		commits[subpath] = status.Current.String()
+		repo, err := submodule.Repository()
+		if err != nil {
+			return err
+		}
+		subwt, err := repo.Worktree()
+		if err != nil {
+			return err
+		}
+		err = addSubmoduleCommits(subwt, subpath, commits)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (gl *gitlayer) pull(branch string) error {
-	fmt.Printf("Pulling branch %v\n", branch)
-	nm := plumbing.NewBranchReferenceName(branch)
-
-	var feo *git.PullOptions
-
-	if gl.pat == "" {
-		feo = &git.PullOptions{ReferenceName: nm, Force: true}
-	} else {
-		feo = &git.PullOptions{
-			ReferenceName: nm,
-			Auth: &http.BasicAuth{
-				Username: "abc123", // yes, this can be anything except an empty string
-				Password: gl.pat,
-			},
+// lsRemote returns the commit branch points to in repo without cloning it.  If branch is empty the
+// remote's default branch is resolved and returned along with its commit.
+func lsRemote(repo string, branch string, auth transport.AuthMethod) (string, string, error) {
+	clarkezoneLog.Debugf("gitlayer::lsRemote repo:%v branch:%v", RedactURL(repo), branch)
+	refs, err := listRemote(repo, auth)
+	if err != nil {
+		return "", "", err
+	}
+	want := plumbing.NewBranchReferenceName(branch)
+	if branch == "" {
+		want = plumbing.HEAD
+	}
+	for i := 0; i < 2; i++ {
+		for _, ref := range refs {
+			if ref.Name() != want {
+				continue
+			}
+			if ref.Type() == plumbing.SymbolicReference {
+				// HEAD names the default branch, resolve it on the next pass
+				want = ref.Target()
+				break
+			}
+			return want.Short(), ref.Hash().String(), nil
 		}
 	}
+	return "", "", fmt.Errorf("branch %v not found in %v", want.Short(), RedactURL(repo))
+}
 
-	err := gl.wt.Pull(feo)
+// remoteHeads returns the commit each branch of repo points to without cloning it
+func remoteHeads(repo string, auth transport.AuthMethod) (map[string]string, error) {
+	refs, err := listRemote(repo, auth)
+	if err != nil {
+		return nil, err
+	}
+	heads := make(map[string]string)
+	for _, ref := range refs {
+		if ref.Name().IsBranch() {
+			heads[ref.Name().Short()] = ref.Hash().String()
+		}
+	}
+	return heads, nil
+}
 
-	if err != nil && err.Error() != "already up-to-date" {
-		fmt.Printf("Pull failed %v\n", err.Error())
+func listRemote(repo string, auth transport.AuthMethod) ([]*plumbing.Reference, error) {
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{repo}})
+	return remote.List(&git.ListOptions{Auth: auth})
+}
+
+// checkoutCommit checks out commit, verifying that it was fetched
+func (gl *gitlayer) checkoutCommit(commit string) error {
+	hash := plumbing.NewHash(commit)
+	_, err := gl.repo.CommitObject(hash)
+	if err != nil {
+		return fmt.Errorf("commit %v was not fetched, it may have been force pushed away or be deeper than the "+
+			"clone depth: %w", commit, err)
+	}
+	err = gl.wt.Checkout(&git.CheckoutOptions{Hash: hash, Force: true})
+	if err != nil {
+		return err
+	}
+	err = gl.updateWorktree()
+	if err != nil {
+		return err
+	}
+	head, err := gl.headCommit()
+	if err != nil {
 		return err
 	}
+	if head != commit {
+		return fmt.Errorf("checked out %v rather than commit %v", head, commit)
+	}
 	return nil
 }
+
+func (gl *gitlayer) headCommit() (string, error) {
+	ref, err := gl.repo.Head()
+	if err != nil {
+		return "", err
+	}
+	return ref.Hash().String(), nil
+}
+
+// headBranch returns the branch checked out, which after a clone is the remote's default branch
+func (gl *gitlayer) headBranch() (string, error) {
+	ref, err := gl.repo.Head()
+	if err != nil {
+		return "", err
+	}
+	if !ref.Name().IsBranch() {
+		return "", fmt.Errorf("no branch is checked out, HEAD is %v", ref.Hash())
+	}
+	return ref.Name().Short(), nil
+}
+
+// pull fetches branch and resets the worktree to it, fetching into the shared clone of worktrees.  Unlike
+// git pull no fast-forward check is made, which would walk history that a shallow clone does not have.
+func (gl *gitlayer) pull(branch string) error {
+	fmt.Printf("Pulling branch %v\n", branch)
+	if gl.shared != nil {
+		return gl.pullShared(branch)
+	}
+	err := gl.fetch(branch)
+	if err != nil {
+		return err
+	}
+
+	ref, err := gl.repo.Reference(plumbing.NewRemoteReferenceName("origin", branch), true)
+	if err != nil {
+		fmt.Printf("Pull failed %v\n", err.Error())
+		return err
+	}
+	err = gl.wt.Reset(&git.ResetOptions{Commit: ref.Hash(), Mode: git.HardReset})
+	if err != nil {
+		fmt.Printf("Pull failed %v\n", err.Error())
+		return err
+	}
+	return gl.updateWorktree()
+}
@@ -4,10 +4,18 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/clarkezone/previewd/internal"
 	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/sirupsen/logrus"
 )
 
@@ -37,7 +45,7 @@ func TestCloneNoAuth(t *testing.T) {
 		t.Fatalf("Dir already exists")
 	}
 
-	_, err = clone(reponame, dirName)
+	_, err = clone(reponame, dirName, nil, cloneOptions{})
 
 	if err != nil {
 		t.Fatalf("Clone failed %v", err)
@@ -73,7 +81,7 @@ func TestPullBranch(t *testing.T) {
 		log.Fatal("TestPullBranch: removeallfailed")
 	}
 
-	repo, err := clone(reponame, dirName)
+	repo, err := clone(reponame, dirName, nil, cloneOptions{})
 	if err != nil {
 		log.Fatal("TestPullBranch: clone failed")
 	}
@@ -118,7 +126,7 @@ func TestPullBranch(t *testing.T) {
 // 		log.Fatal("TestCloneAuth: removeallfailed")
 // 	}
 //
-// 	_, err = secureClone(secureproname, dirname, pw)
+// 	_, err = clone(secureproname, dirname, tokenAuth("", pw), cloneOptions{})
 // 	// repo, err := clone(reponame, dirname, "", pw)
 // 	if err != nil {
 // 		log.Fatal("TestCloneAuth: clone failed")
@@ -148,3 +156,281 @@ func TestPullBranch(t *testing.T) {
 // 		log.Fatal("TestCloneAuth: removeallfailed")
 // 	}
 // }
+
+// createTestRepo creates a repo with a commit on master and a feature branch pointing at a second commit
+func createTestRepo(t *testing.T) (string, string, string) {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(content string) string {
+		err := os.WriteFile(path.Join(dir, "index.md"), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wt.Add("index.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := wt.Commit(content, &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash.String()
+	}
+	master := commit("master")
+	err = wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("feature"), Create: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	feature := commit("feature")
+	err = wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("master")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, master, feature
+}
+
+func TestLsRemote(t *testing.T) {
+	dir, master, feature := createTestRepo(t)
+	branch, commit, err := lsRemote(dir, "", nil)
+	if err != nil || branch != "master" || commit != master {
+		t.Fatalf("default branch resolved to %v %v %v", branch, commit, err)
+	}
+	branch, commit, err = lsRemote(dir, "feature", nil)
+	if err != nil || branch != "feature" || commit != feature {
+		t.Fatalf("feature resolved to %v %v %v", branch, commit, err)
+	}
+	if _, _, err = lsRemote(dir, "missing", nil); err == nil {
+		t.Fatalf("expected error for missing branch")
+	}
+}
+
+// addCommit commits content to branch of the test repo in dir and returns the commit
+func addCommit(t *testing.T, dir string, branch string, content string) string {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dir, "index.md"), []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wt.Add("index.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := wt.Commit(content, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("master")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash.String()
+}
+
+// createBranch creates branch in the repo in dir at the head of master
+func createBranch(t *testing.T, dir string, branch string) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	master, err := repo.Reference(plumbing.NewBranchReferenceName("master"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Storer.SetReference(plumbing.NewHashReference(plumbing.NewBranchReferenceName(branch), master.Hash()))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShallowSingleBranchClone(t *testing.T) {
+	dir, _, feature := createTestRepo(t)
+	addCommit(t, dir, "master", "second")
+	master := addCommit(t, dir, "master", "third")
+	source, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = source.CreateTag("v1", plumbing.NewHash(master), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := clone("file://"+dir, t.TempDir(), nil, cloneOptions{depth: 1, singleBranch: true, noTags: true})
+	if err != nil {
+		t.Fatalf("clone failed %v", err)
+	}
+	shallow, err := repo.repo.Storer.Shallow()
+	if err != nil || len(shallow) != 1 || shallow[0].String() != master {
+		t.Fatalf("clone should be shallow at %v, got %v %v", master, shallow, err)
+	}
+	if _, err = repo.repo.Reference(plumbing.NewRemoteReferenceName("origin", "feature"), false); err == nil {
+		t.Fatalf("feature should not be cloned")
+	}
+	if _, err = repo.repo.Tag("v1"); err == nil {
+		t.Fatalf("tags should not be cloned")
+	}
+
+	err = repo.checkout("feature")
+	if err != nil {
+		t.Fatalf("checkout of a branch that was not cloned failed %v", err)
+	}
+	err = repo.pull("feature")
+	if err != nil {
+		t.Fatalf("pull failed %v", err)
+	}
+	if head, _ := repo.headCommit(); head != feature {
+		t.Fatalf("feature not checked out, head %v", head)
+	}
+
+	feature = addCommit(t, dir, "feature", "feature two")
+	err = repo.pull("feature")
+	if err != nil {
+		t.Fatalf("pull of new commit failed %v", err)
+	}
+	if head, _ := repo.headCommit(); head != feature {
+		t.Fatalf("new commit not pulled, head %v", head)
+	}
+	content, err := os.ReadFile(path.Join(repo.wt.Filesystem.Root(), "index.md"))
+	if err != nil || string(content) != "feature two" {
+		t.Fatalf("worktree not updated %q %v", content, err)
+	}
+	if _, err = repo.repo.Tag("v1"); err == nil {
+		t.Fatalf("tags should not be fetched")
+	}
+}
+
+// runGit runs git in dir, allowing local paths as submodule urls
+func runGit(t *testing.T, dir string, args ...string) {
+	args = append([]string{"-c", "protocol.file.allow=always", "-c", "user.name=test",
+		"-c", "user.email=test@example.com"}, args...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v failed %v: %s", args, err, output)
+	}
+}
+
+func TestSubmodules(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	theme, themeMaster, _ := createTestRepo(t)
+	dir, _, _ := createTestRepo(t)
+	runGit(t, dir, "submodule", "-q", "add", theme, "theme")
+	runGit(t, dir, "commit", "-q", "-m", "add theme")
+
+	repo, err := clone(dir, t.TempDir(), nil, cloneOptions{submodules: true})
+	if err != nil {
+		t.Fatalf("clone failed %v", err)
+	}
+	root := repo.wt.Filesystem.Root()
+	if content, _ := os.ReadFile(path.Join(root, "theme", "index.md")); string(content) != "master" {
+		t.Fatalf("submodule not cloned %q", content)
+	}
+	commits, err := repo.submoduleCommits()
+	if err != nil || len(commits) != 1 || commits["theme"] != themeMaster {
+		t.Fatalf("unexpected submodule commits %v %v", commits, err)
+	}
+
+	updated := addCommit(t, theme, "master", "theme two")
+	runGit(t, path.Join(dir, "theme"), "pull", "-q", "origin", "master")
+	runGit(t, dir, "commit", "-q", "-am", "update theme")
+	err = repo.pull("master")
+	if err != nil {
+		t.Fatalf("pull failed %v", err)
+	}
+	if content, _ := os.ReadFile(path.Join(root, "theme", "index.md")); string(content) != "theme two" {
+		t.Fatalf("submodule not updated %q", content)
+	}
+	commits, err = repo.submoduleCommits()
+	if err != nil || commits["theme"] != updated {
+		t.Fatalf("submodule commit not updated %v %v", commits, err)
+	}
+
+	repo, err = clone(dir, t.TempDir(), nil, cloneOptions{})
+	if err != nil {
+		t.Fatalf("clone failed %v", err)
+	}
+	if _, err = os.Stat(path.Join(repo.wt.Filesystem.Root(), "theme", "index.md")); !os.IsNotExist(err) {
+		t.Fatalf("submodules should only be cloned when enabled")
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	if tokenAuth("", "") != nil {
+		t.Fatalf("no token should use anonymous access")
+	}
+	auth, ok := tokenAuth("", "secrettoken").(*http.BasicAuth)
+	if !ok || auth.Username != defaultTokenUsername || auth.Password != "secrettoken" {
+		t.Fatalf("token should be sent with the default username %v", auth)
+	}
+	auth, ok = tokenAuth("gitea-user", "secrettoken").(*http.BasicAuth)
+	if !ok || auth.Username != "gitea-user" {
+		t.Fatalf("token should be sent with the configured username %v", auth)
+	}
+	if strings.Contains(auth.String(), "secrettoken") {
+		t.Fatalf("token should not be printed %v", auth)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	redacted := RedactURL("https://secrettoken@github.com/clarkezone/blog.git")
+	if strings.Contains(redacted, "secrettoken") || !strings.Contains(redacted, "github.com/clarkezone/blog.git") {
+		t.Fatalf("credentials not redacted %v", redacted)
+	}
+	if RedactURL("https://github.com/clarkezone/blog.git") != "https://github.com/clarkezone/blog.git" {
+		t.Fatalf("url without credentials should be unchanged")
+	}
+}
+
+func TestWorktreeReadsObjectsWhereverMounted(t *testing.T) {
+	repo, _, feature := createTestRepo(t)
+	root := path.Join(t.TempDir(), "claim")
+	lrm, err := CreateLocalRepoManager(root, nil, true, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	err = lrm.InitialClone(repo, "")
+	if err != nil {
+		t.Fatalf("initial clone failed %v", err)
+	}
+	err = lrm.SwitchBranch("feature")
+	if err != nil {
+		t.Fatalf("switch branch failed %v", err)
+	}
+	// the claim is mounted at a different path by another pod
+	mounted := path.Join(t.TempDir(), "mounted")
+	err = os.Rename(root, mounted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := git.PlainOpen(path.Join(mounted, "worktrees", lrm.BranchDir("feature"), "source"))
+	if err != nil {
+		t.Fatalf("unable to open moved worktree %v", err)
+	}
+	commit, err := worktree.CommitObject(plumbing.NewHash(feature))
+	if err != nil || commit.Message != "feature" {
+		t.Fatalf("moved worktree cannot read the objects it shares %v", err)
+	}
+}
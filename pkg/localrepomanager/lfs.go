@@ -0,0 +1,360 @@
+package localrepomanager
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+const (
+	lfsMediaType      = "application/vnd.git-lfs+json"
+	lfsPointerVersion = "version https://git-lfs.github.com/spec/v1"
+	// lfsMaxPointerSize is the largest blob parsed as a pointer, pointers are around 130 bytes
+	lfsMaxPointerSize = 1024
+	// lfsBatchSize is the number of objects requested per batch, as recommended by the batch API spec
+	lfsBatchSize  = 100
+	lfsTimeout    = 10 * time.Minute
+	lfsConfigFile = ".lfsconfig"
+)
+
+// lfsPointer identifies an object stored in LFS, see
+// https://github.com/git-lfs/git-lfs/blob/main/docs/spec.md
+type lfsPointer struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// parseLFSPointer returns the object a pointer file refers to, or false if content is not a pointer
+func parseLFSPointer(content []byte) (lfsPointer, bool) {
+	var pointer lfsPointer
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	if !scanner.Scan() || scanner.Text() != lfsPointerVersion {
+		return pointer, false
+	}
+	for scanner.Scan() {
+		key, value, found := cut(scanner.Text(), " ")
+		if !found {
+			return pointer, false
+		}
+		switch key {
+		case "oid":
+			pointer.OID = strings.TrimPrefix(value, "sha256:")
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return pointer, false
+			}
+			pointer.Size = size
+		}
+	}
+	_, err := hex.DecodeString(pointer.OID)
+	return pointer, err == nil && len(pointer.OID) == sha256.Size*2
+}
+
+// cut is strings.Cut, which needs go 1.18
+func cut(s string, sep string) (string, string, bool) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
+
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers"`
+	Objects   []lfsPointer `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Objects []lfsBatchObject `json:"objects"`
+	Message string           `json:"message"`
+}
+
+type lfsBatchObject struct {
+	lfsPointer
+	Actions struct {
+		Download *lfsAction `json:"download"`
+	} `json:"actions"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+// lfsEndpoint returns the LFS server of a repo, lfs.url in the repo's .lfsconfig if set and otherwise
+// <repo>.git/info/lfs.  The server of ssh remotes is assumed to be served over https from the same host.
+func lfsEndpoint(repo string, lfsConfig []byte) (string, error) {
+	if len(lfsConfig) > 0 {
+		cfg := config.New()
+		err := config.NewDecoder(bytes.NewReader(lfsConfig)).Decode(cfg)
+		if err != nil {
+			return "", fmt.Errorf("unable to parse %v: %w", lfsConfigFile, err)
+		}
+		if url := cfg.Section("lfs").Option("url"); url != "" {
+			return strings.TrimSuffix(url, "/"), nil
+		}
+	}
+	endpoint, err := transport.NewEndpoint(repo)
+	if err != nil {
+		return "", err
+	}
+	host := endpoint.Host
+	scheme := endpoint.Protocol
+	switch scheme {
+	case "http", "https":
+		if endpoint.Port != 0 {
+			host = fmt.Sprintf("%v:%v", endpoint.Host, endpoint.Port)
+		}
+	case "ssh":
+		scheme = "https"
+	default:
+		return "", fmt.Errorf("no LFS server known for %v, set lfs.url in %v", RedactURL(repo), lfsConfigFile)
+	}
+	repoPath := strings.TrimSuffix(endpoint.Path, "/")
+	if !strings.HasSuffix(repoPath, ".git") {
+		repoPath += ".git"
+	}
+	if !strings.HasPrefix(repoPath, "/") {
+		repoPath = "/" + repoPath
+	}
+	return fmt.Sprintf("%v://%v%v/info/lfs", scheme, host, repoPath), nil
+}
+
+// lfsClient downloads objects from an LFS server using the basic transfer adapter
+type lfsClient struct {
+	endpoint string
+	auth     transport.AuthMethod
+	client   *http.Client
+	// cacheDir stores downloaded objects so that switching branches does not download them again
+	cacheDir string
+}
+
+// setAuth sends the repo's token to the LFS server, ssh keys cannot be used so other auth is anonymous
+func (c *lfsClient) setAuth(req *http.Request) {
+	if basic, ok := c.auth.(*githttp.BasicAuth); ok {
+		req.SetBasicAuth(basic.Username, basic.Password)
+	}
+}
+
+// batch requests download actions for objects
+func (c *lfsClient) batch(ctx context.Context, objects []lfsPointer) ([]lfsBatchObject, error) {
+	body, err := json.Marshal(lfsBatchRequest{Operation: "download", Transfers: []string{"basic"}, Objects: objects})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	c.setAuth(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var result lfsBatchResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("LFS batch request to %v failed with %v %v", c.endpoint, resp.Status, result.Message)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode LFS batch response: %w", err)
+	}
+	return result.Objects, nil
+}
+
+// download fetches an object into the cache, verifying its size and hash
+func (c *lfsClient) download(ctx context.Context, object lfsBatchObject) error {
+	if object.Error != nil {
+		return fmt.Errorf("LFS object %v: %v %v", object.OID, object.Error.Code, object.Error.Message)
+	}
+	if object.Actions.Download == nil {
+		return fmt.Errorf("LFS object %v has no download action", object.OID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, object.Actions.Download.Href, nil)
+	if err != nil {
+		return err
+	}
+	if len(object.Actions.Download.Header) == 0 {
+		c.setAuth(req)
+	}
+	for key, value := range object.Actions.Download.Header {
+		req.Header.Set(key, value)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download of LFS object %v failed with %v", object.OID, resp.Status)
+	}
+
+	err = os.MkdirAll(c.cacheDir, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(c.cacheDir, "download")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(temp, hash), resp.Body)
+	closeErr := temp.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if size != object.Size || hex.EncodeToString(hash.Sum(nil)) != object.OID {
+		return fmt.Errorf("LFS object %v does not match its pointer, downloaded %v bytes with hash %x", object.OID,
+			size, hash.Sum(nil))
+	}
+	return os.Rename(temp.Name(), c.cachePath(object.OID))
+}
+
+func (c *lfsClient) cachePath(oid string) string {
+	return path.Join(c.cacheDir, oid)
+}
+
+// fetchLFS replaces the LFS pointer files of the checked out commit, those matching a filter=lfs
+// attribute, with their objects, downloading objects that are not already cached
+func (gl *gitlayer) fetchLFS() error {
+	pointers, err := gl.lfsPointers()
+	if err != nil || len(pointers) == 0 {
+		return err
+	}
+	origin, err := gl.repo.Remote("origin")
+	if err != nil {
+		return err
+	}
+	lfsConfig, err := os.ReadFile(path.Join(gl.wt.Filesystem.Root(), lfsConfigFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	endpoint, err := lfsEndpoint(origin.Config().URLs[0], lfsConfig)
+	if err != nil {
+		return err
+	}
+	client := &lfsClient{endpoint: endpoint, auth: gl.auth, client: &http.Client{Timeout: lfsTimeout},
+		cacheDir: path.Join(gl.wt.Filesystem.Root(), ".git", "lfs", "objects")}
+
+	var missing []lfsPointer
+	seen := make(map[string]bool)
+	for _, pointer := range pointers {
+		if seen[pointer.OID] {
+			continue
+		}
+		seen[pointer.OID] = true
+		if _, err := os.Stat(client.cachePath(pointer.OID)); err != nil {
+			missing = append(missing, pointer)
+		}
+	}
+	clarkezoneLog.Infof("gitlayer::fetchLFS %v LFS files, downloading %v objects from %v", len(pointers),
+		len(missing), RedactURL(endpoint))
+	ctx := context.TODO()
+	for start := 0; start < len(missing); start += lfsBatchSize {
+		end := start + lfsBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		objects, err := client.batch(ctx, missing[start:end])
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			err = client.download(ctx, object)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for file, pointer := range pointers {
+		content, err := os.ReadFile(client.cachePath(pointer.OID))
+		if err != nil {
+			return fmt.Errorf("LFS object %v of %v was not downloaded: %w", pointer.OID, file, err)
+		}
+		target := path.Join(gl.wt.Filesystem.Root(), file)
+		info, err := os.Stat(target)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(target, content, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lfsPointers returns the pointer files of the checked out commit keyed by path
+func (gl *gitlayer) lfsPointers() (map[string]lfsPointer, error) {
+	attributes, err := gitattributes.ReadPatterns(gl.wt.Filesystem, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(attributes) == 0 {
+		return nil, nil
+	}
+	matcher := gitattributes.NewMatcher(attributes)
+	head, err := gl.repo.Head()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := gl.repo.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	pointers := make(map[string]lfsPointer)
+	err = tree.Files().ForEach(func(file *object.File) error {
+		if file.Size > lfsMaxPointerSize {
+			return nil
+		}
+		results, _ := matcher.Match(strings.Split(file.Name, "/"), []string{"filter"})
+		if filter, ok := results["filter"]; !ok || filter.Value() != "lfs" {
+			return nil
+		}
+		content, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		if pointer, ok := parseLFSPointer([]byte(content)); ok {
+			pointers[file.Name] = pointer
+		}
+		return nil
+	})
+	return pointers, err
+}
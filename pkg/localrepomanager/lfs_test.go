@@ -0,0 +1,188 @@
+package localrepomanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func lfsPointerFile(content []byte) (string, string) {
+	sum := sha256.Sum256(content)
+	oid := hex.EncodeToString(sum[:])
+	return oid, fmt.Sprintf("%v\noid sha256:%v\nsize %v\n", lfsPointerVersion, oid, len(content))
+}
+
+// startLFSServer serves objects through the batch API, requiring basic auth with token as the password
+func startLFSServer(t *testing.T, token string, objects map[string][]byte, downloads *int32) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, password, _ := r.BasicAuth(); password != token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodPost && r.URL.Path == "/site.git/info/lfs/objects/batch" {
+			if r.Header.Get("Accept") != lfsMediaType {
+				w.WriteHeader(http.StatusNotAcceptable)
+				return
+			}
+			var request lfsBatchRequest
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil || request.Operation != "download" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var response lfsBatchResponse
+			for _, pointer := range request.Objects {
+				object := lfsBatchObject{lfsPointer: pointer}
+				object.Actions.Download = &lfsAction{Href: server.URL + "/objects/" + pointer.OID}
+				response.Objects = append(response.Objects, object)
+			}
+			w.Header().Set("Content-Type", lfsMediaType)
+			_ = json.NewEncoder(w).Encode(response)
+			return
+		}
+		if content, ok := objects[strings.TrimPrefix(r.URL.Path, "/objects/")]; ok && r.Method == http.MethodGet {
+			atomic.AddInt32(downloads, 1)
+			_, _ = w.Write(content)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// commitFiles commits files to the checked out branch of the test repo in dir
+func commitFiles(t *testing.T, dir string, files map[string]string) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		err = os.WriteFile(path.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wt.Add(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = wt.Commit("add files", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchLFS(t *testing.T) {
+	photo := []byte("not really a jpeg")
+	oid, pointer := lfsPointerFile(photo)
+	badOID, badPointer := lfsPointerFile([]byte("expected content"))
+	var downloads int32
+	server := startLFSServer(t, "secrettoken", map[string][]byte{oid: photo, badOID: []byte("other content")},
+		&downloads)
+
+	dir, _, _ := createTestRepo(t)
+	commitFiles(t, dir, map[string]string{
+		".gitattributes": "*.jpg filter=lfs diff=lfs merge=lfs -text\n",
+		".lfsconfig":     fmt.Sprintf("[lfs]\n\turl = %v/site.git/info/lfs\n", server.URL),
+		"photo.jpg":      pointer,
+		"copy.jpg":       pointer,
+		"pointer.txt":    pointer,
+	})
+
+	repo, err := clone(dir, t.TempDir(), tokenAuth("", "secrettoken"), cloneOptions{})
+	if err != nil {
+		t.Fatalf("clone failed %v", err)
+	}
+	root := repo.wt.Filesystem.Root()
+	for _, file := range []string{"photo.jpg", "copy.jpg"} {
+		if content, _ := os.ReadFile(path.Join(root, file)); string(content) != string(photo) {
+			t.Fatalf("LFS object not checked out in %v, found %q", file, content)
+		}
+	}
+	if content, _ := os.ReadFile(path.Join(root, "pointer.txt")); string(content) != pointer {
+		t.Fatalf("files without the lfs filter should not be replaced")
+	}
+	if atomic.LoadInt32(&downloads) != 1 {
+		t.Fatalf("object should be downloaded once, downloaded %v times", downloads)
+	}
+
+	err = repo.checkout("feature")
+	if err != nil {
+		t.Fatalf("checkout failed %v", err)
+	}
+	err = repo.checkout("master")
+	if err != nil {
+		t.Fatalf("checkout failed %v", err)
+	}
+	if content, _ := os.ReadFile(path.Join(root, "photo.jpg")); string(content) != string(photo) {
+		t.Fatalf("LFS object not restored from the cache, found %q", content)
+	}
+	if atomic.LoadInt32(&downloads) != 1 {
+		t.Fatalf("cached object should not be downloaded again, downloaded %v times", downloads)
+	}
+
+	_, err = clone(dir, t.TempDir(), tokenAuth("", "wrongtoken"), cloneOptions{})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("credentials not sent to the LFS server %v", err)
+	}
+
+	commitFiles(t, dir, map[string]string{"bad.jpg": badPointer})
+	_, err = clone(dir, t.TempDir(), tokenAuth("", "secrettoken"), cloneOptions{})
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("object not verified against its pointer %v", err)
+	}
+}
+
+func TestLFSEndpoint(t *testing.T) {
+	for repo, expected := range map[string]string{
+		"https://github.com/clarkezone/blog.git":          "https://github.com/clarkezone/blog.git/info/lfs",
+		"https://github.com/clarkezone/blog":              "https://github.com/clarkezone/blog.git/info/lfs",
+		"http://user:pw@gitea.local:3000/clarkezone/blog": "http://gitea.local:3000/clarkezone/blog.git/info/lfs",
+		"git@github.com:clarkezone/blog.git":              "https://github.com/clarkezone/blog.git/info/lfs",
+	} {
+		endpoint, err := lfsEndpoint(repo, nil)
+		if err != nil || endpoint != expected {
+			t.Fatalf("endpoint of %v is %v %v, expected %v", repo, endpoint, err, expected)
+		}
+	}
+	endpoint, err := lfsEndpoint("/tmp/repo", []byte("[lfs]\n\turl = https://lfs.test/blog/\n"))
+	if err != nil || endpoint != "https://lfs.test/blog" {
+		t.Fatalf("lfs.url not used %v %v", endpoint, err)
+	}
+	if _, err = lfsEndpoint("/tmp/repo", nil); err == nil {
+		t.Fatalf("local repos have no LFS server")
+	}
+}
+
+func TestParseLFSPointer(t *testing.T) {
+	oid, pointer := lfsPointerFile([]byte("content"))
+	parsed, ok := parseLFSPointer([]byte(pointer))
+	if !ok || parsed.OID != oid || parsed.Size != int64(len("content")) {
+		t.Fatalf("pointer not parsed %v %v", parsed, ok)
+	}
+	for _, content := range []string{"content", lfsPointerVersion + "\noid sha256:abc\nsize 7\n",
+		lfsPointerVersion + "\noid sha256:" + oid + "\nsize seven\n"} {
+		if _, ok = parseLFSPointer([]byte(content)); ok {
+			t.Fatalf("%q is not a pointer", content)
+		}
+	}
+}
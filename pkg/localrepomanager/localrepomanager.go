@@ -2,17 +2,33 @@
 package localrepomanager
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"os"
 	"path"
 	"regexp"
+	"sync"
 
 	"github.com/clarkezone/previewd/pkg/jobmanager"
 	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
-	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+const (
+	sourceDir = "source"
+	outputDir = "output"
+	// worktreesDir holds a directory for each branch checked out in a worktree, named by BranchDir
+	worktreesDir = "worktrees"
+	// branchHashLength is the number of hex digits of a branch's hash in its BranchDir
+	branchHashLength = 8
 )
 
 type newBranchHandler interface {
 	NewBranch(branch string, dir string)
+	// DeletedBranch is called once the output of a deleted branch is removed so that it is no longer served
+	DeletedBranch(branch string, dir string)
 }
 
 // LocalRepoManager is a type for managing local git repos
@@ -25,6 +41,29 @@ type LocalRepoManager struct {
 	enableBranchMode bool
 	jm               *jobmanager.Jobmanager
 	kubenamespace    string
+	renderSpec       jobmanager.RenderSpec
+	primaryBranch    string
+	previewURL       func(branch string) string
+	branchSpec       func(branch string, spec jobmanager.RenderSpec) jobmanager.RenderSpec
+	// in clone in job mode the repo is not cloned locally, branches are resolved to commits that
+	// render jobs fetch themselves
+	cloneInJob bool
+	repoURL    string
+	commit     string
+	// auth authenticates clone, fetch, pull and ls-remote, nil for anonymous access
+	auth        transport.AuthMethod
+	gitUsername string
+	sshKey      *sshKey
+	cloneOpts   cloneOptions
+	// repo is the checkout of currentBranch.  source is the clone in repoSourceDir, which stays on
+	// sourceBranch, the remote's default branch, and every other branch is checked out into one of
+	// worktrees so that renders of different branches read isolated source trees.
+	source       *gitlayer
+	sourceBranch string
+	worktrees    map[string]*gitlayer
+	// built holds the commit of each branch last queued for rendering, guarded by builtMu as pollers read it
+	builtMu sync.Mutex
+	built   map[string]string
 }
 
 // CreateLocalRepoManager is a factory method for creating a new LRM instance
@@ -34,15 +73,15 @@ func CreateLocalRepoManager(rootDir string,
 	clarkezoneLog.Debugf("CreateLocalRepoManager rootDir:%v, newBarnch:%v, enableBranchMode:%v,"+
 		" currentBranch:Master, namespace:%v",
 		rootDir, newBranch, enableBranchMode, namespace)
-	var lrm = &LocalRepoManager{currentBranch: "master", localRootDir: rootDir}
+	var lrm = &LocalRepoManager{currentBranch: "master", localRootDir: rootDir,
+		worktrees: make(map[string]*gitlayer), built: make(map[string]string)}
 	lrm.newBranchObs = newBranch
 	lrm.enableBranchMode = enableBranchMode
 	lrm.jm = jm
 	lrm.kubenamespace = namespace
-	// TODO: replace with an error check for missing dir
-	//nolint
-	os.RemoveAll(rootDir) // ignore error since it may not exist
-	dir, err := lrm.ensureDir("source")
+	lrm.renderSpec = jobmanager.GetJekyllRenderSpec()
+	// an existing clone in rootDir is reused by InitialClone
+	dir, err := lrm.ensureDir(sourceDir)
 	if err != nil {
 		return nil, err
 	}
@@ -70,10 +109,68 @@ func (lrm *LocalRepoManager) getSourceDir() string {
 
 func (lrm *LocalRepoManager) getRenderDir() (string, error) {
 	if lrm.enableBranchMode {
-		branchName := lrm.legalizeBranchName(lrm.currentBranch)
-		return lrm.ensureDir(branchName)
+		return lrm.ensureDir(lrm.BranchDir(lrm.currentBranch))
+	}
+	return lrm.ensureDir(outputDir)
+}
+
+// SetRenderSpec replaces the default Jekyll spec used for render jobs
+func (lrm *LocalRepoManager) SetRenderSpec(spec jobmanager.RenderSpec) {
+	lrm.renderSpec = spec
+}
+
+// RenderSpec returns the spec used to render the current branch.  In branch mode the render claim
+// is mounted at the branch's directory so that each branch's output is kept separately, matching getRenderDir.
+// The source claim is mounted at the branch's worktree if it has one.
+func (lrm *LocalRepoManager) RenderSpec() jobmanager.RenderSpec {
+	return lrm.branchRenderSpec(lrm.currentBranch)
+}
+
+func (lrm *LocalRepoManager) branchRenderSpec(branch string) jobmanager.RenderSpec {
+	spec := lrm.renderSpec
+	if lrm.enableBranchMode && spec.RenderSubPath == "" && branch != lrm.primaryBranch {
+		spec.RenderSubPath = lrm.BranchDir(branch)
+	}
+	if lrm.cloneInJob {
+		spec.CloneRepo = lrm.repoURL
+		spec.CloneSubmodules = lrm.cloneOpts.submodules
+	} else if _, ok := lrm.worktrees[branch]; ok {
+		// mounting the worktree's directory, below the directory of the claim holding rootDir if any,
+		// keeps the clone at /src/source
+		spec.SourceSubPath = path.Join(spec.SourceSubPath, worktreesDir, lrm.BranchDir(branch))
 	}
-	return lrm.ensureDir("output")
+	if lrm.branchSpec != nil {
+		spec = lrm.branchSpec(branch, spec)
+	}
+	return spec
+}
+
+// SetBranchRenderSpec sets a function that adjusts the render spec of each branch, eg to render it
+// in a namespace of its own
+func (lrm *LocalRepoManager) SetBranchRenderSpec(branchSpec func(branch string,
+	spec jobmanager.RenderSpec) jobmanager.RenderSpec) {
+	lrm.branchSpec = branchSpec
+}
+
+// SetCloneInJob selects cloning repo inside render jobs rather than into the local source dir, so that
+// no source claim is shared with render jobs.  Must be called before InitialClone or HandleWebhook.
+func (lrm *LocalRepoManager) SetCloneInJob(repo string) {
+	lrm.cloneInJob = repo != ""
+	lrm.repoURL = repo
+}
+
+// SetPrimaryBranch sets the branch rendered into the root of the render claim in branch mode,
+// every other branch is rendered into its BranchDir
+func (lrm *LocalRepoManager) SetPrimaryBranch(branch string) {
+	lrm.primaryBranch = branch
+}
+
+// BranchDir returns the name of the directory used for a branch's output in branch mode and for its
+// worktree, the branch with non-alphanumeric characters removed suffixed with a hash of the branch so
+// that branches such as feature/a-b and feature/ab never share, or delete, each other's directories
+func (lrm *LocalRepoManager) BranchDir(branch string) string {
+	sum := sha256.Sum256([]byte(branch))
+	return lrm.legalizeBranchName(branch) + "-" + hex.EncodeToString(sum[:])[:branchHashLength]
 }
 
 func (lrm *LocalRepoManager) legalizeBranchName(name string) string {
@@ -81,75 +178,333 @@ func (lrm *LocalRepoManager) legalizeBranchName(name string) string {
 	return reg.ReplaceAllString(name, "")
 }
 
-// InitialClone performs clone on given repo
+// SetGitUsername sets the username sent with a personal access token, which Gitea and GitLab require
+// to be the token's owner.  Must be called before InitialClone.
+func (lrm *LocalRepoManager) SetGitUsername(username string) {
+	lrm.gitUsername = username
+}
+
+// SetCloneOptions limits the history cloned to depth commits, or all history if depth is 0, clones
+// only the default branch if singleBranch is set and skips tags if noTags is set.  Branches switched
+// to are fetched to the same depth.  Must be called before InitialClone.
+func (lrm *LocalRepoManager) SetCloneOptions(depth int, singleBranch bool, noTags bool) {
+	lrm.cloneOpts.depth = depth
+	lrm.cloneOpts.singleBranch = singleBranch
+	lrm.cloneOpts.noTags = noTags
+}
+
+// SetSubmodules selects initializing and updating submodules recursively on clone and every branch
+// switch, using the same authentication as the repo.  The commit of each submodule is recorded in
+// CurrentBuild.  Must be called before InitialClone.
+func (lrm *LocalRepoManager) SetSubmodules(enabled bool) {
+	lrm.cloneOpts.submodules = enabled
+}
+
+// SetSSHKey authenticates with ssh remotes using the private key at keyPath, decrypted with passphrase
+// if it is encrypted.  Servers must present a host key listed in knownHostsPath.  Must be called before
+// InitialClone.
+func (lrm *LocalRepoManager) SetSSHKey(keyPath string, passphrase string, knownHostsPath string) {
+	lrm.sshKey = &sshKey{keyPath: keyPath, passphrase: passphrase, knownHostsPath: knownHostsPath}
+}
+
+// authFor returns the auth used for repo, an ssh key for ssh remotes if one is set and otherwise the
+// personal access token pat
+func (lrm *LocalRepoManager) authFor(repo string, pat string) (transport.AuthMethod, error) {
+	if lrm.sshKey != nil && isSSHRemote(repo) {
+		return sshKeyAuth(repo, *lrm.sshKey)
+	}
+	return tokenAuth(lrm.gitUsername, pat), nil
+}
+
+// InitialClone performs clone on given repo, authenticating with repopat if it is not empty or the
+// ssh key if repo is an ssh remote.  An existing clone of repo is reused, reset to the remote's default
+// branch, and is only wiped and cloned again if it is of another remote or corrupt.  Worktrees of other
+// branches are reused when those branches are switched to.
 func (lrm *LocalRepoManager) InitialClone(repo string, repopat string) error {
 	//TODO: this function should ensure branch name is correct
-	clarkezoneLog.Debugf("Initial clone for\n repo: %v\n local dir:%v", repo, lrm.repoSourceDir)
-	if repopat != "" {
+	clarkezoneLog.Debugf("Initial clone for\n repo: %v\n local dir:%v", RedactURL(repo), lrm.repoSourceDir)
+	if lrm.sshKey != nil && isSSHRemote(repo) {
+		clarkezoneLog.Debugf(" with ssh key %v.\n", lrm.sshKey.keyPath)
+	} else if repopat != "" {
 		clarkezoneLog.Debugf(" with Personal Access Token.\n")
 	} else {
 		clarkezoneLog.Debugf(" with no authentication.\n")
 	}
+	auth, err := lrm.authFor(repo, repopat)
+	if err != nil {
+		clarkezoneLog.Errorf("LocalRepoManager::InitialClone %v", err)
+		return err
+	}
+	lrm.auth = auth
+	lrm.worktrees = make(map[string]*gitlayer)
+	lrm.repoURL = repo
 
-	re, err := clone(repo, lrm.repoSourceDir)
+	if lrm.cloneInJob {
+		err = lrm.resolveBranch(repo, "")
+		lrm.sourceBranch = lrm.currentBranch
+		return err
+	}
+
+	re, branch, err := reuseClone(repo, lrm.repoSourceDir, lrm.auth, lrm.cloneOpts)
 	if err != nil {
-		clarkezoneLog.Errorf("EXITING: Fatal Error in initial clone: %v\n", err.Error())
-		os.Exit(1)
+		clarkezoneLog.Errorf("Fatal Error refreshing existing clone: %v\n", err.Error())
+		return err
 	}
-	lrm.repo = re
+	if re != nil {
+		lrm.setSource(re, branch)
+		clarkezoneLog.Infof("Reused existing clone.")
+		return nil
+	}
+	err = os.RemoveAll(lrm.repoSourceDir)
+	if err != nil {
+		clarkezoneLog.Errorf("Unable to remove existing source dir: %v\n", err.Error())
+		return err
+	}
+	re, err = clone(repo, lrm.repoSourceDir, lrm.auth, lrm.cloneOpts)
+	if err != nil {
+		clarkezoneLog.Errorf("Fatal Error in initial clone: %v\n", err.Error())
+		return err
+	}
+	branch, err = re.headBranch()
+	if err != nil {
+		clarkezoneLog.Errorf("Fatal Error in initial clone: %v\n", err.Error())
+		return err
+	}
+	lrm.setSource(re, branch)
 	clarkezoneLog.Infof("Clone Done.")
-	return err
+	return nil
 }
 
-// SwitchBranch changes to a new branch on current repo
-func (lrm *LocalRepoManager) SwitchBranch(branch string) error {
-	clarkezoneLog.Debugf("SwitchingBranch: resetting with hard")
-	re := git.ResetOptions{Mode: git.HardReset}
-	err := lrm.repo.wt.Reset(&re)
+// setSource records the clone in repoSourceDir, which is checked out at branch
+func (lrm *LocalRepoManager) setSource(source *gitlayer, branch string) {
+	lrm.source = source
+	lrm.sourceBranch = branch
+	lrm.repo = source
+	lrm.currentBranch = branch
+}
+
+// resolveBranch records the commit that branch of repo points to, or the remote's default branch
+// if branch is empty, without cloning
+func (lrm *LocalRepoManager) resolveBranch(repo string, branch string) error {
+	resolved, commit, err := lsRemote(repo, branch, lrm.auth)
 	if err != nil {
-		clarkezoneLog.Errorf("LocalRepoManager::SwitchBranch reset failed with %v", err)
+		clarkezoneLog.Errorf("LocalRepoManager::resolveBranch unable to resolve %v in %v: %v", branch,
+			RedactURL(repo), err)
 		return err
 	}
+	if resolved != plumbing.HEAD.Short() {
+		lrm.currentBranch = resolved
+	}
+	lrm.commit = commit
+	clarkezoneLog.Infof("Resolved branch %v to commit %v", lrm.currentBranch, commit)
+	return nil
+}
 
+// SwitchBranch changes to a new branch on current repo, updating the branch's checkout to the head
+// of the remote branch.  Branches other than the default branch are checked out into worktrees of their
+// own, which are created when a branch is first switched to.
+func (lrm *LocalRepoManager) SwitchBranch(branch string) error {
+	if lrm.cloneInJob {
+		return lrm.resolveBranch(lrm.repoURL, branch)
+	}
+	checkout, err := lrm.worktree(branch)
+	if err != nil {
+		clarkezoneLog.Errorf("LocalRepoManager::SwitchBranch unable to create worktree for %v: %v", branch, err)
+		return err
+	}
 	if branch != lrm.currentBranch {
 		clarkezoneLog.Debugf("Switching branch befween current %v and %v", lrm.currentBranch, branch)
+	}
+
+	err = checkout.pull(branch)
+	if err != nil {
+		clarkezoneLog.Errorf("LocalRepoManager::SwitchBranch pull failed for %v with %v", branch, err)
+		return err
+	}
+	lrm.repo = checkout
+	lrm.currentBranch = branch
+	return nil
+}
 
-		err := lrm.repo.checkout(branch)
+// worktree returns the checkout of branch, the source clone for the default branch and otherwise the
+// branch's worktree, which is reused from a previous run if possible or created.  Worktrees share the
+// objects of the source clone, which fetches for them, so are checked out by pull.
+func (lrm *LocalRepoManager) worktree(branch string) (*gitlayer, error) {
+	if branch == lrm.sourceBranch {
+		return lrm.source, nil
+	}
+	if checkout, ok := lrm.worktrees[branch]; ok {
+		return checkout, nil
+	}
+	dir := lrm.worktreeDir(branch)
+	checkout := reuseWorktree(lrm.source, lrm.repoURL, dir)
+	if checkout == nil {
+		err := os.RemoveAll(dir)
 		if err != nil {
-			clarkezoneLog.Errorf("LocalRepoManager::Switchbranch checkout failed %v", err)
-			return err
+			return nil, err
+		}
+		clarkezoneLog.Infof("Creating worktree for branch %v in %v", branch, dir)
+		checkout, err = newWorktree(lrm.source, lrm.repoURL, dir)
+		if err != nil {
+			return nil, err
 		}
+	}
+	lrm.worktrees[branch] = checkout
+	return checkout, nil
+}
 
-		lrm.currentBranch = branch
+// worktreeDir returns the directory a branch is cloned into, <root>/worktrees/<BranchDir>/source so
+// that render jobs mounting the branch's directory find the source at /src/source as they do otherwise
+func (lrm *LocalRepoManager) worktreeDir(branch string) string {
+	return path.Join(lrm.localRootDir, worktreesDir, lrm.BranchDir(branch), sourceDir)
+}
+
+// RemoveWorktree deletes the worktree of branch, eg once the branch has been merged.  The default
+// branch has no worktree of its own and is not removed.  If branch is the current branch the current
+// branch becomes the default branch.
+func (lrm *LocalRepoManager) RemoveWorktree(branch string) error {
+	if lrm.cloneInJob || branch == lrm.sourceBranch {
+		return nil
+	}
+	delete(lrm.worktrees, branch)
+	if branch == lrm.currentBranch && lrm.source != nil {
+		lrm.repo = lrm.source
+		lrm.currentBranch = lrm.sourceBranch
 	}
+	err := os.RemoveAll(path.Join(lrm.localRootDir, worktreesDir, lrm.BranchDir(branch)))
+	if err != nil {
+		clarkezoneLog.Errorf("LocalRepoManager::RemoveWorktree unable to remove worktree of %v: %v", branch, err)
+		return err
+	}
+	clarkezoneLog.Infof("Removed worktree of branch %v", branch)
+	return nil
+}
 
-	err = lrm.repo.pull(branch)
+// PruneWorktrees deletes the worktrees of every branch other than those in branches, including worktrees
+// left by previous runs, eg when branches are removed from a SitePreview
+func (lrm *LocalRepoManager) PruneWorktrees(branches []string) error {
+	keep := make(map[string]bool, len(branches))
+	for _, branch := range branches {
+		keep[lrm.BranchDir(branch)] = true
+	}
+	for branch := range lrm.worktrees {
+		if !keep[lrm.BranchDir(branch)] {
+			err := lrm.RemoveWorktree(branch)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	entries, err := os.ReadDir(path.Join(lrm.localRootDir, worktreesDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		clarkezoneLog.Errorf("LocalRepoManager::SwitchBranch pull failed for %v with %v", branch, err)
 		return err
 	}
+	for _, entry := range entries {
+		if keep[entry.Name()] {
+			continue
+		}
+		err = os.RemoveAll(path.Join(lrm.localRootDir, worktreesDir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		clarkezoneLog.Infof("Removed stale worktree %v", entry.Name())
+	}
 	return nil
 }
 
-// HandleWebhook called by webhook machinery to trigger new job
-func (lrm *LocalRepoManager) HandleWebhook(branch string, sendNotify bool) error {
-	clarkezoneLog.Debugf("LocalRepoManager::HandleWebhook branch: %v", branch)
+// SetPreviewURL sets the function returning the url a branch is served from, which is passed to
+// render jobs in branch mode
+func (lrm *LocalRepoManager) SetPreviewURL(previewURL func(branch string) string) {
+	lrm.previewURL = previewURL
+}
+
+// CurrentBuild returns the branch and commit currently checked out
+func (lrm *LocalRepoManager) CurrentBuild() jobmanager.BuildInfo {
+	build := jobmanager.BuildInfo{Site: lrm.renderSpec.Site, Branch: lrm.currentBranch}
+	if lrm.enableBranchMode && lrm.previewURL != nil {
+		build.PreviewURL = lrm.previewURL(lrm.currentBranch)
+	}
+	if lrm.repo == nil {
+		build.Commit = lrm.commit
+		return build
+	}
+	commit, err := lrm.repo.headCommit()
+	if err != nil {
+		clarkezoneLog.Errorf("LocalRepoManager::CurrentBuild unable to read head commit %v", err)
+		return build
+	}
+	build.Commit = commit
+	build.Submodules, err = lrm.repo.submoduleCommits()
+	if err != nil {
+		clarkezoneLog.Errorf("LocalRepoManager::CurrentBuild unable to read submodule commits %v", err)
+	}
+	return build
+}
+
+// pinCommit checks out commit, which must have been fetched with the current branch, so that a build
+// corresponds to the pushed commit even if the branch has moved on since
+func (lrm *LocalRepoManager) pinCommit(commit string) error {
+	if !plumbing.IsHash(commit) {
+		return fmt.Errorf("%v is not a commit hash", commit)
+	}
+	if lrm.cloneInJob {
+		// render jobs fetch the commit themselves and fail if it does not exist
+		if commit != lrm.commit {
+			clarkezoneLog.Infof("Building commit %v of branch %v, whose head is now %v", commit, lrm.currentBranch,
+				lrm.commit)
+		}
+		lrm.commit = commit
+		return nil
+	}
+	head, err := lrm.repo.headCommit()
+	if err != nil {
+		return err
+	}
+	if head == commit {
+		return nil
+	}
+	clarkezoneLog.Infof("Building commit %v of branch %v, whose head is now %v", commit, lrm.currentBranch, head)
+	return lrm.repo.checkoutCommit(commit)
+}
+
+// HandleWebhook called by webhook machinery to trigger new job.  The pushed commit is built, or the
+// head of branch if commit is empty.
+func (lrm *LocalRepoManager) HandleWebhook(branch string, commit string, sendNotify bool) error {
+	clarkezoneLog.Debugf("LocalRepoManager::HandleWebhook branch: %v commit: %v", branch, commit)
 	err := lrm.SwitchBranch(branch)
 	if err != nil {
 		clarkezoneLog.Errorf("LocalRepoManager::HandleWebhook %v", err)
 		return err
 	}
 
+	if commit != "" {
+		err = lrm.pinCommit(commit)
+		if err != nil {
+			clarkezoneLog.Errorf("LocalRepoManager::HandleWebhook unable to check out commit %v of %v: %v", commit,
+				branch, err)
+			return err
+		}
+	}
+
 	renderDir, err := lrm.getRenderDir()
 	if err != nil {
 		clarkezoneLog.Errorf("LocalRepoManager::HandleWebhook %v", err)
 		return err
 	}
 
+	build := lrm.CurrentBuild()
 	if lrm.jm == nil {
 		clarkezoneLog.Infof("Skipping StartJob due to lack of jobmanager instance")
 	} else {
-		err = jobmanager.CreateJekyllJob(lrm.kubenamespace, lrm.jm.KubeSession(), lrm.jm)
+		err = jobmanager.CreateRenderJob(lrm.kubenamespace, lrm.jm.KubeSession(), lrm.jm, lrm.RenderSpec(), build)
+	}
+	if err == nil {
+		lrm.builtMu.Lock()
+		lrm.built[branch] = build.Commit
+		lrm.builtMu.Unlock()
 	}
 
 	if lrm.enableBranchMode && sendNotify && lrm.newBranchObs != nil {
@@ -157,3 +512,75 @@ func (lrm *LocalRepoManager) HandleWebhook(branch string, sendNotify bool) error
 	}
 	return err
 }
+
+// BuiltCommit returns the commit of branch last queued for rendering by HandleWebhook, or empty if none
+func (lrm *LocalRepoManager) BuiltCommit(branch string) string {
+	lrm.builtMu.Lock()
+	defer lrm.builtMu.Unlock()
+	return lrm.built[branch]
+}
+
+// RemoteHeads returns the commit each of branches points to on the remote, or every branch's commit if
+// branches is empty, without fetching.  Branches that do not exist are omitted.  Must be called after
+// InitialClone.
+func (lrm *LocalRepoManager) RemoteHeads(branches []string) (map[string]string, error) {
+	heads, err := remoteHeads(lrm.repoURL, lrm.auth)
+	if err != nil {
+		return nil, err
+	}
+	if len(branches) == 0 {
+		return heads, nil
+	}
+	result := make(map[string]string, len(branches))
+	for _, branch := range branches {
+		if commit, ok := heads[branch]; ok {
+			result[branch] = commit
+		}
+	}
+	return result, nil
+}
+
+// DeleteBranch tears down a branch deleted from the remote, eg after it is merged, removing its worktree
+// and in branch mode its render output and preview.  The default and primary branches are never torn down.
+func (lrm *LocalRepoManager) DeleteBranch(branch string) error {
+	clarkezoneLog.Debugf("LocalRepoManager::DeleteBranch branch: %v", branch)
+	if branch == lrm.sourceBranch || branch == lrm.primaryBranch {
+		clarkezoneLog.Infof("Ignoring deletion of branch %v, whose output is shared with the site", branch)
+		return nil
+	}
+	lrm.builtMu.Lock()
+	delete(lrm.built, branch)
+	lrm.builtMu.Unlock()
+	// a render in flight mounts the worktree, which is deleted regardless as the branch is gone
+	err := lrm.RemoveWorktree(branch)
+	if err != nil {
+		return err
+	}
+	if !lrm.enableBranchMode {
+		clarkezoneLog.Infof("Tore down deleted branch %v", branch)
+		return nil
+	}
+
+	spec := lrm.branchRenderSpec(branch)
+	if lrm.jm == nil {
+		clarkezoneLog.Infof("Skipping removal of render output due to lack of jobmanager instance")
+	} else if spec.RenderSubPath != "" {
+		build := jobmanager.BuildInfo{Site: lrm.renderSpec.Site, Branch: branch}
+		err = jobmanager.CreateRemoveOutputJob(lrm.kubenamespace, lrm.jm.KubeSession(), lrm.jm, spec, build)
+		if err != nil {
+			clarkezoneLog.Errorf("LocalRepoManager::DeleteBranch unable to remove output of %v: %v", branch, err)
+			return err
+		}
+	}
+	renderDir := path.Join(lrm.localRootDir, lrm.BranchDir(branch))
+	err = os.RemoveAll(renderDir)
+	if err != nil {
+		clarkezoneLog.Errorf("LocalRepoManager::DeleteBranch %v", err)
+		return err
+	}
+	if lrm.newBranchObs != nil {
+		lrm.newBranchObs.DeletedBranch(lrm.legalizeBranchName(branch), renderDir)
+	}
+	clarkezoneLog.Infof("Tore down deleted branch %v", branch)
+	return nil
+}
@@ -3,6 +3,8 @@ package localrepomanager
 import (
 	"io/ioutil"
 	"os"
+	"path"
+	"strings"
 	"testing"
 
 	"github.com/clarkezone/previewd/internal"
@@ -75,6 +77,12 @@ func TestLegalizeBranchName(t *testing.T) {
 		t.Fatalf("result incorrect")
 	}
 
+	// branches legalized to the same name have separate directories
+	if name := lrm.BranchDir("feature/a-b"); !strings.HasPrefix(name, "featureab-") ||
+		name == lrm.BranchDir("feature/ab") || name != lrm.BranchDir("feature/a-b") {
+		t.Fatalf("branch directories should be unique and stable %v", name)
+	}
+
 	err = os.RemoveAll("test")
 	if err != nil {
 		t.Fatalf("unable to remove dirs")
@@ -92,11 +100,11 @@ func TestGetCurrentBranchRender(t *testing.T) {
 		t.Fatalf("getrenderdir failed")
 	}
 
-	if dir != "test/master" {
+	if dir != path.Join("test", lrm.BranchDir("master")) {
 		t.Fatalf("Wrong name")
 	}
 
-	_, err = ioutil.ReadDir("test/master")
+	_, err = ioutil.ReadDir(dir)
 	if err != nil {
 		t.Fatalf("Directory didn't get created")
 	}
@@ -107,6 +115,418 @@ func TestGetCurrentBranchRender(t *testing.T) {
 	}
 }
 
+func TestRenderSpecSubPath(t *testing.T) {
+	lrm, err := CreateLocalRepoManager(t.TempDir(), nil, true, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	lrm.currentBranch = "feature/one"
+	if lrm.RenderSpec().RenderSubPath != lrm.BranchDir("feature/one") ||
+		!strings.HasPrefix(lrm.RenderSpec().RenderSubPath, "featureone-") {
+		t.Fatalf("branch not rendered into its directory %v", lrm.RenderSpec().RenderSubPath)
+	}
+	lrm.SetPrimaryBranch("feature/one")
+	if lrm.RenderSpec().RenderSubPath != "" {
+		t.Fatalf("primary branch should render into the root of the claim")
+	}
+
+	lrm, err = CreateLocalRepoManager(t.TempDir(), nil, false, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	if lrm.RenderSpec().RenderSubPath != "" {
+		t.Fatalf("subpath should only be used in branch mode")
+	}
+}
+
+func TestCurrentBuildPreviewURL(t *testing.T) {
+	lrm, err := CreateLocalRepoManager(t.TempDir(), nil, true, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	lrm.currentBranch = "feature"
+	if lrm.CurrentBuild().PreviewURL != "" {
+		t.Fatalf("preview url should be empty without SetPreviewURL")
+	}
+	lrm.SetPreviewURL(func(branch string) string { return "http://blog.test/" + branch + "/" })
+	if build := lrm.CurrentBuild(); build.PreviewURL != "http://blog.test/feature/" || build.Branch != "feature" {
+		t.Fatalf("unexpected build %v", build)
+	}
+
+	lrm.enableBranchMode = false
+	if lrm.CurrentBuild().PreviewURL != "" {
+		t.Fatalf("preview url should only be set in branch mode")
+	}
+}
+
+func TestCloneInJob(t *testing.T) {
+	repo, master, feature := createTestRepo(t)
+	lrm, err := CreateLocalRepoManager(t.TempDir(), nil, false, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	lrm.SetCloneInJob(repo)
+	err = lrm.InitialClone(repo, "")
+	if err != nil {
+		t.Fatalf("initial clone failed %v", err)
+	}
+	if lrm.repo != nil {
+		t.Fatalf("repo should not be cloned locally")
+	}
+	if build := lrm.CurrentBuild(); build.Branch != "master" || build.Commit != master {
+		t.Fatalf("default branch not resolved %v", build)
+	}
+	err = lrm.SwitchBranch("feature")
+	if err != nil {
+		t.Fatalf("switch branch failed %v", err)
+	}
+	if build := lrm.CurrentBuild(); build.Branch != "feature" || build.Commit != feature {
+		t.Fatalf("feature branch not resolved %v", build)
+	}
+	if lrm.RenderSpec().CloneRepo != repo {
+		t.Fatalf("render spec should clone %v", repo)
+	}
+}
+
+func TestHandleWebhookPinsCommit(t *testing.T) {
+	repo, _, _ := createTestRepo(t)
+	pushed := addCommit(t, repo, "master", "pushed")
+	head := addCommit(t, repo, "master", "raced")
+	lrm, err := CreateLocalRepoManager(t.TempDir(), nil, false, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	err = lrm.InitialClone(repo, "")
+	if err != nil {
+		t.Fatalf("initial clone failed %v", err)
+	}
+
+	err = lrm.HandleWebhook("master", pushed, false)
+	if err != nil {
+		t.Fatalf("handle webhook failed %v", err)
+	}
+	if build := lrm.CurrentBuild(); build.Commit != pushed {
+		t.Fatalf("pushed commit not built %v", build)
+	}
+	if content, _ := os.ReadFile(path.Join(lrm.getSourceDir(), "index.md")); string(content) != "pushed" {
+		t.Fatalf("pushed commit not checked out %q", content)
+	}
+
+	err = lrm.HandleWebhook("master", "", false)
+	if err != nil {
+		t.Fatalf("handle webhook failed %v", err)
+	}
+	if build := lrm.CurrentBuild(); build.Commit != head {
+		t.Fatalf("branch head not built %v", build)
+	}
+
+	err = lrm.HandleWebhook("master", "0123456789012345678901234567890123456789", false)
+	if err == nil {
+		t.Fatalf("missing commit not detected")
+	}
+	err = lrm.HandleWebhook("master", "master", false)
+	if err == nil {
+		t.Fatalf("commit should be a hash")
+	}
+
+	lrm, err = CreateLocalRepoManager(t.TempDir(), nil, false, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	lrm.SetCloneInJob(repo)
+	err = lrm.InitialClone(repo, "")
+	if err != nil {
+		t.Fatalf("initial clone failed %v", err)
+	}
+	err = lrm.HandleWebhook("master", pushed, false)
+	if err != nil {
+		t.Fatalf("handle webhook failed %v", err)
+	}
+	if build := lrm.CurrentBuild(); build.Commit != pushed {
+		t.Fatalf("pushed commit not passed to the render job %v", build)
+	}
+}
+
+func TestReuseClone(t *testing.T) {
+	repo, _, _ := createTestRepo(t)
+	root := t.TempDir()
+	lrm, err := CreateLocalRepoManager(root, nil, false, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	err = lrm.InitialClone(repo, "")
+	if err != nil {
+		t.Fatalf("initial clone failed %v", err)
+	}
+	err = lrm.SwitchBranch("feature")
+	if err != nil {
+		t.Fatalf("switch branch failed %v", err)
+	}
+	source := lrm.getSourceDir()
+	marker := path.Join(source, ".git", "marker")
+	for _, file := range []string{marker, path.Join(source, "untracked.md"), path.Join(source, "index.md")} {
+		err = os.WriteFile(file, []byte("changed"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	master := addCommit(t, repo, "master", "restarted")
+
+	lrm, err = CreateLocalRepoManager(root, nil, false, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	err = lrm.InitialClone(repo, "")
+	if err != nil {
+		t.Fatalf("reusing clone failed %v", err)
+	}
+	if _, err = os.Stat(marker); err != nil {
+		t.Fatalf("existing clone was not reused")
+	}
+	if build := lrm.CurrentBuild(); build.Branch != "master" || build.Commit != master {
+		t.Fatalf("clone not reset to the default branch %v", build)
+	}
+	if _, err = os.Stat(path.Join(source, "untracked.md")); !os.IsNotExist(err) {
+		t.Fatalf("untracked file not cleaned")
+	}
+	if content, _ := os.ReadFile(path.Join(source, "index.md")); string(content) != "restarted" {
+		t.Fatalf("modified file not reset %q", content)
+	}
+
+	other, otherMaster, _ := createTestRepo(t)
+	err = lrm.InitialClone(other, "")
+	if err != nil {
+		t.Fatalf("clone of another remote failed %v", err)
+	}
+	if _, err = os.Stat(marker); !os.IsNotExist(err) {
+		t.Fatalf("clone of another remote should be wiped")
+	}
+	if build := lrm.CurrentBuild(); build.Commit != otherMaster {
+		t.Fatalf("other remote not cloned %v", build)
+	}
+
+	err = os.WriteFile(path.Join(source, ".git", "HEAD"), []byte("corrupt"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = lrm.InitialClone(other, "")
+	if err != nil {
+		t.Fatalf("corrupt clone not replaced %v", err)
+	}
+	if build := lrm.CurrentBuild(); build.Commit != otherMaster {
+		t.Fatalf("corrupt clone not replaced %v", build)
+	}
+}
+
+func TestBranchWorktrees(t *testing.T) {
+	repo, master, feature := createTestRepo(t)
+	root := t.TempDir()
+	lrm, err := CreateLocalRepoManager(root, nil, true, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	err = lrm.InitialClone(repo, "")
+	if err != nil {
+		t.Fatalf("initial clone failed %v", err)
+	}
+	err = lrm.SwitchBranch("feature")
+	if err != nil {
+		t.Fatalf("switch branch failed %v", err)
+	}
+	worktree := path.Join(root, "worktrees", lrm.BranchDir("feature"), "source")
+	if content, _ := os.ReadFile(path.Join(worktree, "index.md")); string(content) != "feature" {
+		t.Fatalf("branch not checked out into its worktree %q", content)
+	}
+	if content, _ := os.ReadFile(path.Join(lrm.getSourceDir(), "index.md")); string(content) != "master" {
+		t.Fatalf("source dir should stay on the default branch %q", content)
+	}
+	if build := lrm.CurrentBuild(); build.Branch != "feature" || build.Commit != feature {
+		t.Fatalf("worktree not built %v", build)
+	}
+	if lrm.RenderSpec().SourceSubPath != path.Join("worktrees", lrm.BranchDir("feature")) {
+		t.Fatalf("render job should mount the worktree %v", lrm.RenderSpec().SourceSubPath)
+	}
+	alternates, _ := os.ReadFile(path.Join(worktree, ".git", "objects", "info", "alternates"))
+	if strings.TrimSpace(string(alternates)) != "../../../../../source/.git/objects" {
+		t.Fatalf("worktree should share the objects of the source clone %q", alternates)
+	}
+	if packs, _ := os.ReadDir(path.Join(worktree, ".git", "objects", "pack")); len(packs) != 0 {
+		t.Fatalf("worktree should not fetch objects of its own %v", packs)
+	}
+
+	err = lrm.SwitchBranch("master")
+	if err != nil {
+		t.Fatalf("switch branch failed %v", err)
+	}
+	if build := lrm.CurrentBuild(); build.Commit != master || lrm.RenderSpec().SourceSubPath != "" {
+		t.Fatalf("default branch should be built from the source dir %v", build)
+	}
+	updated := addCommit(t, repo, "feature", "updated")
+	err = lrm.SwitchBranch("feature")
+	if err != nil {
+		t.Fatalf("switch branch failed %v", err)
+	}
+	if build := lrm.CurrentBuild(); build.Commit != updated {
+		t.Fatalf("worktree not updated %v", build)
+	}
+
+	marker := path.Join(worktree, ".git", "marker")
+	err = os.WriteFile(marker, []byte("reused"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lrm, err = CreateLocalRepoManager(root, nil, true, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	err = lrm.InitialClone(repo, "")
+	if err != nil {
+		t.Fatalf("initial clone failed %v", err)
+	}
+	err = lrm.SwitchBranch("feature")
+	if err != nil {
+		t.Fatalf("switch branch failed %v", err)
+	}
+	if _, err = os.Stat(marker); err != nil {
+		t.Fatalf("existing worktree was not reused")
+	}
+
+	err = lrm.PruneWorktrees([]string{"master"})
+	if err != nil {
+		t.Fatalf("prune failed %v", err)
+	}
+	if _, err = os.Stat(worktree); !os.IsNotExist(err) {
+		t.Fatalf("worktree of removed branch not deleted")
+	}
+	if build := lrm.CurrentBuild(); build.Branch != "master" {
+		t.Fatalf("current branch should revert to the default branch %v", build)
+	}
+}
+
+func TestRemoteHeads(t *testing.T) {
+	repo, master, feature := createTestRepo(t)
+	lrm, err := CreateLocalRepoManager(t.TempDir(), nil, false, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	err = lrm.InitialClone(repo, "")
+	if err != nil {
+		t.Fatalf("initial clone failed %v", err)
+	}
+	heads, err := lrm.RemoteHeads(nil)
+	if err != nil || len(heads) != 2 || heads["master"] != master || heads["feature"] != feature {
+		t.Fatalf("unexpected heads %v %v", heads, err)
+	}
+	heads, err = lrm.RemoteHeads([]string{"feature", "missing"})
+	if err != nil || len(heads) != 1 || heads["feature"] != feature {
+		t.Fatalf("unexpected heads of feature %v %v", heads, err)
+	}
+
+	if lrm.BuiltCommit("feature") != "" {
+		t.Fatalf("feature has not been built")
+	}
+	err = lrm.HandleWebhook("feature", "", false)
+	if err != nil {
+		t.Fatalf("handle webhook failed %v", err)
+	}
+	if lrm.BuiltCommit("feature") != feature {
+		t.Fatalf("built commit not recorded %v", lrm.BuiltCommit("feature"))
+	}
+}
+
+type branchRecorder struct {
+	deleted []string
+}
+
+func (r *branchRecorder) NewBranch(branch string, dir string) {}
+
+func (r *branchRecorder) DeletedBranch(branch string, dir string) {
+	r.deleted = append(r.deleted, branch)
+}
+
+func TestDeleteBranch(t *testing.T) {
+	repo, _, _ := createTestRepo(t)
+	root := t.TempDir()
+	observer := &branchRecorder{}
+	lrm, err := CreateLocalRepoManager(root, observer, true, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	err = lrm.InitialClone(repo, "")
+	if err != nil {
+		t.Fatalf("initial clone failed %v", err)
+	}
+	err = lrm.HandleWebhook("feature", "", true)
+	if err != nil {
+		t.Fatalf("handle webhook failed %v", err)
+	}
+
+	err = lrm.DeleteBranch("feature")
+	if err != nil {
+		t.Fatalf("delete branch failed %v", err)
+	}
+	for _, dir := range []string{path.Join(root, "worktrees", lrm.BranchDir("feature")),
+		path.Join(root, lrm.BranchDir("feature"))} {
+		if _, err = os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("%v of deleted branch not removed", dir)
+		}
+	}
+	if len(observer.deleted) != 1 || observer.deleted[0] != "feature" {
+		t.Fatalf("observer not told of deleted branch %v", observer.deleted)
+	}
+	if build := lrm.CurrentBuild(); build.Branch != "master" {
+		t.Fatalf("current branch should revert to the default branch %v", build)
+	}
+
+	err = lrm.DeleteBranch("master")
+	if err != nil {
+		t.Fatalf("delete branch failed %v", err)
+	}
+	if _, err = os.Stat(path.Join(lrm.getSourceDir(), "index.md")); err != nil || len(observer.deleted) != 1 {
+		t.Fatalf("default branch should not be torn down")
+	}
+}
+
+func TestDeleteBranchWithCollidingName(t *testing.T) {
+	repo, _, _ := createTestRepo(t)
+	for _, branch := range []string{"preview/a-b", "preview/ab"} {
+		createBranch(t, repo, branch)
+		addCommit(t, repo, branch, branch)
+	}
+	root := t.TempDir()
+	lrm, err := CreateLocalRepoManager(root, nil, true, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed")
+	}
+	err = lrm.InitialClone(repo, "")
+	if err != nil {
+		t.Fatalf("initial clone failed %v", err)
+	}
+	for _, branch := range []string{"preview/a-b", "preview/ab"} {
+		err = lrm.HandleWebhook(branch, "", false)
+		if err != nil {
+			t.Fatalf("handle webhook failed %v", err)
+		}
+	}
+	if lrm.BranchDir("preview/a-b") == lrm.BranchDir("preview/ab") {
+		t.Fatalf("branches share a directory %v", lrm.BranchDir("preview/ab"))
+	}
+
+	err = lrm.DeleteBranch("preview/a-b")
+	if err != nil {
+		t.Fatalf("delete branch failed %v", err)
+	}
+	for _, dir := range []string{path.Join(root, lrm.BranchDir("preview/ab")),
+		path.Join(root, "worktrees", lrm.BranchDir("preview/ab"), "source", "index.md")} {
+		if _, err = os.Stat(dir); err != nil {
+			t.Fatalf("%v of the live branch removed %v", dir, err)
+		}
+	}
+	if _, err = os.Stat(path.Join(root, lrm.BranchDir("preview/a-b"))); !os.IsNotExist(err) {
+		t.Fatalf("output of deleted branch not removed")
+	}
+}
+
 func TestLRMCheckout(t *testing.T) {
 	//nolint
 	repo, dirname, _, _, _ := internal.Getenv(t)
@@ -0,0 +1,70 @@
+package localrepomanager
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// shallowStorer presents the shallow commits of a shallow clone as having no parents, as git does
+// with grafts.  Without it go-git fails to fetch into a shallow clone with object not found, as it
+// walks the history of local refs to find the commits it has and reaches parents that were never
+// cloned.
+type shallowStorer struct {
+	storage.Storer
+	shallow map[plumbing.Hash]bool
+}
+
+func newShallowStorer(s storage.Storer) (*shallowStorer, error) {
+	hashes, err := s.Shallow()
+	if err != nil {
+		return nil, err
+	}
+	shallow := make(map[plumbing.Hash]bool, len(hashes))
+	for _, hash := range hashes {
+		shallow[hash] = true
+	}
+	return &shallowStorer{Storer: s, shallow: shallow}, nil
+}
+
+// graftedObject is a commit re-encoded without parents that keeps the hash of the original
+type graftedObject struct {
+	*plumbing.MemoryObject
+	hash plumbing.Hash
+}
+
+func (o *graftedObject) Hash() plumbing.Hash {
+	return o.hash
+}
+
+// EncodedObject returns shallow commits without their parents and every other object unchanged
+func (s *shallowStorer) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	obj, err := s.Storer.EncodedObject(t, h)
+	if err != nil || !s.shallow[h] || obj.Type() != plumbing.CommitObject {
+		return obj, err
+	}
+	commit, err := object.DecodeCommit(s.Storer, obj)
+	if err != nil {
+		return nil, err
+	}
+	commit.ParentHashes = nil
+	grafted := &graftedObject{MemoryObject: &plumbing.MemoryObject{}, hash: h}
+	err = commit.Encode(grafted.MemoryObject)
+	if err != nil {
+		return nil, err
+	}
+	return grafted, nil
+}
+
+// PackfileWriter lets fetched packfiles be written as is rather than unpacked into loose objects
+func (s *shallowStorer) PackfileWriter() (io.WriteCloser, error) {
+	pw, ok := s.Storer.(storer.PackfileWriter)
+	if !ok {
+		return nil, fmt.Errorf("storage does not support writing packfiles")
+	}
+	return pw.PackfileWriter()
+}
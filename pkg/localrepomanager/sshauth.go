@@ -0,0 +1,81 @@
+package localrepomanager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshKey is a private key used to authenticate with ssh remotes
+type sshKey struct {
+	keyPath        string
+	passphrase     string
+	knownHostsPath string
+}
+
+// isSSHRemote returns true for ssh://, git+ssh:// and scp-like user@host:path remotes
+func isSSHRemote(repo string) bool {
+	endpoint, err := transport.NewEndpoint(repo)
+	return err == nil && endpoint.Protocol == "ssh"
+}
+
+// sshKeyAuth returns public key auth for an ssh remote using the user named in the remote, or git if
+// there is none.  The server's host key must be listed in the known_hosts file.
+func sshKeyAuth(repo string, key sshKey) (transport.AuthMethod, error) {
+	if key.knownHostsPath == "" {
+		return nil, fmt.Errorf("a known_hosts file is required to verify ssh remote %v", RedactURL(repo))
+	}
+	endpoint, err := transport.NewEndpoint(repo)
+	if err != nil {
+		return nil, err
+	}
+	user := endpoint.User
+	if user == "" {
+		user = gitssh.DefaultUsername
+	}
+	pem, err := os.ReadFile(key.keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ssh key: %w", err)
+	}
+	auth, err := gitssh.NewPublicKeys(user, pem, key.passphrase)
+	if err != nil {
+		// never include the passphrase, errors from parsing the key do not
+		return nil, fmt.Errorf("unable to load ssh key %v: %w", key.keyPath, err)
+	}
+	callback, err := strictHostKeyCallback(key.knownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+	auth.HostKeyCallback = callback
+	return auth, nil
+}
+
+// strictHostKeyCallback rejects servers whose host key is not in the known_hosts file, explaining
+// whether the host is unknown or presented a different key
+func strictHostKeyCallback(knownHostsPath string) (ssh.HostKeyCallback, error) {
+	callback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read known_hosts %v: %w", knownHostsPath, err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) == 0 {
+			return fmt.Errorf("host %v is not in known_hosts %v, add its key with ssh-keyscan", hostname,
+				knownHostsPath)
+		}
+		want := keyErr.Want[0]
+		return fmt.Errorf("host key mismatch for %v: server presented %v key %v but %v:%v expects %v key %v, "+
+			"the host key may have changed or the connection is being intercepted", hostname, key.Type(),
+			ssh.FingerprintSHA256(key), want.Filename, want.Line, want.Key.Type(), ssh.FingerprintSHA256(want.Key))
+	}, nil
+}
@@ -0,0 +1,185 @@
+package localrepomanager
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func generateKey(t *testing.T) (ssh.Signer, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// startSSHServer serves git-upload-pack over ssh to clients authenticating with clientKey, returning
+// the address it listens on
+func startSSHServer(t *testing.T, hostKey ssh.Signer, clientKey ssh.PublicKey) string {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, fmt.Errorf("unknown key for %v", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSHConn(conn, config)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveSSHConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go serveSession(channel, requests)
+	}
+}
+
+// serveSession runs the git-upload-pack '<path>' command a git client execs
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" || len(req.Payload) < 4 {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		command := string(req.Payload[4:])
+		if !strings.HasPrefix(command, "git-upload-pack ") {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		_ = req.Reply(true, nil)
+		repo := strings.Trim(strings.TrimPrefix(command, "git-upload-pack "), "'")
+		//nolint:gosec // test server, repo is a temporary directory
+		cmd := exec.Command("git", "upload-pack", repo)
+		cmd.Stdin = channel
+		cmd.Stdout = channel
+		cmd.Stderr = channel.Stderr()
+		status := make([]byte, 4)
+		if err := cmd.Run(); err != nil {
+			binary.BigEndian.PutUint32(status, 1)
+		}
+		_, _ = channel.SendRequest("exit-status", false, status)
+		return
+	}
+}
+
+func writeKnownHosts(t *testing.T, addr string, key ssh.PublicKey) string {
+	knownHosts := path.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, key) + "\n"
+	err := os.WriteFile(knownHosts, []byte(line), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return knownHosts
+}
+
+func TestSSHKeyClone(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo, master, _ := createTestRepo(t)
+	hostKey, _ := generateKey(t)
+	otherHostKey, _ := generateKey(t)
+	clientKey, clientPEM := generateKey(t)
+	keyPath := path.Join(t.TempDir(), "id_ecdsa")
+	err := os.WriteFile(keyPath, clientPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := startSSHServer(t, hostKey, clientKey.PublicKey())
+	remote := fmt.Sprintf("ssh://git@%v%v", addr, repo)
+
+	clone := func(knownHosts string) (*LocalRepoManager, error) {
+		lrm, err := CreateLocalRepoManager(t.TempDir(), nil, false, nil, "")
+		if err != nil {
+			t.Fatalf("create localrepomanager failed")
+		}
+		lrm.SetSSHKey(keyPath, "", knownHosts)
+		return lrm, lrm.InitialClone(remote, "")
+	}
+
+	lrm, err := clone(writeKnownHosts(t, addr, hostKey.PublicKey()))
+	if err != nil {
+		t.Fatalf("clone over ssh failed %v", err)
+	}
+	if build := lrm.CurrentBuild(); build.Commit != master {
+		t.Fatalf("unexpected commit %v", build)
+	}
+
+	_, err = clone(writeKnownHosts(t, addr, otherHostKey.PublicKey()))
+	if err == nil || !strings.Contains(err.Error(), "host key mismatch") {
+		t.Fatalf("changed host key not detected %v", err)
+	}
+
+	_, err = clone(writeKnownHosts(t, "github.com", hostKey.PublicKey()))
+	if err == nil || !strings.Contains(err.Error(), "not in known_hosts") {
+		t.Fatalf("unknown host not detected %v", err)
+	}
+
+	_, err = clone("")
+	if err == nil {
+		t.Fatalf("known_hosts should be required")
+	}
+}
+
+func TestIsSSHRemote(t *testing.T) {
+	for repo, expected := range map[string]bool{
+		"git@github.com:clarkezone/previewd.git":       true,
+		"ssh://git@github.com/clarkezone/previewd.git": true,
+		"https://github.com/clarkezone/previewd.git":   false,
+		"/tmp/repo": false,
+	} {
+		if isSSHRemote(repo) != expected {
+			t.Fatalf("isSSHRemote(%v) should be %v", repo, expected)
+		}
+	}
+}
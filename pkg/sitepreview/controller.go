@@ -0,0 +1,506 @@
+package sitepreview
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/clarkezone/hookserve/hookserve"
+
+	"github.com/clarkezone/previewd/pkg/jobmanager"
+	llrm "github.com/clarkezone/previewd/pkg/localrepomanager"
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+	"github.com/clarkezone/previewd/pkg/webhooklistener"
+)
+
+const (
+	requeueWhileBuilding = 10 * time.Second
+	// defaultTokenKey is the key of the token secret read when none is given
+	defaultTokenKey = "token"
+)
+
+var secretsResource = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+
+// Controller reconciles SitePreview resources by cloning each site with a LocalRepoManager
+// and rendering its branches with render jobs scheduled by the Jobmanager
+type Controller struct {
+	client    dynamic.Interface
+	jm        *jobmanager.Jobmanager
+	rootDir   string
+	namespace string
+	factory   dynamicinformer.DynamicSharedInformerFactory
+	informer  cache.SharedIndexInformer
+	queue     workqueue.RateLimitingInterface
+	ctx       context.Context
+	cancel    context.CancelFunc
+	mu        sync.Mutex
+	sites     map[string]*site
+	// previews maps preview namespaces to the key of the site they belong to
+	previews map[string]string
+	// each site's branches are polled every pollInterval for pushes, 0 disables polling
+	pollInterval   time.Duration
+	pollJitter     float64
+	pollMaxBackoff time.Duration
+}
+
+// site holds the state for a single SitePreview
+type site struct {
+	lrm        *llrm.LocalRepoManager
+	spec       SitePreviewSpec
+	generation int64
+	pending    []string
+	building   string
+	status     SitePreviewStatus
+	// stopPoll is closed to stop polling the site, nil if the site is not polled
+	stopPoll chan bool
+}
+
+// NewController creates a controller watching SitePreviews in namespace, or all namespaces if empty.
+// Source for each site is cloned below rootDir, which must be where the source claim is mounted,
+// unless the site specifies a LocalDir.
+// NewController must be called before the Jobmanager's watchers are started.
+func NewController(config *rest.Config, jm *jobmanager.Jobmanager, rootDir string,
+	namespace string) (*Controller, error) {
+	clarkezoneLog.Debugf("sitepreview: NewController() called with rootDir:%v namespace:%v", rootDir, namespace)
+	if config == nil {
+		return nil, fmt.Errorf("config supplied is nil")
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return newControllerWithClient(client, jm, rootDir, namespace), nil
+}
+
+func newControllerWithClient(client dynamic.Interface, jm *jobmanager.Jobmanager, rootDir string,
+	namespace string) *Controller {
+	c := &Controller{client: client, jm: jm, rootDir: rootDir, namespace: namespace}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.sites = make(map[string]*site)
+	c.previews = make(map[string]string)
+	c.queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	c.factory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, namespace, nil)
+	c.informer = c.factory.ForResource(GroupVersionResource).Informer()
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.enqueue,
+		UpdateFunc: func(oldobj interface{}, newobj interface{}) { c.enqueue(newobj) },
+		DeleteFunc: c.enqueue,
+	})
+	if jm != nil {
+		jm.AddBuildObserver(c.onBuildComplete)
+	}
+	return c
+}
+
+// Start starts the informer and reconcile loop
+func (c *Controller) Start() error {
+	clarkezoneLog.Debugf("sitepreview: Start() called")
+	c.factory.Start(c.ctx.Done())
+	if !cache.WaitForCacheSync(c.ctx.Done(), c.informer.HasSynced) {
+		return fmt.Errorf("sitepreview: waitforcachesync failed")
+	}
+	go func() {
+		clarkezoneLog.Debugf("sitepreview: reconcile loop started")
+		defer clarkezoneLog.Debugf("sitepreview: reconcile loop exited")
+		for c.processNextItem() {
+		}
+	}()
+	if c.jm != nil && c.jm.KubeSession() != nil {
+		go c.sweepPreviewNamespaces()
+	}
+	return nil
+}
+
+// SetPolling polls the branches of each site for pushes every interval varied by the fraction jitter,
+// backing off up to maxBackoff while polls fail.  Branches whose head moved are rendered again.
+// Must be called before Start.
+func (c *Controller) SetPolling(interval time.Duration, jitter float64, maxBackoff time.Duration) {
+	c.pollInterval = interval
+	c.pollJitter = jitter
+	c.pollMaxBackoff = maxBackoff
+}
+
+// Stop shuts down the informer, reconcile loop and pollers
+func (c *Controller) Stop() {
+	clarkezoneLog.Debugf("sitepreview: Stop() called")
+	c.cancel()
+	c.queue.ShutDown()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, st := range c.sites {
+		st.stopPolling()
+	}
+}
+
+func (c *Controller) enqueue(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		clarkezoneLog.Errorf("sitepreview: unable to get key for object %v", err)
+		return
+	}
+	c.queue.Add(key)
+}
+
+func (c *Controller) processNextItem() bool {
+	item, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(item)
+	key := item.(string)
+	err := c.reconcile(key)
+	if err != nil {
+		clarkezoneLog.Errorf("sitepreview: reconcile of %v failed: %v", key, err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+func (c *Controller) reconcile(key string) error {
+	clarkezoneLog.Debugf("sitepreview: reconcile() called with key:%v", key)
+	obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		clarkezoneLog.Infof("sitepreview: %v deleted, no longer tracking", key)
+		c.mu.Lock()
+		if st, ok := c.sites[key]; ok {
+			st.stopPolling()
+		}
+		delete(c.sites, key)
+		c.mu.Unlock()
+		return nil
+	}
+	sp, err := FromUnstructured(obj.(*unstructured.Unstructured))
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	st, ok := c.sites[key]
+	stale := !ok || st.generation != sp.Generation
+	busy := ok && st.building != ""
+	c.mu.Unlock()
+
+	if stale {
+		if busy {
+			// the spec changed while a build is in flight, pick it up once that build completes
+			c.queue.AddAfter(key, requeueWhileBuilding)
+			return nil
+		}
+		st, err = c.newSite(key, sp)
+		if err != nil {
+			status := sp.Status
+			status.Phase = PhaseFailed
+			status.Message = err.Error()
+			status.ObservedGeneration = sp.Generation
+			statusErr := c.updateStatus(sp, status)
+			if statusErr != nil {
+				clarkezoneLog.Errorf("sitepreview: unable to update status for %v: %v", key, statusErr)
+			}
+			return err
+		}
+		c.mu.Lock()
+		if old, ok := c.sites[key]; ok {
+			old.stopPolling()
+		}
+		c.sites[key] = st
+		if c.pollInterval > 0 {
+			c.startPolling(key, st)
+		}
+		c.mu.Unlock()
+	}
+
+	c.buildNext(key, st)
+
+	c.mu.Lock()
+	status := st.status
+	c.mu.Unlock()
+	return c.updateStatus(sp, status)
+}
+
+// newSite clones the site's repo and queues all of its branches for rendering
+func (c *Controller) newSite(key string, sp *SitePreview) (*site, error) {
+	if len(sp.Spec.Branches) == 0 {
+		return nil, fmt.Errorf("no branches specified")
+	}
+	if sp.Spec.PreviewNamespaces != nil {
+		// claims cannot be mounted across namespaces and jobs outside the watched namespace are not observed
+		if !sp.Spec.CloneInJob {
+			return nil, fmt.Errorf("previewNamespaces requires cloneInJob")
+		}
+		if c.namespace != "" {
+			return nil, fmt.Errorf("previewNamespaces requires the controller to watch all namespaces")
+		}
+	}
+	spec, err := renderSpecFor(sp)
+	if err != nil {
+		return nil, err
+	}
+	localDir := sp.Spec.LocalDir
+	if localDir == "" {
+		// rootDir is where the source claim is mounted, so render jobs mount the site's directory of it
+		localDir = path.Join(c.rootDir, sp.Namespace, sp.Name)
+		spec.SourceSubPath = path.Join(sp.Namespace, sp.Name)
+	}
+	branchMode := sp.Spec.Publish.BranchPreviews || sp.Spec.PreviewNamespaces != nil
+	lrm, err := llrm.CreateLocalRepoManager(localDir, nil, branchMode, c.jm, sp.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	st := &site{lrm: lrm, spec: sp.Spec, generation: sp.Generation}
+	lrm.SetRenderSpec(spec)
+	// the first branch is served from the root of the site, see previewURL
+	lrm.SetPrimaryBranch(sp.Spec.Branches[0])
+	lrm.SetPreviewURL(func(branch string) string { return branchURL(key, st, branch) })
+	lrm.SetBranchRenderSpec(func(branch string, spec jobmanager.RenderSpec) jobmanager.RenderSpec {
+		return branchRenderSpec(key, st, branch, spec)
+	})
+	if sp.Spec.CloneInJob {
+		lrm.SetCloneInJob(sp.Spec.Repo)
+	}
+	if sp.Spec.Clone != nil {
+		lrm.SetCloneOptions(sp.Spec.Clone.Depth, sp.Spec.Clone.SingleBranch, sp.Spec.Clone.NoTags)
+		lrm.SetSubmodules(sp.Spec.Clone.Submodules)
+	}
+	token := ""
+	if sp.Spec.Auth != nil {
+		token, err = c.readToken(sp.Namespace, sp.Spec.Auth.TokenSecret)
+		if err != nil {
+			return nil, err
+		}
+		lrm.SetGitUsername(sp.Spec.Auth.Username)
+	}
+	err = lrm.InitialClone(sp.Spec.Repo, token)
+	if err != nil {
+		return nil, err
+	}
+	// worktrees of branches no longer in the spec are left by the previous site
+	err = lrm.PruneWorktrees(sp.Spec.Branches)
+	if err != nil {
+		return nil, err
+	}
+	st.pending = append(st.pending, sp.Spec.Branches...)
+	st.status = SitePreviewStatus{Phase: PhasePending, ObservedGeneration: sp.Generation}
+	return st, nil
+}
+
+// buildNext switches to the next pending branch and queues a render if no build is in flight
+func (c *Controller) buildNext(key string, st *site) {
+	c.mu.Lock()
+	if st.building != "" || len(st.pending) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	branch := st.pending[0]
+	st.pending = st.pending[1:]
+	st.building = branch
+	st.status.Phase = PhaseBuilding
+	st.status.Message = fmt.Sprintf("building branch %v", branch)
+	c.mu.Unlock()
+
+	var err error
+	if usesPreviewNamespace(st.spec, branch) {
+		err = c.ensurePreviewNamespace(key, st, branch)
+	}
+	if err == nil {
+		err = st.lrm.HandleWebhook(branch, "", false)
+	}
+	if err != nil {
+		c.mu.Lock()
+		st.building = ""
+		st.status.Phase = PhaseFailed
+		st.status.Message = fmt.Sprintf("unable to build branch %v: %v", branch, err)
+		c.mu.Unlock()
+	}
+}
+
+// startPolling polls the remote heads of the site's branches, queueing renders of branches pushed to.
+// Must be called with c.mu held.
+func (c *Controller) startPolling(key string, st *site) {
+	events := make(chan hookserve.Event)
+	exit := make(chan bool)
+	st.stopPoll = exit
+	poller := webhooklistener.NewPoller(st.spec.Branches, c.pollInterval, c.pollJitter, c.pollMaxBackoff)
+	go poller.Run(st.lrm.RemoteHeads, st.lrm.BuiltCommit, events, exit)
+	go func() {
+		for {
+			select {
+			case <-exit:
+				return
+			case event := <-events:
+				// deleted branches stay in the spec, their last render is kept until the spec changes
+				if event.Type == webhooklistener.PollEventType {
+					c.onPush(key, st, event.Branch, event.Commit)
+				}
+			}
+		}
+	}()
+}
+
+// stopPolling stops the site's poller if it has one.  Must be called with the controller's mu held.
+func (st *site) stopPolling() {
+	if st.stopPoll != nil {
+		close(st.stopPoll)
+		st.stopPoll = nil
+	}
+}
+
+// onPush queues a render of branch once its head has moved to commit, unless commit is already rendered
+// or the branch is already queued
+func (c *Controller) onPush(key string, st *site, branch string, commit string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sites[key] != st || st.lrm.BuiltCommit(branch) == commit {
+		return
+	}
+	for _, pending := range st.pending {
+		if pending == branch {
+			return
+		}
+	}
+	clarkezoneLog.Infof("sitepreview: branch %v of %v pushed to %v, queueing render", branch, key, commit)
+	st.pending = append(st.pending, branch)
+	c.queue.Add(key)
+}
+
+// onBuildComplete is called by the Jobmanager when a render job finishes
+func (c *Controller) onBuildComplete(job *batchv1.Job, succeeded bool) {
+	name := job.Labels[jobmanager.SiteLabel]
+	if name == "" {
+		return
+	}
+	key := job.Namespace + "/" + name
+	branch := job.Annotations[jobmanager.BranchAnnotation]
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if siteKey, ok := c.previews[job.Namespace]; ok {
+		key = siteKey
+	}
+	st, ok := c.sites[key]
+	if !ok || st.building == "" || st.building != branch {
+		return
+	}
+	st.building = ""
+	st.status.LastBranch = branch
+	st.status.LastCommit = job.Annotations[jobmanager.CommitAnnotation]
+	if succeeded {
+		st.status.Phase = PhaseSucceeded
+		st.status.Message = fmt.Sprintf("branch %v rendered", branch)
+		st.status.PreviewURL = branchURL(key, st, branch)
+	} else {
+		st.status.Phase = PhaseFailed
+		st.status.Message = fmt.Sprintf("render job %v failed for branch %v", job.Name, branch)
+	}
+	c.queue.Add(key)
+}
+
+// readToken returns the access token held in a Secret of the SitePreview's namespace.  The token is
+// never logged or included in errors.
+func (c *Controller) readToken(namespace string, selector apiv1.SecretKeySelector) (string, error) {
+	key := selector.Key
+	if key == "" {
+		key = defaultTokenKey
+	}
+	u, err := c.client.Resource(secretsResource).Namespace(namespace).Get(c.ctx, selector.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("unable to read token secret: %w", err)
+	}
+	secret := &apiv1.Secret{}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), secret)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(secret.Data[key]))
+	if token == "" {
+		return "", fmt.Errorf("secret %v/%v has no value for key %v", namespace, selector.Name, key)
+	}
+	return token, nil
+}
+
+func (c *Controller) updateStatus(sp *SitePreview, status SitePreviewStatus) error {
+	if reflect.DeepEqual(sp.Status, status) {
+		return nil
+	}
+	updated := sp.DeepCopyWithStatus(status)
+	u, err := ToUnstructured(updated)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.Resource(GroupVersionResource).Namespace(sp.Namespace).UpdateStatus(c.ctx, u,
+		metav1.UpdateOptions{})
+	return err
+}
+
+// renderSpecFor returns the render spec for a site, defaulting to Jekyll
+func renderSpecFor(sp *SitePreview) (jobmanager.RenderSpec, error) {
+	spec := jobmanager.GetJekyllRenderSpec()
+	spec.JobName = sp.Name + "-render"
+	spec.Site = sp.Name
+	if sp.Spec.Renderer.Image != "" {
+		spec.Image = sp.Spec.Renderer.Image
+	}
+	if sp.Spec.Renderer.Command != nil {
+		spec.Command = sp.Spec.Renderer.Command
+	}
+	if sp.Spec.Renderer.Args != nil {
+		spec.Args = sp.Spec.Renderer.Args
+	}
+	spec.Env = sp.Spec.Renderer.Env
+	spec.EnvFrom = sp.Spec.Renderer.EnvFrom
+	if sp.Spec.Volumes.RenderClaim != "" {
+		spec.RenderClaim = sp.Spec.Volumes.RenderClaim
+	}
+	if sp.Spec.Volumes.SourceClaim != "" {
+		spec.SourceClaim = sp.Spec.Volumes.SourceClaim
+	}
+	for _, volume := range sp.Spec.Volumes.Extra {
+		ref, err := volume.mountRef()
+		if err != nil {
+			return jobmanager.RenderSpec{}, err
+		}
+		spec.Volumes = append(spec.Volumes, ref)
+	}
+	if sp.Spec.CloneInJob && sp.Spec.Auth != nil {
+		// render jobs in the site's namespace read the token from the same secret as the controller
+		selector := sp.Spec.Auth.TokenSecret
+		if selector.Key == "" {
+			selector.Key = defaultTokenKey
+		}
+		spec.CloneTokenSecret = &selector
+		spec.CloneUsername = sp.Spec.Auth.Username
+	}
+	return spec, nil
+}
+
+// previewURL returns the url a rendered branch is served from
+func previewURL(spec SitePreviewSpec, lrm *llrm.LocalRepoManager, branch string) string {
+	if spec.Publish.BaseURL == "" {
+		return ""
+	}
+	base := strings.TrimSuffix(spec.Publish.BaseURL, "/")
+	if !spec.Publish.BranchPreviews || (len(spec.Branches) > 0 && branch == spec.Branches[0]) {
+		return base + "/"
+	}
+	return base + "/" + lrm.BranchDir(branch) + "/"
+}
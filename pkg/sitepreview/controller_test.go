@@ -0,0 +1,586 @@
+package sitepreview
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/sirupsen/logrus"
+	batchv1 "k8s.io/api/batch/v1"
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+
+	"github.com/clarkezone/previewd/pkg/jobmanager"
+	"github.com/clarkezone/previewd/pkg/kubelayer"
+	llrm "github.com/clarkezone/previewd/pkg/localrepomanager"
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+const testNamespace = "testns"
+
+// TestMain initizlie all tests
+func TestMain(m *testing.M) {
+	clarkezoneLog.Init(logrus.DebugLevel)
+	code := m.Run()
+	os.Exit(code)
+}
+
+func getTestSitePreview() *SitePreview {
+	return &SitePreview{
+		TypeMeta: metav1.TypeMeta{APIVersion: Group + "/" + Version, Kind: Kind},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "blog",
+			Namespace:  testNamespace,
+			Generation: 1,
+		},
+		Spec: SitePreviewSpec{
+			Repo:     "https://github.com/clarkezone/selfhostinfrablog.git",
+			Branches: []string{"main", "feature/foo"},
+			Publish:  PublishSpec{BaseURL: "http://blog.test/", BranchPreviews: true},
+		},
+	}
+}
+
+func getTestController(t *testing.T, sp *SitePreview) *Controller {
+	u, err := ToUnstructured(sp)
+	if err != nil {
+		t.Fatalf("ToUnstructured failed %v", err)
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{GroupVersionResource: "SitePreviewList"}, u)
+	c := newControllerWithClient(client, nil, t.TempDir(), testNamespace)
+	err = c.informer.GetIndexer().Add(u)
+	if err != nil {
+		t.Fatalf("unable to add sitepreview to indexer %v", err)
+	}
+	return c
+}
+
+func TestRoundTripUnstructured(t *testing.T) {
+	sp := getTestSitePreview()
+	u, err := ToUnstructured(sp)
+	if err != nil {
+		t.Fatalf("ToUnstructured failed %v", err)
+	}
+	result, err := FromUnstructured(u)
+	if err != nil {
+		t.Fatalf("FromUnstructured failed %v", err)
+	}
+	if result.Spec.Repo != sp.Spec.Repo || len(result.Spec.Branches) != 2 || !result.Spec.Publish.BranchPreviews {
+		t.Fatalf("spec did not round trip %v", result.Spec)
+	}
+}
+
+func TestRenderSpecFor(t *testing.T) {
+	sp := getTestSitePreview()
+	spec, err := renderSpecFor(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := jobmanager.GetJekyllRenderSpec()
+	if spec.JobName != "blog-render" || spec.Site != "blog" {
+		t.Fatalf("incorrect job name %v or site %v", spec.JobName, spec.Site)
+	}
+	if spec.Image != defaults.Image || spec.RenderClaim != defaults.RenderClaim {
+		t.Fatalf("defaults not applied")
+	}
+
+	sp.Spec.Renderer = RendererSpec{Image: "hugo", Command: []string{"hugo"},
+		Env: []apiv1.EnvVar{{Name: "JEKYLL_ENV", Value: "production"}}}
+	sp.Spec.Volumes = VolumesSpec{RenderClaim: "blogrender-pvc", SourceClaim: "blogsource-pvc"}
+	spec, err = renderSpecFor(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.Image != "hugo" || spec.Command[0] != "hugo" || spec.Args[0] != defaults.Args[0] {
+		t.Fatalf("renderer overrides not applied")
+	}
+	if len(spec.Env) != 1 || spec.Env[0].Value != "production" {
+		t.Fatalf("renderer env not applied %v", spec.Env)
+	}
+	if spec.RenderClaim != "blogrender-pvc" || spec.SourceClaim != "blogsource-pvc" {
+		t.Fatalf("volume overrides not applied")
+	}
+
+	if spec.CloneTokenSecret != nil {
+		t.Fatalf("token secret should only be given to jobs that clone")
+	}
+	sp.Spec.CloneInJob = true
+	sp.Spec.Auth = &RepoAuthSpec{TokenSecret: apiv1.SecretKeySelector{
+		LocalObjectReference: apiv1.LocalObjectReference{Name: "blog-git"}}, Username: "gitea"}
+	spec, err = renderSpecFor(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec.CloneTokenSecret == nil || spec.CloneTokenSecret.Name != "blog-git" ||
+		spec.CloneTokenSecret.Key != defaultTokenKey || spec.CloneUsername != "gitea" {
+		t.Fatalf("token secret not forwarded %v %v", spec.CloneTokenSecret, spec.CloneUsername)
+	}
+
+	sp.Spec.Volumes.Extra = []ExtraVolume{
+		{MountPath: "/config", ConfigMap: &apiv1.ConfigMapVolumeSource{
+			LocalObjectReference: apiv1.LocalObjectReference{Name: "blog-config"}}},
+		{MountPath: "/scratch", EmptyDir: &apiv1.EmptyDirVolumeSource{}},
+	}
+	spec, err = renderSpecFor(sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Volumes) != 2 || spec.Volumes[0].Source.ConfigMap.Name != "blog-config" ||
+		spec.Volumes[1].Source.EmptyDir == nil || spec.Volumes[1].MountPath != "/scratch" {
+		t.Fatalf("extra volumes not applied %v", spec.Volumes)
+	}
+
+	// each volume needs exactly one source
+	for _, volume := range []ExtraVolume{
+		{MountPath: "/config"},
+		{MountPath: "/config", Secret: &apiv1.SecretVolumeSource{SecretName: "keys"},
+			EmptyDir: &apiv1.EmptyDirVolumeSource{}},
+		{Secret: &apiv1.SecretVolumeSource{SecretName: "keys"}},
+	} {
+		sp.Spec.Volumes.Extra = []ExtraVolume{volume}
+		if _, err = renderSpecFor(sp); err == nil {
+			t.Fatalf("expected error for volume %v", volume)
+		}
+	}
+}
+
+func TestPreviewURL(t *testing.T) {
+	sp := getTestSitePreview()
+	lrm, err := llrm.CreateLocalRepoManager(t.TempDir(), nil, true, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed %v", err)
+	}
+	if result := previewURL(sp.Spec, lrm, "main"); result != "http://blog.test/" {
+		t.Fatalf("incorrect url for published branch %v", result)
+	}
+	if result := previewURL(sp.Spec, lrm, "feature/foo"); result != "http://blog.test/featurefoo-f9320326/" {
+		t.Fatalf("incorrect url for preview branch %v", result)
+	}
+	sp.Spec.Publish.BranchPreviews = false
+	if result := previewURL(sp.Spec, lrm, "feature/foo"); result != "http://blog.test/" {
+		t.Fatalf("incorrect url without branch previews %v", result)
+	}
+}
+
+func TestBuildCompleteUpdatesStatus(t *testing.T) {
+	sp := getTestSitePreview()
+	c := getTestController(t, sp)
+	lrm, err := llrm.CreateLocalRepoManager(t.TempDir(), nil, true, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed %v", err)
+	}
+	key := testNamespace + "/blog"
+	c.sites[key] = &site{lrm: lrm, spec: sp.Spec, generation: sp.Generation, building: "main",
+		status: SitePreviewStatus{Phase: PhaseBuilding, ObservedGeneration: sp.Generation}}
+
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{
+		Name:        "blog-render",
+		Namespace:   testNamespace,
+		Labels:      map[string]string{jobmanager.SiteLabel: "blog"},
+		Annotations: map[string]string{jobmanager.BranchAnnotation: "main", jobmanager.CommitAnnotation: "e2cdd92"},
+	}}
+	c.onBuildComplete(job, true)
+	if c.queue.Len() != 1 {
+		t.Fatalf("build completion did not enqueue site")
+	}
+
+	err = c.reconcile(key)
+	if err != nil {
+		t.Fatalf("reconcile failed %v", err)
+	}
+	u, err := c.client.Resource(GroupVersionResource).Namespace(testNamespace).Get(context.TODO(), "blog",
+		metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get sitepreview failed %v", err)
+	}
+	result, err := FromUnstructured(u)
+	if err != nil {
+		t.Fatalf("FromUnstructured failed %v", err)
+	}
+	if result.Status.Phase != PhaseSucceeded || result.Status.LastCommit != "e2cdd92" ||
+		result.Status.LastBranch != "main" || result.Status.PreviewURL != "http://blog.test/" {
+		t.Fatalf("status not updated %v", result.Status)
+	}
+}
+
+func TestReconcileWithoutBranchesFails(t *testing.T) {
+	sp := getTestSitePreview()
+	sp.Spec.Branches = nil
+	c := getTestController(t, sp)
+	err := c.reconcile(testNamespace + "/blog")
+	if err == nil {
+		t.Fatalf("expected reconcile to fail")
+	}
+	u, err := c.client.Resource(GroupVersionResource).Namespace(testNamespace).Get(context.TODO(), "blog",
+		metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get sitepreview failed %v", err)
+	}
+	result, err := FromUnstructured(u)
+	if err != nil {
+		t.Fatalf("FromUnstructured failed %v", err)
+	}
+	if result.Status.Phase != PhaseFailed {
+		t.Fatalf("status phase should be failed %v", result.Status)
+	}
+}
+
+func TestPreviewNamespacesRoundTrip(t *testing.T) {
+	sp := getTestSitePreview()
+	size := resource.MustParse("2Gi")
+	sp.Spec.PreviewNamespaces = &PreviewNamespacesSpec{TTL: metav1.Duration{Duration: 72 * time.Hour},
+		Quota: apiv1.ResourceList{apiv1.ResourceRequestsStorage: resource.MustParse("5Gi")}, ClaimSize: &size}
+	u, err := ToUnstructured(sp)
+	if err != nil {
+		t.Fatalf("ToUnstructured failed %v", err)
+	}
+	result, err := FromUnstructured(u)
+	if err != nil {
+		t.Fatalf("FromUnstructured failed %v", err)
+	}
+	preview := result.Spec.PreviewNamespaces
+	if preview == nil || preview.TTL.Duration != 72*time.Hour || preview.ClaimSize.String() != "2Gi" ||
+		preview.Quota.Name(apiv1.ResourceRequestsStorage, resource.BinarySI).String() != "5Gi" {
+		t.Fatalf("preview namespaces did not round trip %v", preview)
+	}
+}
+
+func TestBranchRenderSpecPreviewNamespace(t *testing.T) {
+	sp := getTestSitePreview()
+	sp.Spec.PreviewNamespaces = &PreviewNamespacesSpec{}
+	lrm, err := llrm.CreateLocalRepoManager(t.TempDir(), nil, true, nil, "")
+	if err != nil {
+		t.Fatalf("create localrepomanager failed %v", err)
+	}
+	st := &site{lrm: lrm, spec: sp.Spec}
+	key := testNamespace + "/blog"
+	spec := branchRenderSpec(key, st, "feature/foo", jobmanager.RenderSpec{RenderClaim: "render",
+		RenderSubPath: "featurefoo"})
+	if spec.Namespace != previewNamespace(testNamespace, "blog", "feature/foo") ||
+		!strings.HasPrefix(spec.Namespace, "testns-blog-feature-foo-") || spec.RenderClaim != kubelayer.PreviewRenderClaim ||
+		spec.RenderSubPath != "" {
+		t.Fatalf("preview branch should render into its own namespace %+v", spec)
+	}
+	spec = branchRenderSpec(key, st, "main", jobmanager.RenderSpec{RenderClaim: "render"})
+	if spec.Namespace != "" || spec.RenderClaim != "render" {
+		t.Fatalf("published branch should render into the site's namespace %+v", spec)
+	}
+	siteSecret := &apiv1.SecretKeySelector{LocalObjectReference: apiv1.LocalObjectReference{Name: "blog-git"},
+		Key: "token"}
+	spec = branchRenderSpec(key, st, "feature/foo", jobmanager.RenderSpec{CloneTokenSecret: siteSecret})
+	if spec.CloneTokenSecret.Name != kubelayer.PreviewTokenSecret ||
+		spec.CloneTokenSecret.Key != kubelayer.PreviewTokenKey {
+		t.Fatalf("preview branch should clone with the token copied into its namespace %v", spec.CloneTokenSecret)
+	}
+	spec = branchRenderSpec(key, st, "main", jobmanager.RenderSpec{CloneTokenSecret: siteSecret})
+	if spec.CloneTokenSecret != siteSecret {
+		t.Fatalf("published branch should clone with the site's secret %v", spec.CloneTokenSecret)
+	}
+	if result := branchURL(key, st, "feature/foo"); result != "http://previewd-nginx."+
+		previewNamespace(testNamespace, "blog", "feature/foo")+".svc.cluster.local/" {
+		t.Fatalf("incorrect url for preview namespace %v", result)
+	}
+
+	long := previewNamespace(testNamespace, "a-site-with-a-very-long-name", "feature/a-very-long-branch-name")
+	if len(long) > maxNamespaceLength || long == previewNamespace(testNamespace, "a-site-with-a-very-long-name",
+		"feature/a-very-long-branch-name2") {
+		t.Fatalf("long namespace names should be shortened uniquely %v", long)
+	}
+	if previewNamespace(testNamespace, "blog", "feature-a") == previewNamespace(testNamespace, "blog", "featurea") {
+		t.Fatalf("branches with similar names should not share a namespace")
+	}
+	for _, name := range []string{long, previewNamespace(testNamespace, "blog.example.com", "Feature/A_b"),
+		previewNamespace(testNamespace, "blog", "-")} {
+		if errs := validation.IsDNS1123Label(name); len(errs) != 0 {
+			t.Fatalf("%v is not a valid namespace name %v", name, errs)
+		}
+	}
+}
+
+func TestPreviewDeletedClearsStatus(t *testing.T) {
+	sp := getTestSitePreview()
+	c := getTestController(t, sp)
+	key := testNamespace + "/blog"
+	name := previewNamespace(testNamespace, "blog", "feature/foo")
+	c.sites[key] = &site{spec: sp.Spec, status: SitePreviewStatus{Phase: PhaseSucceeded,
+		PreviewURL: previewNamespaceURL(name)}}
+	c.previews[name] = key
+	ns := &apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name,
+		Annotations: map[string]string{jobmanager.BranchAnnotation: "feature/foo"}}}
+	c.previewDeleted(key, ns, "ttl expired")
+	if c.sites[key].status.PreviewURL != "" || c.queue.Len() != 1 {
+		t.Fatalf("preview url of deleted namespace should be cleared and the site queued %v",
+			c.sites[key].status)
+	}
+	if _, ok := c.previews[name]; ok {
+		t.Fatalf("deleted namespace not forgotten")
+	}
+}
+
+func TestPreviewExpired(t *testing.T) {
+	sp := getTestSitePreview()
+	sp.Spec.PreviewNamespaces = &PreviewNamespacesSpec{TTL: metav1.Duration{Duration: time.Hour}}
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	ns := &apiv1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "testns-blog-featurefoo",
+		Annotations: map[string]string{jobmanager.BranchAnnotation: "feature/foo",
+			lastBuildAnnotation: now.Add(-30 * time.Minute).Format(time.RFC3339)}}}
+	if expired, reason := previewExpired(ns, &sp.Spec, now); expired {
+		t.Fatalf("recently built preview should be kept: %v", reason)
+	}
+	if expired, _ := previewExpired(ns, &sp.Spec, now.Add(time.Hour)); !expired {
+		t.Fatalf("preview should expire after ttl")
+	}
+	if expired, _ := previewExpired(ns, nil, now); !expired {
+		t.Fatalf("preview of deleted site should be deleted")
+	}
+	sp.Spec.Branches = []string{"main"}
+	if expired, _ := previewExpired(ns, &sp.Spec, now); !expired {
+		t.Fatalf("preview of removed branch should be deleted")
+	}
+	sp.Spec.Branches = []string{"main", "feature/foo"}
+	sp.Spec.PreviewNamespaces.TTL.Duration = 0
+	if expired, _ := previewExpired(ns, &sp.Spec, now.Add(24*time.Hour)); expired {
+		t.Fatalf("preview without ttl should be kept")
+	}
+}
+
+func TestPreviewNamespacesRequireCloneInJob(t *testing.T) {
+	sp := getTestSitePreview()
+	sp.Spec.PreviewNamespaces = &PreviewNamespacesSpec{}
+	c := getTestController(t, sp)
+	_, err := c.newSite(testNamespace+"/blog", sp)
+	if err == nil || !strings.Contains(err.Error(), "cloneInJob") {
+		t.Fatalf("expected previewNamespaces without cloneInJob to fail %v", err)
+	}
+}
+
+func TestReadToken(t *testing.T) {
+	secret := &apiv1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: "blog-git", Namespace: testNamespace},
+		Data:       map[string][]byte{"token": []byte("secrettoken\n"), "gitea": []byte("giteatoken")},
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), &unstructured.Unstructured{Object: content})
+	c := newControllerWithClient(client, nil, t.TempDir(), testNamespace)
+	selector := apiv1.SecretKeySelector{LocalObjectReference: apiv1.LocalObjectReference{Name: "blog-git"}}
+	token, err := c.readToken(testNamespace, selector)
+	if err != nil || token != "secrettoken" {
+		t.Fatalf("unexpected token %v %v", token, err)
+	}
+	selector.Key = "gitea"
+	token, err = c.readToken(testNamespace, selector)
+	if err != nil || token != "giteatoken" {
+		t.Fatalf("unexpected token for key %v %v", token, err)
+	}
+	selector.Key = "missing"
+	_, err = c.readToken(testNamespace, selector)
+	if err == nil {
+		t.Fatalf("expected missing key to fail")
+	}
+}
+
+// createTestRepo creates a repo whose index.md holds the name of each of branches
+func createTestRepo(t *testing.T, branches ...string) string {
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, branch := range branches {
+		if i > 0 {
+			err = wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branch), Create: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = os.WriteFile(path.Join(dir, "index.md"), []byte(branch), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wt.Add("index.md")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = wt.Commit(branch, &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(branches[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDefaultLocalDirMountsSiteDir(t *testing.T) {
+	sp := getTestSitePreview()
+	sp.Spec.Repo = createTestRepo(t, "master", "feature")
+	sp.Spec.Branches = []string{"master", "feature"}
+	sp.Spec.Renderer = RendererSpec{Command: []string{"sh", "-c", "--"},
+		Args: []string{"cp /src/source/index.md /site/index.html"}}
+	u, err := ToUnstructured(sp)
+	if err != nil {
+		t.Fatalf("ToUnstructured failed %v", err)
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{GroupVersionResource: "SitePreviewList"}, u)
+	rootDir, siteDir := t.TempDir(), t.TempDir()
+	jm, err := jobmanager.NewLocalJobmanager(rootDir, map[string]string{"/src": rootDir, "/site": siteDir})
+	if err != nil {
+		t.Fatalf("unable to create local jobmanager %v", err)
+	}
+	c := newControllerWithClient(client, jm, rootDir, testNamespace)
+	done := make(chan bool, 2)
+	jm.AddBuildObserver(func(job *batchv1.Job, succeeded bool) { done <- succeeded })
+	err = c.informer.GetIndexer().Add(u)
+	if err != nil {
+		t.Fatalf("unable to add sitepreview to indexer %v", err)
+	}
+
+	key := testNamespace + "/blog"
+	for _, branch := range []struct{ name, subPath, output string }{
+		{"master", "testns/blog", "index.html"},
+		{"feature", "testns/blog/worktrees/feature-2ad56231", "feature-2ad56231/index.html"},
+	} {
+		err = c.reconcile(key)
+		if err != nil {
+			t.Fatalf("reconcile failed %v", err)
+		}
+		if spec := c.sites[key].lrm.RenderSpec(); spec.SourceSubPath != branch.subPath {
+			t.Fatalf("render job for %v should mount %v of the source claim, not %v", branch.name, branch.subPath,
+				spec.SourceSubPath)
+		}
+		select {
+		case succeeded := <-done:
+			if !succeeded {
+				t.Fatalf("render of %v failed", branch.name)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no build completion before 10 second timeout")
+		}
+		content, err := os.ReadFile(path.Join(siteDir, branch.output))
+		if err != nil || string(content) != branch.name {
+			t.Fatalf("render of %v did not read its source %q %v", branch.name, content, err)
+		}
+	}
+}
+
+// commitTestRepo commits content to index.md of the checked out branch of the repo in dir
+func commitTestRepo(t *testing.T, dir string, content string) string {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path.Join(dir, "index.md"), []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = wt.Add("index.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := wt.Commit(content, &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash.String()
+}
+
+func TestPollRendersPush(t *testing.T) {
+	sp := getTestSitePreview()
+	repoDir := createTestRepo(t, "master")
+	sp.Spec.Repo = repoDir
+	sp.Spec.Branches = []string{"master"}
+	sp.Spec.Renderer = RendererSpec{Command: []string{"sh", "-c", "--"},
+		Args: []string{"cp /src/source/index.md /site/index.html"}}
+	u, err := ToUnstructured(sp)
+	if err != nil {
+		t.Fatalf("ToUnstructured failed %v", err)
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{GroupVersionResource: "SitePreviewList"}, u)
+	rootDir, siteDir := t.TempDir(), t.TempDir()
+	jm, err := jobmanager.NewLocalJobmanager(rootDir, map[string]string{"/src": rootDir, "/site": siteDir})
+	if err != nil {
+		t.Fatalf("unable to create local jobmanager %v", err)
+	}
+	c := newControllerWithClient(client, jm, rootDir, testNamespace)
+	c.SetPolling(10*time.Millisecond, 0, time.Second)
+	done := make(chan bool, 2)
+	jm.AddBuildObserver(func(job *batchv1.Job, succeeded bool) { done <- succeeded })
+	err = c.informer.GetIndexer().Add(u)
+	if err != nil {
+		t.Fatalf("unable to add sitepreview to indexer %v", err)
+	}
+	key := testNamespace + "/blog"
+	defer c.Stop()
+
+	for _, content := range []string{"master", "pushed"} {
+		commit := ""
+		if content != "master" {
+			// pushed before or after the first poll, which compares heads with the commits built
+			commit = commitTestRepo(t, repoDir, content)
+			waitForPending(t, c, key)
+		}
+		err = c.reconcile(key)
+		if err != nil {
+			t.Fatalf("reconcile failed %v", err)
+		}
+		select {
+		case succeeded := <-done:
+			if !succeeded {
+				t.Fatalf("render of %v failed", content)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no build completion before 10 second timeout")
+		}
+		output, err := os.ReadFile(path.Join(siteDir, "index.html"))
+		if err != nil || string(output) != content {
+			t.Fatalf("render did not read %v %q %v", content, output, err)
+		}
+		if commit != "" && c.sites[key].lrm.BuiltCommit("master") != commit {
+			t.Fatalf("pushed commit %v not built, built %v", commit, c.sites[key].lrm.BuiltCommit("master"))
+		}
+	}
+}
+
+// waitForPending waits for a branch of the site to be queued for rendering
+func waitForPending(t *testing.T, c *Controller, key string) {
+	for start := time.Now(); time.Since(start) < 10*time.Second; time.Sleep(10 * time.Millisecond) {
+		c.mu.Lock()
+		pending := len(c.sites[key].pending)
+		c.mu.Unlock()
+		if pending > 0 {
+			return
+		}
+	}
+	t.Fatalf("no branch queued before 10 second timeout")
+}
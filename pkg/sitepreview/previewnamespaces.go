@@ -0,0 +1,238 @@
+package sitepreview
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/clarkezone/previewd/pkg/jobmanager"
+	"github.com/clarkezone/previewd/pkg/kubelayer"
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+const (
+	// siteNamespaceLabel records the namespace of the SitePreview that owns a preview namespace,
+	// the SitePreview's name is recorded in the jobmanager.SiteLabel
+	siteNamespaceLabel = "previewd.io/site-namespace"
+	// lastBuildAnnotation records when a preview namespace's branch was last built
+	lastBuildAnnotation = "previewd.io/last-build"
+
+	previewSweepInterval = time.Minute
+	maxNamespaceLength   = 63
+	hashSuffixLength     = 8
+)
+
+// nonDNSLabel matches the characters that cannot appear in a namespace name
+var nonDNSLabel = regexp.MustCompile("[^a-z0-9-]+")
+
+// usesPreviewNamespace returns true if branch is rendered in a namespace of its own
+func usesPreviewNamespace(spec SitePreviewSpec, branch string) bool {
+	return spec.PreviewNamespaces != nil && len(spec.Branches) > 0 && branch != spec.Branches[0]
+}
+
+// previewNamespace returns the name of the namespace a site's branch is previewed in, a DNS label made
+// from the site's namespace, name and branch and suffixed with a hash of them so that branches that
+// sanitize to the same name, eg feature-a and featurea, and names shortened to fit never share a namespace
+func previewNamespace(siteNamespace string, site string, branch string) string {
+	sum := sha256.Sum256([]byte(siteNamespace + "/" + site + "/" + branch))
+	suffix := hex.EncodeToString(sum[:])[:hashSuffixLength]
+	name := strings.ToLower(fmt.Sprintf("%v-%v-%v", siteNamespace, site, branch))
+	name = nonDNSLabel.ReplaceAllString(name, "-")
+	if len(name) > maxNamespaceLength-len(suffix)-1 {
+		name = name[:maxNamespaceLength-len(suffix)-1]
+	}
+	return strings.Trim(name, "-") + "-" + suffix
+}
+
+// previewNamespaceURL returns the in-cluster url of the service serving a preview namespace
+func previewNamespaceURL(namespace string) string {
+	return fmt.Sprintf("http://%v.%v.svc.cluster.local/", kubelayer.PreviewServiceName, namespace)
+}
+
+// branchRenderSpec renders branches that use a preview namespace into the root of that namespace's
+// render claim, cloning with the copy of the site's token made by ensurePreviewNamespace
+func branchRenderSpec(key string, st *site, branch string, spec jobmanager.RenderSpec) jobmanager.RenderSpec {
+	if !usesPreviewNamespace(st.spec, branch) {
+		return spec
+	}
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	spec.Namespace = previewNamespace(namespace, name, branch)
+	spec.RenderClaim = kubelayer.PreviewRenderClaim
+	spec.RenderSubPath = ""
+	if spec.CloneTokenSecret != nil {
+		spec.CloneTokenSecret = &apiv1.SecretKeySelector{
+			LocalObjectReference: apiv1.LocalObjectReference{Name: kubelayer.PreviewTokenSecret},
+			Key:                  kubelayer.PreviewTokenKey}
+	}
+	return spec
+}
+
+// branchURL returns the url a site's branch is served from
+func branchURL(key string, st *site, branch string) string {
+	if usesPreviewNamespace(st.spec, branch) {
+		namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+		return previewNamespaceURL(previewNamespace(namespace, name, branch))
+	}
+	return previewURL(st.spec, st.lrm, branch)
+}
+
+// ensurePreviewNamespace creates or refreshes the preview namespace of a site's branch before it is built.
+// The site's token is copied into the namespace on every build so that a rotated token is picked up.
+func (c *Controller) ensurePreviewNamespace(key string, st *site, branch string) error {
+	if c.jm == nil || c.jm.KubeSession() == nil {
+		return fmt.Errorf("preview namespaces require the kube executor")
+	}
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	preview := st.spec.PreviewNamespaces
+	token := ""
+	if st.spec.Auth != nil {
+		var err error
+		token, err = c.readToken(namespace, st.spec.Auth.TokenSecret)
+		if err != nil {
+			return err
+		}
+	}
+	env := kubelayer.PreviewEnvironment{
+		Namespace: previewNamespace(namespace, name, branch),
+		Labels:    map[string]string{jobmanager.SiteLabel: name, siteNamespaceLabel: namespace},
+		Annotations: map[string]string{jobmanager.BranchAnnotation: branch,
+			lastBuildAnnotation: time.Now().UTC().Format(time.RFC3339)},
+		Quota:            preview.Quota,
+		ClaimSize:        preview.ClaimSize,
+		StorageClassName: preview.StorageClassName,
+		AccessMode:       preview.AccessMode,
+		NginxImage:       preview.NginxImage,
+		Token:            token,
+	}
+	err := c.jm.KubeSession().EnsurePreviewEnvironment(env)
+	if err != nil {
+		return fmt.Errorf("unable to provision preview namespace %v: %w", env.Namespace, err)
+	}
+	c.mu.Lock()
+	c.previews[env.Namespace] = key
+	c.mu.Unlock()
+	return nil
+}
+
+// sweepPreviewNamespaces periodically deletes expired preview namespaces until the controller is stopped
+func (c *Controller) sweepPreviewNamespaces() {
+	ticker := time.NewTicker(previewSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			err := c.deleteExpiredPreviews(time.Now())
+			if err != nil {
+				clarkezoneLog.Errorf("sitepreview: unable to delete expired preview namespaces: %v", err)
+			}
+		}
+	}
+}
+
+// deleteExpiredPreviews deletes the preview namespaces of deleted sites and branches, and those that
+// have outlived their TTL
+func (c *Controller) deleteExpiredPreviews(now time.Time) error {
+	ks := c.jm.KubeSession()
+	selector := siteNamespaceLabel
+	if c.namespace != "" {
+		// sites in other namespaces are not watched so cannot tell if their previews expired
+		selector += "=" + c.namespace
+	}
+	namespaces, err := ks.ListNamespaces(selector)
+	if err != nil {
+		return err
+	}
+	for i := range namespaces {
+		ns := &namespaces[i]
+		if ns.DeletionTimestamp != nil {
+			continue
+		}
+		key := ns.Labels[siteNamespaceLabel] + "/" + ns.Labels[jobmanager.SiteLabel]
+		var spec *SitePreviewSpec
+		obj, exists, err := c.informer.GetIndexer().GetByKey(key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			sp, err := FromUnstructured(obj.(*unstructured.Unstructured))
+			if err != nil {
+				return err
+			}
+			spec = &sp.Spec
+		}
+		expired, reason := previewExpired(ns, spec, now)
+		if !expired {
+			continue
+		}
+		clarkezoneLog.Infof("sitepreview: deleting preview namespace %v of %v: %v", ns.Name, key, reason)
+		err = ks.DeleteNamespace(ns.Name, nil)
+		if err != nil {
+			return err
+		}
+		c.previewDeleted(key, ns, reason)
+	}
+	return nil
+}
+
+// previewDeleted forgets a deleted preview namespace and clears the site's preview url if it points at
+// the namespace, queueing the site so that its status is updated.  The namespace is provisioned again
+// when the branch is next built.
+func (c *Controller) previewDeleted(key string, ns *apiv1.Namespace, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.previews, ns.Name)
+	st, ok := c.sites[key]
+	if !ok || st.status.PreviewURL != previewNamespaceURL(ns.Name) {
+		return
+	}
+	st.status.PreviewURL = ""
+	st.status.Message = fmt.Sprintf("preview namespace %v of branch %v deleted: %v", ns.Name,
+		ns.Annotations[jobmanager.BranchAnnotation], reason)
+	c.queue.Add(key)
+}
+
+// previewExpired returns true and the reason if a preview namespace should be deleted, spec is nil
+// if the site it belongs to has been deleted
+func previewExpired(ns *apiv1.Namespace, spec *SitePreviewSpec, now time.Time) (bool, string) {
+	if spec == nil {
+		return true, "site deleted"
+	}
+	if spec.PreviewNamespaces == nil {
+		return true, "preview namespaces disabled"
+	}
+	branch := ns.Annotations[jobmanager.BranchAnnotation]
+	if !usesPreviewNamespace(*spec, branch) || !contains(spec.Branches, branch) {
+		return true, fmt.Sprintf("branch %v removed", branch)
+	}
+	ttl := spec.PreviewNamespaces.TTL.Duration
+	if ttl <= 0 {
+		return false, ""
+	}
+	lastBuild, err := time.Parse(time.RFC3339, ns.Annotations[lastBuildAnnotation])
+	if err != nil {
+		// never recorded, fall back to when the namespace was created
+		lastBuild = ns.CreationTimestamp.Time
+	}
+	if now.Sub(lastBuild) < ttl {
+		return false, ""
+	}
+	return true, fmt.Sprintf("branch %v not built since %v", branch, lastBuild.Format(time.RFC3339))
+}
+
+func contains(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
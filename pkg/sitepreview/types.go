@@ -0,0 +1,202 @@
+// Package sitepreview contains the SitePreview custom resource and a controller that reconciles it
+package sitepreview
+
+import (
+	"fmt"
+
+	apiv1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/clarkezone/previewd/pkg/kubelayer"
+)
+
+const (
+	// Group is the API group of the SitePreview resource
+	Group = "previewd.io"
+	// Version is the API version of the SitePreview resource
+	Version = "v1alpha1"
+	// Kind is the kind of the SitePreview resource
+	Kind = "SitePreview"
+	// Resource is the plural resource name of SitePreview
+	Resource = "sitepreviews"
+
+	// PhasePending indicates the site has not been built yet
+	PhasePending = "Pending"
+	// PhaseBuilding indicates a render job is queued or running for the site
+	PhaseBuilding = "Building"
+	// PhaseSucceeded indicates the last render job succeeded
+	PhaseSucceeded = "Succeeded"
+	// PhaseFailed indicates the last clone or render job failed
+	PhaseFailed = "Failed"
+)
+
+// GroupVersionResource identifies SitePreview resources for the dynamic client
+var GroupVersionResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: Resource}
+
+// SitePreview describes a static site that previewd clones, renders and publishes
+type SitePreview struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   SitePreviewSpec   `json:"spec"`
+	Status SitePreviewStatus `json:"status,omitempty"`
+}
+
+// SitePreviewSpec is the desired state of a site
+type SitePreviewSpec struct {
+	// Repo is the url of the git repo containing the site source
+	Repo string `json:"repo"`
+	// Branches are rendered in order, the first branch is the published branch
+	Branches []string `json:"branches"`
+	// Auth authenticates cloning a private repo
+	Auth *RepoAuthSpec `json:"auth,omitempty"`
+	// LocalDir is the path inside the previewd pod where the source volume is mounted, by default the site
+	// is cloned into <namespace>/<name> of the source claim mounted at the controller's localdir
+	LocalDir string `json:"localDir,omitempty"`
+	// Clone limits how much of the repo is cloned
+	Clone *CloneSpec `json:"clone,omitempty"`
+	// CloneInJob fetches the commit being built inside each render job rather than mounting a source claim
+	CloneInJob bool `json:"cloneInJob,omitempty"`
+	// Renderer overrides the default Jekyll render image and command
+	Renderer RendererSpec `json:"renderer,omitempty"`
+	// Volumes names the claims used by render jobs
+	Volumes VolumesSpec `json:"volumes,omitempty"`
+	// Publish controls how rendered output is exposed
+	Publish PublishSpec `json:"publish,omitempty"`
+	// PreviewNamespaces renders and serves every branch but the first in a namespace of its own
+	PreviewNamespaces *PreviewNamespacesSpec `json:"previewNamespaces,omitempty"`
+}
+
+// RepoAuthSpec authenticates with a personal access token read from a Secret in the SitePreview's namespace
+type RepoAuthSpec struct {
+	// TokenSecret selects the key holding the token, token if the key is empty
+	TokenSecret apiv1.SecretKeySelector `json:"tokenSecret"`
+	// Username is sent with the token, Gitea and GitLab require the token's owner
+	Username string `json:"username,omitempty"`
+}
+
+// CloneSpec limits the history, branches and tags cloned for large repos and selects cloning submodules
+type CloneSpec struct {
+	// Depth truncates history to the given number of commits, 0 for full history
+	Depth int `json:"depth,omitempty"`
+	// SingleBranch clones only the default branch, other branches are fetched when built
+	SingleBranch bool `json:"singleBranch,omitempty"`
+	// NoTags skips fetching tags
+	NoTags bool `json:"noTags,omitempty"`
+	// Submodules initializes and updates submodules recursively, eg themes
+	Submodules bool `json:"submodules,omitempty"`
+}
+
+// RendererSpec describes the image and command used to render a site
+type RendererSpec struct {
+	Image   string   `json:"image,omitempty"`
+	Command []string `json:"command,omitempty"`
+	Args    []string `json:"args,omitempty"`
+	// Env and EnvFrom set environment variables of the renderer, including values from Secret and ConfigMap keys
+	Env     []apiv1.EnvVar        `json:"env,omitempty"`
+	EnvFrom []apiv1.EnvFromSource `json:"envFrom,omitempty"`
+}
+
+// VolumesSpec identifies the persistent volume claims used by render jobs by exact name
+// or by label selector, eg previewd.io/role=render,previewd.io/site=blog
+type VolumesSpec struct {
+	// RenderClaim is mounted at /site and receives rendered output
+	RenderClaim string `json:"renderClaim,omitempty"`
+	// SourceClaim is mounted at /src and must be the volume mounted at LocalDir
+	SourceClaim string `json:"sourceClaim,omitempty"`
+	// Extra volumes are mounted into render pods, eg configuration overrides or API keys
+	Extra []ExtraVolume `json:"extra,omitempty"`
+}
+
+// ExtraVolume mounts exactly one of a ConfigMap, Secret, emptyDir or projected volume into render pods
+type ExtraVolume struct {
+	MountPath string `json:"mountPath"`
+	ReadOnly  bool   `json:"readOnly,omitempty"`
+	SubPath   string `json:"subPath,omitempty"`
+
+	ConfigMap *apiv1.ConfigMapVolumeSource `json:"configMap,omitempty"`
+	Secret    *apiv1.SecretVolumeSource    `json:"secret,omitempty"`
+	EmptyDir  *apiv1.EmptyDirVolumeSource  `json:"emptyDir,omitempty"`
+	Projected *apiv1.ProjectedVolumeSource `json:"projected,omitempty"`
+}
+
+// mountRef returns the mount reference used by render jobs for the volume
+func (v ExtraVolume) mountRef() (kubelayer.PVClaimMountRef, error) {
+	source := apiv1.VolumeSource{ConfigMap: v.ConfigMap, Secret: v.Secret, EmptyDir: v.EmptyDir, Projected: v.Projected}
+	count := 0
+	for _, set := range []bool{v.ConfigMap != nil, v.Secret != nil, v.EmptyDir != nil, v.Projected != nil} {
+		if set {
+			count++
+		}
+	}
+	if count != 1 || v.MountPath == "" {
+		return kubelayer.PVClaimMountRef{}, fmt.Errorf("volume mounted at '%v' must set a mountPath and exactly one "+
+			"of configMap, secret, emptyDir or projected", v.MountPath)
+	}
+	return kubelayer.PVClaimMountRef{MountPath: v.MountPath, ReadOnly: v.ReadOnly, SubPath: v.SubPath,
+		Source: &source}, nil
+}
+
+// PublishSpec describes where rendered output is served
+type PublishSpec struct {
+	// BaseURL is the url the published branch is served from
+	BaseURL string `json:"baseURL,omitempty"`
+	// BranchPreviews renders each branch into its own directory served below BaseURL
+	BranchPreviews bool `json:"branchPreviews,omitempty"`
+}
+
+// PreviewNamespacesSpec describes the namespace created for each preview branch.  Each namespace holds
+// a quota, a render claim and an nginx deployment and service serving it, and is deleted when its branch
+// is removed from the site or has not been built for TTL.
+type PreviewNamespacesSpec struct {
+	// TTL is how long a preview namespace is kept after its branch was last built, forever if zero
+	TTL metav1.Duration `json:"ttl,omitempty"`
+	// Quota is the hard limit of the ResourceQuota created in each namespace
+	Quota apiv1.ResourceList `json:"quota,omitempty"`
+	// ClaimSize is the size of the render claim, 1Gi if empty
+	ClaimSize        *resource.Quantity               `json:"claimSize,omitempty"`
+	StorageClassName string                           `json:"storageClassName,omitempty"`
+	AccessMode       apiv1.PersistentVolumeAccessMode `json:"accessMode,omitempty"`
+	// NginxImage serves the rendered branch, nginx:1.20-alpine if empty
+	NginxImage string `json:"nginxImage,omitempty"`
+}
+
+// SitePreviewStatus is the observed state of a site
+type SitePreviewStatus struct {
+	Phase              string `json:"phase,omitempty"`
+	Message            string `json:"message,omitempty"`
+	LastBranch         string `json:"lastBranch,omitempty"`
+	LastCommit         string `json:"lastCommit,omitempty"`
+	PreviewURL         string `json:"previewURL,omitempty"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+}
+
+// FromUnstructured converts an object returned by the dynamic client into a SitePreview
+func FromUnstructured(u *unstructured.Unstructured) (*SitePreview, error) {
+	sp := &SitePreview{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), sp)
+	if err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// ToUnstructured converts a SitePreview into an object that can be sent by the dynamic client
+func ToUnstructured(sp *SitePreview) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(sp)
+	if err != nil {
+		return nil, err
+	}
+	return &unstructured.Unstructured{Object: content}, nil
+}
+
+// DeepCopyWithStatus returns a copy of the SitePreview with status replaced
+func (sp *SitePreview) DeepCopyWithStatus(status SitePreviewStatus) *SitePreview {
+	updated := &SitePreview{TypeMeta: sp.TypeMeta, Spec: sp.Spec, Status: status}
+	sp.ObjectMeta.DeepCopyInto(&updated.ObjectMeta)
+	return updated
+}
@@ -0,0 +1,125 @@
+package webhooklistener
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/clarkezone/hookserve/hookserve"
+
+	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
+)
+
+// PollEventType is the type of events queued for branches whose head changed between polls
+const PollEventType = "poll"
+
+// Poller periodically lists the heads of branches on the remote, for repos whose git host cannot reach
+// previewd, and queues an event for each branch whose head changed and each branch deleted.  Events are
+// handled by the same loop as webhooks, which polling can run alongside as a safety net.
+type Poller struct {
+	heads func(branches []string) (map[string]string, error)
+	// built returns the commit of a branch last built, empty if it has not been built
+	built    func(branch string) string
+	branches []string
+	interval time.Duration
+	// jitter is the fraction each interval is randomly varied by so that polls of many sites spread out
+	jitter float64
+	// maxBackoff caps the interval, doubled after each failed poll, between failed polls
+	maxBackoff time.Duration
+	events     chan<- hookserve.Event
+	exit       <-chan bool
+	// known holds the heads seen by the last successful poll, nil until the first
+	known map[string]string
+}
+
+// NewPoller returns a Poller of branches, or every branch if branches is empty, that polls every interval
+// varied by the fraction jitter, backing off up to maxBackoff while polls fail
+func NewPoller(branches []string, interval time.Duration, jitter float64, maxBackoff time.Duration) *Poller {
+	return &Poller{branches: branches, interval: interval, jitter: jitter, maxBackoff: maxBackoff}
+}
+
+// Run polls heads and queues events to events until exit is closed.  The first poll queues events for built
+// branches whose head has moved on from the commit built returns for them.
+func (p *Poller) Run(heads func(branches []string) (map[string]string, error), built func(branch string) string,
+	events chan<- hookserve.Event, exit <-chan bool) {
+	p.heads = heads
+	p.built = built
+	p.events = events
+	p.exit = exit
+	clarkezoneLog.Infof("Polling for changes every %v", p.interval)
+	failures := 0
+	for {
+		err := p.poll()
+		if err != nil {
+			failures++
+			clarkezoneLog.Errorf("poller: poll %v failed: %v", failures, err)
+		} else {
+			failures = 0
+		}
+		timer := time.NewTimer(p.wait(failures))
+		select {
+		case <-p.exit:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// poll lists the heads of branches and queues events for those that changed since the last poll
+func (p *Poller) poll() error {
+	heads, err := p.heads(p.branches)
+	if err != nil {
+		return err
+	}
+	first := p.known == nil
+	for branch, commit := range heads {
+		if first {
+			// the head may have moved between the initial clone or build and the first poll
+			built := p.built(branch)
+			if built == "" || built == commit {
+				continue
+			}
+		} else if p.known[branch] == commit {
+			continue
+		}
+		clarkezoneLog.Infof("poller: branch %v changed to %v", branch, commit)
+		if !p.send(hookserve.Event{Type: PollEventType, Branch: branch, Commit: commit}) {
+			return nil
+		}
+	}
+	for branch := range p.known {
+		if _, ok := heads[branch]; ok {
+			continue
+		}
+		clarkezoneLog.Infof("poller: branch %v deleted", branch)
+		if !p.send(hookserve.Event{Type: deleteEventType, Branch: branch}) {
+			return nil
+		}
+	}
+	p.known = heads
+	return nil
+}
+
+// send queues event, returning false if the poller is exiting
+func (p *Poller) send(event hookserve.Event) bool {
+	select {
+	case p.events <- event:
+		return true
+	case <-p.exit:
+		return false
+	}
+}
+
+// wait returns how long to wait before the next poll, backing off exponentially after failures
+func (p *Poller) wait(failures int) time.Duration {
+	wait := p.interval
+	for i := 0; i < failures && wait < p.maxBackoff; i++ {
+		wait *= 2
+	}
+	if failures > 0 && wait > p.maxBackoff && p.maxBackoff > p.interval {
+		wait = p.maxBackoff
+	}
+	// jitter does not need a cryptographic source
+	//nolint:gosec
+	return time.Duration(float64(wait) * (1 + p.jitter*(2*rand.Float64()-1)))
+}
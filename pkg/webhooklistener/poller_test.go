@@ -0,0 +1,97 @@
+package webhooklistener
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/clarkezone/hookserve/hookserve"
+)
+
+func TestPollerPoll(t *testing.T) {
+	heads := map[string]string{"master": "a1", "feature": "b1"}
+	var err error
+	events := make(chan hookserve.Event, 10)
+	p := &Poller{events: events, exit: make(chan bool),
+		heads: func(branches []string) (map[string]string, error) {
+			result := make(map[string]string)
+			for branch, commit := range heads {
+				result[branch] = commit
+			}
+			return result, err
+		},
+		built: func(branch string) string { return "" }}
+
+	if p.poll() != nil || len(events) != 0 {
+		t.Fatalf("first poll should only record the heads of branches not built")
+	}
+	heads["feature"] = "b2"
+	heads["new"] = "c1"
+	delete(heads, "master")
+	if p.poll() != nil {
+		t.Fatalf("poll failed")
+	}
+	received := make(map[string]hookserve.Event)
+	for len(events) > 0 {
+		event := <-events
+		received[event.Branch] = event
+	}
+	changed := hookserve.Event{Type: PollEventType, Branch: "feature", Commit: "b2"}
+	if len(received) != 3 || received["feature"] != changed || received["new"].Commit != "c1" ||
+		received["master"].Type != deleteEventType {
+		t.Fatalf("unexpected events %v", received)
+	}
+
+	err = fmt.Errorf("unreachable")
+	heads["feature"] = "b3"
+	if p.poll() == nil || len(events) != 0 {
+		t.Fatalf("failed poll should queue nothing")
+	}
+	err = nil
+	if p.poll() != nil || len(events) != 1 {
+		t.Fatalf("change missed by a failed poll should be picked up by the next")
+	}
+}
+
+func TestPollerFirstPollComparesBuilt(t *testing.T) {
+	events := make(chan hookserve.Event, 10)
+	// master moved on from the commit built before the first poll, feature is up to date and new not built
+	built := map[string]string{"master": "a1", "feature": "b1"}
+	p := &Poller{events: events, exit: make(chan bool),
+		heads: func(branches []string) (map[string]string, error) {
+			return map[string]string{"master": "a2", "feature": "b1", "new": "c1"}, nil
+		},
+		built: func(branch string) string { return built[branch] }}
+
+	if p.poll() != nil || len(events) != 1 {
+		t.Fatalf("first poll should queue only the branch whose head moved since it was built, %v queued",
+			len(events))
+	}
+	changed := hookserve.Event{Type: PollEventType, Branch: "master", Commit: "a2"}
+	if event := <-events; event != changed {
+		t.Fatalf("unexpected event %v", event)
+	}
+	if p.poll() != nil || len(events) != 0 {
+		t.Fatalf("second poll should compare against the heads of the first")
+	}
+}
+
+func TestPollerWait(t *testing.T) {
+	p := &Poller{interval: time.Minute, maxBackoff: 10 * time.Minute}
+	for failures, expected := range map[int]time.Duration{0: time.Minute, 1: 2 * time.Minute, 3: 8 * time.Minute,
+		4: 10 * time.Minute, 100: 10 * time.Minute} {
+		if wait := p.wait(failures); wait != expected {
+			t.Fatalf("wait after %v failures is %v, expected %v", failures, wait, expected)
+		}
+	}
+	p.maxBackoff = 0
+	if wait := p.wait(3); wait != time.Minute {
+		t.Fatalf("no backoff expected without maxBackoff %v", wait)
+	}
+	p.jitter = 0.1
+	for i := 0; i < 100; i++ {
+		if wait := p.wait(0); wait < 54*time.Second || wait > 66*time.Second {
+			t.Fatalf("wait %v varies by more than the jitter", wait)
+		}
+	}
+}
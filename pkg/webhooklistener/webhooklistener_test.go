@@ -182,3 +182,50 @@ func Test_hookprocessing(t *testing.T) {
 		t.Errorf("shutdown failed")
 	}
 }
+
+func TestDeleteEvents(t *testing.T) {
+	wl := CreateWebhookListener(nil)
+	wl.hookserver = hs.NewServer()
+	post := func(eventType string, body *strings.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/postreceive", body)
+		req.Header.Set("X-GitHub-Event", eventType)
+		w := httptest.NewRecorder()
+		wl.getHandler()(w, req)
+		return w
+	}
+
+	for eventType, body := range map[string]string{
+		"push": `{"ref": "refs/heads/feature/one", "after": "0000000000000000000000000000000000000000",
+			"head_commit": null, "repository": {"name": "blog"}}`,
+		"delete": `{"ref": "feature/one", "ref_type": "branch", "repository": {"name": "blog"}}`,
+	} {
+		if w := post(eventType, strings.NewReader(body)); w.Code != http.StatusOK {
+			t.Fatalf("%v deleting a branch failed with %v", eventType, w.Code)
+		}
+		event := <-wl.hookserver.Events
+		if event.Type != deleteEventType || event.Branch != "feature/one" || event.Repo != "blog" {
+			t.Fatalf("%v deleting a branch not recognised %v", eventType, event)
+		}
+	}
+
+	if _, deleted, _ := deleteEvent("push", []byte(`{"ref": "refs/heads/feature", "deleted": true}`)); !deleted {
+		t.Fatalf("push marked deleted not recognised")
+	}
+	if _, deleted, _ := deleteEvent("delete", []byte(`{"ref": "v1", "ref_type": "tag"}`)); deleted {
+		t.Fatalf("deleted tags should be ignored")
+	}
+	if _, deleted, _ := deleteEvent("push", []byte(`{"ref": "refs/tags/v1", "deleted": true}`)); deleted {
+		t.Fatalf("deleted tags should be ignored")
+	}
+	if w := post("push", strings.NewReader("not json")); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad payload accepted")
+	}
+
+	w := post("push", GetBody())
+	if w.Code != http.StatusOK {
+		t.Fatalf("push not passed to hookserve %v", w.Code)
+	}
+	if event := <-wl.hookserver.Events; event.Type != "push" || event.Branch != "master" {
+		t.Fatalf("push not parsed %v", event)
+	}
+}
@@ -2,7 +2,12 @@
 package webhooklistener
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/clarkezone/previewd/pkg/basicserver"
 	lrm "github.com/clarkezone/previewd/pkg/localrepomanager"
@@ -11,6 +16,25 @@ import (
 	clarkezoneLog "github.com/clarkezone/previewd/pkg/log"
 )
 
+const (
+	// deleteEventType is the type of events queued for deleted branches, which hookserve ignores
+	deleteEventType = "delete"
+	// zeroCommit is the head of a branch deleted by a push
+	zeroCommit   = "0000000000000000000000000000000000000000"
+	branchPrefix = "refs/heads/"
+)
+
+// deletePayload is the part of push and delete payloads identifying a deleted branch
+type deletePayload struct {
+	Ref        string `json:"ref"`
+	RefType    string `json:"ref_type"`
+	After      string `json:"after"`
+	Deleted    bool   `json:"deleted"`
+	Repository struct {
+		Name string `json:"name"`
+	} `json:"repository"`
+}
+
 // WebhookListener struct holds state for webhook
 type WebhookListener struct {
 	lrm          *lrm.LocalRepoManager
@@ -18,6 +42,7 @@ type WebhookListener struct {
 	hookserver   *hookserve.Server
 	basicServer  *basicserver.BasicServer
 	exitchan     chan bool
+	poller       *Poller
 }
 
 // CreateWebhookListener creates a new instance of WebhookListener
@@ -41,9 +66,21 @@ func (wl *WebhookListener) StartListen(secret string) {
 	wrappedMux = basicserver.NewPromMetricsMiddleware("previewd_webhook", wrappedMux)
 
 	go wl.getHookProcessor()()
+	if wl.poller != nil && wl.lrm != nil {
+		go wl.poller.Run(wl.lrm.RemoteHeads, wl.lrm.BuiltCommit, wl.hookserver.Events, wl.exitchan)
+	}
 	wl.basicServer.StartListen(secret, wrappedMux)
 }
 
+// SetPolling polls the remote for changes to branches, or every branch if branches is empty, every
+// interval varied by the fraction jitter, backing off up to maxBackoff while polls fail.  Changes are
+// built as if a webhook had been received for them, commits that a webhook already built are not built
+// again.  Must be called before StartListen.
+func (wl *WebhookListener) SetPolling(branches []string, interval time.Duration, jitter float64,
+	maxBackoff time.Duration) {
+	wl.poller = NewPoller(branches, interval, jitter, maxBackoff)
+}
+
 // WaitForInterupt waits for user to ctrl c to exit
 func (wl *WebhookListener) WaitForInterupt() error {
 	clarkezoneLog.Infof("Waiting for user to interrupt")
@@ -52,11 +89,60 @@ func (wl *WebhookListener) WaitForInterupt() error {
 
 func (wl *WebhookListener) getHandler() func(w http.ResponseWriter, r *http.Request) {
 	responsewriter := func(w http.ResponseWriter, r *http.Request) {
+		// hookserve drops pushes deleting a branch and rejects delete events, so both are handled here
+		eventType := r.Header.Get("X-GitHub-Event")
+		if r.Method == http.MethodPost && r.URL.Path == wl.hookserver.Path &&
+			(eventType == "push" || eventType == deleteEventType) {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			event, deleted, err := deleteEvent(eventType, body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if deleted {
+				go func() {
+					wl.hookserver.Events <- event
+				}()
+				_, _ = w.Write([]byte(event.String()))
+				return
+			}
+			if eventType == deleteEventType {
+				// a deleted tag
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
 		wl.hookserver.ServeHTTP(w, r)
 	}
 	return responsewriter
 }
 
+// deleteEvent returns an event for the branch deleted by a webhook, either a push to a branch that is
+// marked deleted or whose head is the zero commit, as GitHub and Gitea send, or a delete event for a
+// branch.  It returns false for any other webhook.
+func deleteEvent(eventType string, body []byte) (hookserve.Event, bool, error) {
+	var payload deletePayload
+	err := json.Unmarshal(body, &payload)
+	if err != nil {
+		return hookserve.Event{}, false, err
+	}
+	event := hookserve.Event{Type: deleteEventType, Repo: payload.Repository.Name}
+	switch {
+	case eventType == deleteEventType && payload.RefType == "branch":
+		event.Branch = payload.Ref
+	case eventType == "push" && strings.HasPrefix(payload.Ref, branchPrefix) &&
+		(payload.Deleted || payload.After == zeroCommit):
+		event.Branch = strings.TrimPrefix(payload.Ref, branchPrefix)
+	default:
+		return hookserve.Event{}, false, nil
+	}
+	return event, event.Branch != "", nil
+}
+
 func (wl *WebhookListener) getHookProcessor() func() {
 	return func() {
 		clarkezoneLog.Debugf("WebhookListener: processing loop started")
@@ -73,7 +159,19 @@ func (wl *WebhookListener) getHookProcessor() func() {
 					clarkezoneLog.Debugf("WebhookListener: Webhook event ignored as lrm is not initialized")
 					break
 				}
-				err := wl.lrm.HandleWebhook(event.Branch, wl.initialBuild)
+				if event.Type == PollEventType && wl.lrm.BuiltCommit(event.Branch) == event.Commit {
+					clarkezoneLog.Debugf("WebhookListener: commit %v of %v already built", event.Commit, event.Branch)
+					break
+				}
+				if event.Type == deleteEventType {
+					err := wl.lrm.DeleteBranch(event.Branch)
+					if err != nil {
+						clarkezoneLog.Errorf("WebhookListener:DeleteBranch failed:%v", err)
+					}
+					break
+				}
+				// build the pushed commit, the branch may have moved on by the time it is fetched
+				err := wl.lrm.HandleWebhook(event.Branch, event.Commit, wl.initialBuild)
 				if err != nil {
 					clarkezoneLog.Errorf("WebhookListener:HandleWebhook failed:%v", err)
 				}